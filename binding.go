@@ -3,13 +3,10 @@ package nrv
 import (
 	"fmt"
 	"reflect"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 )
 
-var paramReplaceRegexp = regexp.MustCompile("\\(.*?\\)")
-
 type CallHandler interface {
 	InitHandler(binding *Binding)
 	SetNextHandler(handler CallHandler)
@@ -23,29 +20,118 @@ type Pattern interface {
 	CallHandler
 }
 
+// Implemented by call handlers that run background goroutines so that they can be
+// stopped with the cluster and started again
+type HandlerLifecycle interface {
+	StartHandler()
+	StopHandler()
+}
+
+// Creates a call handler to be inserted in a binding's chain. Service and cluster
+// interceptors are given as factories since each binding needs its own handler
+// instance to link in its chain.
+type InterceptorFactory func() CallHandler
+
+// Base that can be embedded by call handlers that only need to act on some requests.
+// Requests are passed through to the next (send) or previous (receive) handler.
+type BaseHandler struct {
+	binding         *Binding
+	nextHandler     CallHandler
+	previousHandler CallHandler
+}
+
+func (h *BaseHandler) InitHandler(binding *Binding) {
+	h.binding = binding
+}
+
+func (h *BaseHandler) SetNextHandler(handler CallHandler) {
+	h.nextHandler = handler
+}
+
+func (h *BaseHandler) SetPreviousHandler(handler CallHandler) {
+	h.previousHandler = handler
+}
+
+func (h *BaseHandler) Binding() *Binding {
+	return h.binding
+}
+
+func (h *BaseHandler) NextHandler() CallHandler {
+	return h.nextHandler
+}
+
+func (h *BaseHandler) PreviousHandler() CallHandler {
+	return h.previousHandler
+}
+
+func (h *BaseHandler) HandleRequestSend(request *Request) *Request {
+	return h.nextHandler.HandleRequestSend(request)
+}
+
+func (h *BaseHandler) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
+	return h.previousHandler.HandleRequestReceive(request)
+}
+
 type Binding struct {
 	cluster Cluster
 	service *Service
 
-	Path     string
-	nbParams int
-	pathRe   *regexp.Regexp
+	// Path regex, parameters can be named and typed: /users/{id:int}/posts/{slug}
+	Path string
+	path *bindingPath
+
+	// HTTP methods accepted by the binding, any if empty
+	Methods []string
+
+	RequestLogger  *RequestLogger
+	RequestMetrics *RequestMetrics
+	Pattern        Pattern
+	Resolver       Resolver
+	Consensus      ConsensusManager
+	Persistence    PersistenceManager
+	Protocol       Protocol
 
-	RequestLogger *RequestLogger
-	Pattern       Pattern
-	Resolver      Resolver
-	Consensus     ConsensusManager
-	Persistence   PersistenceManager
-	Protocol      Protocol
+	// Stops sending requests to nodes that keep failing, if set
+	CircuitBreaker *CircuitBreaker
+
+	// Sends requests to replicas one after the other instead of all at once, if set
+	Hedging *Hedging
+
+	// User handlers inserted after the request logger, before resolving. Cluster
+	// interceptors come first, then service ones, then these.
+	Interceptors []CallHandler
+	handlers     []CallHandler
 
 	Timeout  int
 	MaxRetry int
 
+	// Sends messages that need no reply over UDP when the protocol supports it and
+	// they fit in MAX_UDP_SIZE, TCP being used otherwise. If UDPRetries is over 0,
+	// datagrams are acknowledged and sent again up to that many times if no ack
+	// is received.
+	UDP        bool
+	UDPRetries int
+
+	// Maximum number of requests received through the binding's protocol handled at
+	// once, including the ones this node sends to itself, 0 for no limit. Requests
+	// over it wait in a queue of MaxQueue requests and, when it's full, are refused
+	// with ERROR_BUSY according to the Shedding policy (SHED_NEWEST or SHED_OLDEST).
+	// Requests received over HTTP aren't limited.
+	MaxConcurrency int
+	MaxQueue       int
+	Shedding       int
+	limiter        *receiveLimiter
+
 	Controller interface{}
 	Method     string
 	Closure    func(request *ReceivedRequest)
-	rflMethod  *reflect.Method
+	method     *methodHandler
 	ctrlType   reflect.Type
+
+	// Typed handler func(ctx, *ReceivedRequest, *In) (*Out, error). Controller
+	// methods taking a context first are also called as typed handlers.
+	Handler interface{}
+	typed   *typedHandler
 }
 
 func (b *Binding) String() string {
@@ -55,15 +141,30 @@ func (b *Binding) String() string {
 func (b *Binding) InitHandler(binding *Binding) {
 }
 
-func (b *Binding) init(service *Service, cluster Cluster) {
+func (b *Binding) init(service *Service, cluster Cluster) error {
 	b.cluster = cluster
 	b.service = service
-	b.pathRe = regexp.MustCompile("^" + b.Path)
-	b.nbParams = len(paramReplaceRegexp.FindAll([]byte(b.Path), -1))
+
+	for i, method := range b.Methods {
+		b.Methods[i] = strings.ToUpper(method)
+	}
+
+	if (b.Closure != nil && b.Handler != nil) || (b.Controller != nil && (b.Closure != nil || b.Handler != nil)) {
+		return fmt.Errorf("Binding %s must set only one of Closure, Handler or Controller", b)
+	}
+
+	var err error
+	b.path, err = compilePath(b.Path)
+	if err != nil {
+		return fmt.Errorf("Invalid path for binding %s: %s", b, err)
+	}
 
 	if b.RequestLogger == nil {
 		b.RequestLogger = &RequestLogger{}
 	}
+	if b.RequestMetrics == nil {
+		b.RequestMetrics = &RequestMetrics{}
+	}
 	if b.Resolver == nil {
 		b.Resolver = &ResolverPath{Count: 1}
 	}
@@ -79,33 +180,99 @@ func (b *Binding) init(service *Service, cluster Cluster) {
 		b.ctrlType = reflect.TypeOf(b.Controller)
 		rMethod, found := b.ctrlType.MethodByName(b.Method)
 
-		if found {
-			b.rflMethod = &rMethod
+		if !found {
+			return fmt.Errorf("Couldn't find method in controller: %s.%s", b.ctrlType, b.Method)
+		}
+
+		if isTypedMethod(rMethod) {
+			ctrlVal := reflect.ValueOf(b.Controller)
+			b.typed, err = newTypedHandler(rMethod.Func, &ctrlVal)
+			if err != nil {
+				return fmt.Errorf("Invalid method %s.%s for binding %s: %s", b.ctrlType, b.Method, b, err)
+			}
 		} else {
-			Log.Fatal("nrv> Couldn't find method in controller: %s.%s", b.ctrlType, b.Method)
+			b.method, err = newMethodHandler(rMethod, reflect.ValueOf(b.Controller), b.path)
+			if err != nil {
+				return fmt.Errorf("Invalid method %s.%s for binding %s: %s", b.ctrlType, b.Method, b, err)
+			}
+		}
+	}
+
+	if b.Handler != nil {
+		b.typed, err = newTypedHandler(reflect.ValueOf(b.Handler), nil)
+		if err != nil {
+			return fmt.Errorf("Invalid handler for binding %s: %s", b, err)
 		}
 	}
 
-	b.SetNextHandler(b.RequestLogger)
-	b.RequestLogger.SetPreviousHandler(b)
-	b.RequestLogger.SetNextHandler(b.Resolver)
-	b.Resolver.SetPreviousHandler(b.RequestLogger)
-	b.Resolver.SetNextHandler(b.Pattern)
-	b.Pattern.SetPreviousHandler(b.Resolver)
-	b.Pattern.SetNextHandler(b.Protocol)
+	// chain: binding -> request logger -> metrics -> interceptors -> resolver -> hedging -> circuit breaker -> pattern -> protocol
+	b.handlers = []CallHandler{b.RequestLogger, b.RequestMetrics}
+	for _, factory := range cluster.GetInterceptors() {
+		b.handlers = append(b.handlers, factory())
+	}
+	for _, factory := range service.Interceptors {
+		b.handlers = append(b.handlers, factory())
+	}
+	b.handlers = append(b.handlers, b.Interceptors...)
+	b.handlers = append(b.handlers, b.Resolver)
+	if b.Hedging != nil {
+		b.handlers = append(b.handlers, b.Hedging)
+	}
+	if b.CircuitBreaker != nil {
+		b.handlers = append(b.handlers, b.CircuitBreaker)
+	}
+	b.handlers = append(b.handlers, b.Pattern)
+
+	var previous CallHandler = b
+	for _, handler := range b.handlers {
+		previous.SetNextHandler(handler)
+		handler.SetPreviousHandler(previous)
+		previous = handler
+	}
+	previous.SetNextHandler(b.Protocol)
 
 	b.InitHandler(b)
-	b.RequestLogger.InitHandler(b)
-	b.Resolver.InitHandler(b)
-	b.Pattern.InitHandler(b)
+	for _, handler := range b.handlers {
+		handler.InitHandler(b)
+	}
+
+	// after handlers so that the metrics registry is set
+	b.limiter = newReceiveLimiter(b)
+
+	return nil
+}
+
+func (b *Binding) start() {
+	for _, handler := range b.handlers {
+		if lifecycle, ok := handler.(HandlerLifecycle); ok {
+			lifecycle.StartHandler()
+		}
+	}
+}
+
+func (b *Binding) stop() {
+	for _, handler := range b.handlers {
+		if lifecycle, ok := handler.(HandlerLifecycle); ok {
+			lifecycle.StopHandler()
+		}
+	}
+}
+
+// Resolves members of the service for a token, preferring nodes whose circuit
+// breaker is closed
+func (b *Binding) resolve(token Token, count int) *ServiceMembers {
+	if b.CircuitBreaker == nil {
+		return b.service.Resolve(token, count)
+	}
+	return b.service.ResolveAvailable(token, count, b.CircuitBreaker.Available)
 }
 
 func (b *Binding) getFirstBackwardHandler() CallHandler {
-	return b.Pattern
+	return b.handlers[len(b.handlers)-1]
 }
 
 func (b *Binding) getFirstForwardHandler() CallHandler {
-	return b.RequestLogger
+	return b.handlers[0]
 }
 
 func (b *Binding) SetNextHandler(handler CallHandler)     {}
@@ -121,31 +288,42 @@ func (b *Binding) MatchesMethod(controller interface{}, method string) bool {
 	return false
 }
 
-func (b *Binding) GetPath(params ...string) string {
-	i := 0
+func (b *Binding) getCompiledPath() (*bindingPath, error) {
+	if b.path != nil {
+		return b.path, nil
+	}
+	return compilePath(b.Path)
+}
 
-	path := paramReplaceRegexp.ReplaceAllStringFunc(b.Path, func(match string) string {
-		ret := params[i]
-		i++
-		return ret
-	})
+// Returns the path with its parameters replaced, or "" if it can't be formatted.
+// See FormatPath.
+func (b *Binding) GetPath(params ...interface{}) string {
+	path, err := b.FormatPath(params...)
+	if err != nil {
+		Log.Warning("%s> Couldn't format path: %s", b, err)
+		return ""
+	}
+	return path
+}
 
-	return strings.Trim(path, "^$|()")
+// Returns the path with its parameters replaced. A single Map fills parameters by
+// name or position, otherwise parameters are given in order. Each value must match
+// its parameter.
+func (b *Binding) FormatPath(params ...interface{}) (string, error) {
+	path, err := b.getCompiledPath()
+	if err != nil {
+		return "", err
+	}
+	return path.format(params...)
 }
 
+// Returns the parameters of the path if it matches the binding, nil otherwise
 func (b *Binding) Matches(path string) Map {
-	m := b.pathRe.FindSubmatch([]uint8(path))
-	if len(m) > 0 {
-		m = m[1:]
-		ret := NewMap()
-		for i, arParam := range m {
-			ret[strconv.Itoa(i)] = string(arParam)
-		}
-
-		return ret
+	compiled, err := b.getCompiledPath()
+	if err != nil {
+		return nil
 	}
-
-	return nil
+	return compiled.match(path)
 }
 
 func (b *Binding) Call(reqBuild RequestBuilder) *Request {
@@ -153,6 +331,17 @@ func (b *Binding) Call(reqBuild RequestBuilder) *Request {
 	return b.HandleRequestSend(request)
 }
 
+func (b *Binding) CallWait(reqBuild RequestBuilder) *ReceivedRequest {
+	return <-b.CallChan(reqBuild)
+}
+
+func (b *Binding) CallChan(reqBuild RequestBuilder) chan *ReceivedRequest {
+	request := reqBuild.ToRequest()
+	c := request.ReplyChan()
+	b.Call(request)
+	return c
+}
+
 func (b *Binding) HandleRequestSend(request *Request) *Request {
 	Log.Debug("%s> New request to send %s", b, request)
 
@@ -163,45 +352,99 @@ func (b *Binding) HandleRequestSend(request *Request) *Request {
 	request.Binding = b
 	request.Message.Source = NewServiceMembers(ServiceMember{Token(0), b.cluster.GetLocalNode()})
 	request.Message.ServiceName = b.service.Name
+	if request.Message.DestinationRdv > 0 && request.InitRequest != nil {
+		request.Message.Method = request.InitRequest.Message.Method
+	} else {
+		request.Message.Method = b.requestMethod(request.Message.Path, request.Message.Method)
+	}
+
+	// track requests waiting for a reply so that a stopping cluster waits for them
+	if request.Message.DestinationRdv == 0 && request.NeedReply() {
+		tracker := b.cluster.getRequestTracker()
+		tracker.enterPending()
+
+		var once sync.Once
+		onReply := request.OnReply
+		request.OnReply = func(reply *ReceivedRequest) {
+			once.Do(tracker.leave)
+			onReply(reply)
+		}
+	}
 
 	return b.getFirstForwardHandler().HandleRequestSend(request)
 }
 
+// Returns the method of a request sent by the binding: one of its methods, or if it
+// accepts any method, one that doesn't route the path to another binding. The
+// destination then handles it with the same binding, and its reply comes back to
+// this one.
+func (b *Binding) requestMethod(path, method string) string {
+	method = strings.ToUpper(method)
+	if len(b.Methods) > 0 {
+		if containsMethod(b.Methods, method) {
+			return method
+		}
+		return b.Methods[0]
+	}
+
+	if method != "" {
+		if binding, _, _ := b.service.FindBindingMethod(path, method); binding != b {
+			return ""
+		}
+	}
+	return method
+}
+
 func (b *Binding) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
 	Log.Debug("%s> Received new request %s", b, request)
 
 	// if this is a response to a reply, call the handle reply method
 	if request.InitRequest != nil && request.InitRequest.NeedReply() {
 		request.InitRequest.handleReply(request)
+		return request
+	}
 
-		// else, call the closure
-	} else if b.Closure != nil {
-		b.Closure(request)
+	if request.shed {
+		request.Logger.Warning("%s> Shedding request %s, binding is busy", b, request)
+		if request.NeedReply() {
+			request.ReplyMessage(&Message{Error: Error{"Binding is busy", ERROR_BUSY}})
+		}
+		return request
+	}
 
-		// else, call a method by reflection
-	} else if b.rflMethod != nil {
-		ctrlVal := reflect.ValueOf(b.Controller)
-		reqVal := reflect.ValueOf(request)
-
-		// TODO: pass params
-		nbParams := b.rflMethod.Func.Type().NumIn()
-		values := make([]reflect.Value, nbParams)
-		values[0] = ctrlVal
-		values[1] = reqVal
-
-		for i := 2; i < nbParams; i++ {
-			if val, found := request.Data[strconv.Itoa(i-2)]; found {
-				values[i] = reflect.ValueOf(val)
-			} else {
-				Log.Warning("Didn't get all paramters to call %s", b)
-				values[i] = reflect.ValueOf("")
-			}
+	tracker := b.cluster.getRequestTracker()
+	if !tracker.enter() {
+		request.Logger.Warning("%s> Refusing request %s, node is stopping", b, request)
+		if request.NeedReply() {
+			request.ReplyMessage(&Message{Error: Error{"Node is stopping", ERROR_UNAVAILABLE}})
 		}
+		return request
+	}
+	defer tracker.leave()
+
+	// context ended once replied, or once handled if no reply is expected
+	request.initContext(tracker.context())
+	if !request.NeedReply() {
+		defer request.done()
+	}
+
+	// call the closure
+	if b.Closure != nil {
+		b.Closure(request)
 
-		b.rflMethod.Func.Call(values)
+		// else, call the typed handler, decoding and encoding data
+	} else if b.typed != nil {
+		b.typed.call(request)
+
+		// else, call a method by reflection
+	} else if b.method != nil {
+		b.method.call(request)
 
 	} else {
-		Log.Fatal("%s> No closure nor method set", b)
+		request.Logger.Error("%s> No closure nor method set", b)
+		if request.NeedReply() {
+			request.ReplyMessage(&Message{Error: Error{"No handler for " + b.Path, ERROR_NOT_IMPLEMENTED}})
+		}
 	}
 
 	return request
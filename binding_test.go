@@ -1,7 +1,10 @@
 package nrv
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestBindingPathReverse(t *testing.T) {
@@ -10,3 +13,296 @@ func TestBindingPathReverse(t *testing.T) {
 		t.Fatalf("Path is not equal: %s", b.GetPath("bbb"))
 	}
 }
+
+func TestBindingPathFormat(t *testing.T) {
+	b := Binding{Path: "/tags/{tag}"}
+	if path := b.GetPath("(x)$"); path != "/tags/(x)$" {
+		t.Fatalf("Parameter value wasn't kept as is: %s", path)
+	}
+	if _, err := b.FormatPath("a/b"); err == nil {
+		t.Fatalf("Formatting a path with a value not matching its parameter should return an error")
+	}
+
+	b = Binding{Path: "^/files/((a|b)+)/(\\d+)$"}
+	params := b.Matches("/files/abba/12")
+	if params["0"] != "abba" || params["1"] != "12" {
+		t.Fatalf("Nested groups shifted positional parameters: %v", params)
+	}
+	if path := b.GetPath("ab", 12); path != "/files/ab/12" {
+		t.Fatalf("Path with nested groups wasn't formatted: %s", path)
+	}
+	if _, err := b.FormatPath("c", 12); err == nil {
+		t.Fatalf("Formatting a path with a value not matching its group should return an error")
+	}
+
+	b = Binding{Path: "/files.+/(.*)"}
+	if _, err := b.FormatPath("x"); err == nil {
+		t.Fatalf("Formatting a path with regex literals should return an error")
+	}
+}
+
+func TestBindingNamedParams(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("params")
+
+	b, err := service.BindMethod("/users/{id:int}/posts/{slug}", &tController{}, "Hello")
+	if err != nil {
+		t.Fatalf("Couldn't bind path with named parameters: %s", err)
+	}
+
+	params := b.Matches("/users/42/posts/hello-world")
+	if params["id"] != 42 || params["slug"] != "hello-world" || params["0"] != "42" {
+		t.Fatalf("Parameters weren't captured by name: %v", params)
+	}
+	if b.Matches("/users/abc/posts/hello") != nil {
+		t.Fatalf("Typed parameter shouldn't match an invalid value")
+	}
+
+	if path := service.Reverse(&tController{}, "Hello", Map{"id": 12, "slug": "abc"}); path != "/users/12/posts/abc" {
+		t.Fatalf("Path wasn't reversed by name: %s", path)
+	}
+	if path := service.Reverse(&tController{}, "Hello", 12, "abc"); path != "/users/12/posts/abc" {
+		t.Fatalf("Path wasn't reversed by position: %s", path)
+	}
+	if _, err := b.FormatPath(Map{"id": 12}); err == nil {
+		t.Fatalf("Formatting a path with a missing parameter should return an error")
+	}
+
+	if _, err := service.BindClosure("/users/{id:unknown}", func(request *ReceivedRequest) {}); err == nil {
+		t.Fatalf("Binding a path with an unknown parameter type should return an error")
+	}
+	if _, err := service.BindClosure("/users/{id}/{id}", func(request *ReceivedRequest) {}); err == nil {
+		t.Fatalf("Binding a path with a duplicated parameter should return an error")
+	}
+}
+
+type tInterceptor struct {
+	BaseHandler
+	name  string
+	trace *[]string
+}
+
+func (i *tInterceptor) HandleRequestSend(request *Request) *Request {
+	*i.trace = append(*i.trace, "send "+i.name)
+	return i.NextHandler().HandleRequestSend(request)
+}
+
+func (i *tInterceptor) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
+	*i.trace = append(*i.trace, "receive "+i.name)
+	return i.PreviousHandler().HandleRequestReceive(request)
+}
+
+func TestBindingInterceptors(t *testing.T) {
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	trace := make([]string, 0)
+
+	cluster.AddInterceptor(func() CallHandler {
+		return &tInterceptor{name: "cluster", trace: &trace}
+	})
+	service := cluster.GetService("test")
+	service.Members.Add(ServiceMember{Token(0), node})
+	service.Interceptors = []InterceptorFactory{func() CallHandler {
+		return &tInterceptor{name: "service", trace: &trace}
+	}}
+	service.Bind(&Binding{
+		Path:         "/test",
+		Interceptors: []CallHandler{&tInterceptor{name: "binding", trace: &trace}},
+		Closure: func(request *ReceivedRequest) {
+			request.Reply(Map{"ok": true})
+		},
+	})
+
+	resp := service.CallWait("/test", &Message{})
+	if resp.Data["ok"] != true {
+		t.Fatalf("Didn't get a reply: %s", resp)
+	}
+
+	expected := []string{
+		"send cluster", "send service", "send binding",
+		"receive binding", "receive service", "receive cluster",
+		"send cluster", "send service", "send binding",
+		"receive binding", "receive service", "receive cluster",
+	}
+	if len(trace) != len(expected) {
+		t.Fatalf("Interceptors weren't called in order: %v", trace)
+	}
+	for i := range expected {
+		if trace[i] != expected[i] {
+			t.Fatalf("Interceptors weren't called in order: %v", trace)
+		}
+	}
+}
+
+type tController struct{}
+
+func (c *tController) Hello(request *ReceivedRequest) {
+	request.Reply(Map{})
+}
+
+type tGreetIn struct {
+	Name string
+}
+
+type tGreetOut struct {
+	Greeting string
+}
+
+func (c *tController) Greet(ctx context.Context, request *ReceivedRequest, in *tGreetIn) (*tGreetOut, error) {
+	if in.Name == "" {
+		return nil, Error{"Missing name", ERROR_NOT_FOUND}
+	}
+	return &tGreetOut{"hello " + in.Name}, nil
+}
+
+func (c *tController) Invalid(ctx context.Context, in *tGreetIn) error {
+	return nil
+}
+
+func (c *tController) Post(request *ReceivedRequest, id int, slug string) {
+	request.Reply(Map{"id": id, "slug": slug})
+}
+
+func TestBindingInitErrors(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("errors")
+
+	if _, err := service.BindMethod("/hello", &tController{}, "Hello"); err != nil {
+		t.Fatalf("Couldn't bind existing method: %s", err)
+	}
+	if _, err := service.BindMethod("/missing", &tController{}, "Missing"); err == nil {
+		t.Fatalf("Binding a missing method should return an error")
+	}
+	if _, err := service.BindClosure("/invalid/(", func(request *ReceivedRequest) {}); err == nil {
+		t.Fatalf("Binding an invalid path should return an error")
+	}
+
+	if _, err := service.BindMethod("/users/{id}", &tController{}, "Post"); err == nil {
+		t.Fatalf("Binding a method taking more parameters than the path should return an error")
+	}
+	if _, err := service.Bind(&Binding{
+		Path:    "/both",
+		Closure: func(request *ReceivedRequest) {},
+		Handler: func(ctx context.Context, request *ReceivedRequest, in *tGreetIn) (*tGreetOut, error) { return nil, nil },
+	}); err == nil {
+		t.Fatalf("Binding both a closure and a handler should return an error")
+	}
+
+	if err := (&ReceivedRequest{Message: &Message{}}).Reply(Map{}); err == nil {
+		t.Fatalf("Replying to a request without reply callback should return an error")
+	}
+}
+
+func TestBindingTypedHandler(t *testing.T) {
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("typed")
+	service.Members.Add(ServiceMember{Token(0), node})
+
+	if _, err := service.BindMethod("/greet", &tController{}, "Greet"); err != nil {
+		t.Fatalf("Couldn't bind typed method: %s", err)
+	}
+	if _, err := service.BindHandler("/fail", func(ctx context.Context, request *ReceivedRequest, in *tGreetIn) (*tGreetOut, error) {
+		return nil, errors.New("failed")
+	}); err != nil {
+		t.Fatalf("Couldn't bind typed handler: %s", err)
+	}
+
+	resp := service.CallWait("/greet", &Message{Data: Map{"name": "nrv"}})
+	if resp.Data["Greeting"] != "hello nrv" {
+		t.Fatalf("Didn't get typed reply: %v", resp.Data)
+	}
+
+	resp = service.CallWait("/greet", &Message{Data: Map{}})
+	if resp.Error.Code != ERROR_NOT_FOUND {
+		t.Fatalf("Handler error code wasn't kept: %s", resp.Error)
+	}
+
+	resp = service.CallWait("/greet", &Message{Data: Map{"name": Map{}}})
+	if resp.Error.Code != ERROR_BAD_REQUEST {
+		t.Fatalf("Undecodable data should be a bad request: %s", resp.Error)
+	}
+
+	resp = service.CallWait("/fail", &Message{Data: Map{}})
+	if resp.Error.Code != ERROR_INTERNAL || resp.Error.Message != "failed" {
+		t.Fatalf("Plain errors should be internal errors: %s", resp.Error)
+	}
+}
+
+func TestBindingMethodParams(t *testing.T) {
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("params")
+	service.Members.Add(ServiceMember{Token(0), node})
+
+	if _, err := service.BindMethod("/users/{id:int}/posts/(.+)", &tController{}, "Post"); err != nil {
+		t.Fatalf("Couldn't bind method with parameters: %s", err)
+	}
+
+	resp := service.CallWait("/users/42/posts/hello", &Message{})
+	if resp.Data["id"] != 42 || resp.Data["slug"] != "hello" {
+		t.Fatalf("Path parameters weren't passed to the method: %v %s", resp.Data, resp.Error)
+	}
+}
+
+func TestBindingContext(t *testing.T) {
+	handled := make(chan error, 2)
+	running := make(chan bool, 1)
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		service.Bind(&Binding{
+			Path:    "/timeout",
+			Timeout: 50,
+			Handler: func(ctx context.Context, request *ReceivedRequest, in *tGreetIn) (*tGreetOut, error) {
+				if _, ok := ctx.Deadline(); !ok {
+					handled <- errors.New("no deadline")
+					return nil, nil
+				}
+				<-ctx.Done()
+				handled <- ctx.Err()
+				return nil, ctx.Err()
+			},
+		})
+		service.BindClosure("/stop", func(request *ReceivedRequest) {
+			running <- true
+			<-request.Context().Done()
+			handled <- request.Context().Err()
+		})
+	})
+	defer stopClusters(clusters)
+
+	dest := NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()})
+	service := clusters[0].GetService("mem")
+	if resp := service.CallWait("/timeout", &Message{Destination: dest}); resp.Error.Empty() {
+		t.Fatalf("Expected an error, got %v", resp.Data)
+	}
+	if err := <-handled; err != context.DeadlineExceeded {
+		t.Fatalf("Handler context should have expired with the sender's timeout, got %v", err)
+	}
+
+	// context of a handler still running is cancelled once its node is stopped
+	service.Call("/stop", &Message{Destination: dest})
+	<-running
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	clusters[1].Stop(ctx)
+	if err := <-handled; err != context.Canceled {
+		t.Fatalf("Handler context should have been cancelled on stop, got %v", err)
+	}
+}
+
+func TestBindingTypedHandlerErrors(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("typed")
+
+	if _, err := service.BindMethod("/invalid", &tController{}, "Invalid"); err == nil {
+		t.Fatalf("Binding a method with an invalid typed signature should return an error")
+	}
+	if _, err := service.BindHandler("/invalid", func(request *ReceivedRequest) {}); err == nil {
+		t.Fatalf("Binding a handler with an invalid signature should return an error")
+	}
+	if _, err := service.BindHandler("/invalid", func(ctx context.Context, request *ReceivedRequest, in tGreetIn) (*tGreetOut, error) {
+		return nil, nil
+	}); err == nil {
+		t.Fatalf("Binding a handler taking a non pointer should return an error")
+	}
+}
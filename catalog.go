@@ -0,0 +1,202 @@
+package nrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+const (
+	CATALOG_PATH         = "/catalog"
+	CATALOG_CONTENT_TYPE = "application/json"
+)
+
+// Description of a service exposed by a node
+type ServiceInfo struct {
+	Name     string        `nrv:"name" json:"name"`
+	Protocol string        `nrv:"protocol" json:"protocol"`
+	Members  []MemberInfo  `nrv:"members" json:"members"`
+	Bindings []BindingInfo `nrv:"bindings" json:"bindings"`
+}
+
+type MemberInfo struct {
+	Token   uint32 `nrv:"token" json:"token"`
+	Address string `nrv:"address" json:"address"`
+	TCPPort int    `nrv:"tcp_port" json:"tcp_port"`
+	UDPPort int    `nrv:"udp_port" json:"udp_port"`
+}
+
+// Description of a binding, settings depending on its handlers
+type BindingInfo struct {
+	Path     string   `nrv:"path" json:"path"`
+	Methods  []string `nrv:"methods,omitempty" json:"methods,omitempty"`
+	Handler  string   `nrv:"handler" json:"handler"`
+	Pattern  string   `nrv:"pattern" json:"pattern"`
+	Resolver string   `nrv:"resolver" json:"resolver"`
+	Protocol string   `nrv:"protocol" json:"protocol"`
+	Settings Map      `nrv:"settings" json:"settings"`
+}
+
+// Lists the services of a cluster and their bindings, sorted by name and path
+func Catalog(cluster Cluster) []ServiceInfo {
+	services := cluster.GetServices()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	infos := make([]ServiceInfo, len(services))
+	for i, service := range services {
+		infos[i] = service.Info()
+	}
+	return infos
+}
+
+// Describes the service, its members and its bindings
+func (s *Service) Info() ServiceInfo {
+	info := ServiceInfo{
+		Name:     s.Name,
+		Protocol: typeName(s.GetDefaultProtocol()),
+		Members:  make([]MemberInfo, 0, s.Members.Len()),
+		Bindings: make([]BindingInfo, 0, len(s.bindings)),
+	}
+
+	for _, member := range s.Members.Slice() {
+		info.Members = append(info.Members, MemberInfo{
+			Token:   uint32(member.Token),
+			Address: member.Node.Address,
+			TCPPort: member.Node.TCPPort,
+			UDPPort: member.Node.UDPPort,
+		})
+	}
+
+	bindings := make([]*Binding, len(s.bindings))
+	copy(bindings, s.bindings)
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].Path < bindings[j].Path
+	})
+	for _, binding := range bindings {
+		info.Bindings = append(info.Bindings, binding.Info())
+	}
+
+	return info
+}
+
+// Describes the binding's handlers and settings
+func (b *Binding) Info() BindingInfo {
+	info := BindingInfo{
+		Path:     b.Path,
+		Methods:  b.Methods,
+		Handler:  b.handlerName(),
+		Pattern:  typeName(b.Pattern),
+		Resolver: typeName(b.Resolver),
+		Protocol: typeName(b.Protocol),
+		Settings: Map{
+			"timeout":   b.Timeout,
+			"max_retry": b.MaxRetry,
+		},
+	}
+
+	if b.UDP {
+		info.Settings["udp"] = true
+		info.Settings["udp_retries"] = b.UDPRetries
+	}
+
+	if b.CircuitBreaker != nil {
+		info.Settings["circuit_error_rate"] = b.CircuitBreaker.ErrorRate
+		info.Settings["circuit_open_duration"] = b.CircuitBreaker.OpenDuration.String()
+	}
+
+	if b.MaxConcurrency > 0 {
+		info.Settings["max_concurrency"] = b.MaxConcurrency
+		info.Settings["max_queue"] = b.MaxQueue
+		info.Settings["shedding"] = b.Shedding
+	}
+
+	switch resolver := b.Resolver.(type) {
+	case *ResolverPath:
+		info.Settings["resolver_count"] = resolver.Count
+	case *ResolverParam:
+		info.Settings["resolver_count"] = resolver.Count
+		info.Settings["resolver_param"] = resolver.Param
+	}
+
+	return info
+}
+
+func (b *Binding) handlerName() string {
+	switch {
+	case b.Closure != nil:
+		return "closure"
+	case b.Controller != nil:
+		return fmt.Sprintf("%s.%s", typeName(b.Controller), b.Method)
+	case b.Handler != nil:
+		return reflect.TypeOf(b.Handler).String()
+	}
+	return ""
+}
+
+func typeName(obj interface{}) string {
+	if obj == nil {
+		return ""
+	}
+
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ.Name()
+}
+
+// Closure to bind on a service served by ProtocolHTTP to export the catalog of a
+// cluster as JSON
+// ex: httpService.BindClosure("/catalog$", nrv.CatalogHTTPHandler(cluster))
+func CatalogHTTPHandler(cluster Cluster) func(request *ReceivedRequest) {
+	return func(request *ReceivedRequest) {
+		body, err := json.Marshal(Catalog(cluster))
+		if err != nil {
+			request.ReplyMessage(&Message{Error: Error{err.Error(), ERROR_INTERNAL}})
+			return
+		}
+
+		request.Reply(Map{
+			"content-type": CATALOG_CONTENT_TYPE,
+			"body":         string(body),
+		})
+	}
+}
+
+// Replies the catalog of a cluster as data, bound on the cluster service
+func handleCatalogRequest(cluster Cluster, request *ReceivedRequest) {
+	services := NewArray()
+	for _, info := range Catalog(cluster) {
+		data, err := NewMapFromStruct(info)
+		if err != nil {
+			request.ReplyMessage(&Message{Error: Error{err.Error(), ERROR_INTERNAL}})
+			return
+		}
+		services = append(services, data)
+	}
+	request.Reply(Map{"services": services})
+}
+
+// Asks the catalog of another node of the cluster
+func FetchCatalog(cluster Cluster, node *Node) ([]ServiceInfo, error) {
+	resp := cluster.GetService(CLUSTER_SERVICE).CallWait(CATALOG_PATH, &Message{
+		Destination: NewServiceMembers(ServiceMember{Token(0), node}),
+	})
+	if !resp.Error.Empty() {
+		return nil, resp.Error
+	}
+
+	services, ok := resp.Data["services"].(Array)
+	if !ok {
+		return nil, fmt.Errorf("Invalid catalog received from %s", node)
+	}
+
+	var infos []ServiceInfo
+	if err := services.IntoStructSlice(&infos, ServiceInfo{}); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
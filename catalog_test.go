@@ -0,0 +1,74 @@
+package nrv
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalogFetch(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		service.BindClosure("/users/{id:int}", func(request *ReceivedRequest) {}, "GET")
+		service.Bind(&Binding{
+			Path:     "/shard/{key}",
+			Resolver: &ResolverParam{Count: 1, Param: "key"},
+			Closure:  func(request *ReceivedRequest) {},
+		})
+	})
+	defer stopClusters(clusters)
+
+	infos, err := FetchCatalog(clusters[0], clusters[1].GetLocalNode())
+	if err != nil {
+		t.Fatalf("Couldn't fetch catalog: %s", err)
+	}
+
+	var mem *ServiceInfo
+	for i := range infos {
+		if infos[i].Name == "mem" {
+			mem = &infos[i]
+		}
+	}
+	if mem == nil || mem.Protocol != "ProtocolMemory" || len(mem.Members) != 2 || len(mem.Bindings) != 2 {
+		t.Fatalf("Service wasn't described: %+v", infos)
+	}
+
+	shard, users := mem.Bindings[0], mem.Bindings[1]
+	if users.Path != "/users/{id:int}" || len(users.Methods) != 1 || users.Methods[0] != "GET" || users.Handler != "closure" {
+		t.Fatalf("Binding wasn't described: %+v", users)
+	}
+	if shard.Resolver != "ResolverParam" || shard.Pattern != "PatternRequestReply" || shard.Settings["resolver_param"] != "key" {
+		t.Fatalf("Binding handlers weren't described: %+v", shard)
+	}
+}
+
+func TestCatalogHTTP(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("admin")
+	service.BindClosure(CATALOG_PATH, CatalogHTTPHandler(cluster))
+	service.BindMethod("/hello", &tController{}, "Hello")
+
+	recorder := httptest.NewRecorder()
+	ph := &ProtocolHTTP{DefaultService: service}
+	ph.ServeHTTP(recorder, httptest.NewRequest("GET", CATALOG_PATH, nil))
+
+	if recorder.Header().Get("Content-Type") != CATALOG_CONTENT_TYPE {
+		t.Fatalf("Catalog should be served as JSON: %s", recorder.Header().Get("Content-Type"))
+	}
+
+	var infos []ServiceInfo
+	if err := json.Unmarshal(recorder.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("Couldn't decode catalog: %s", err)
+	}
+
+	found := false
+	for _, info := range infos {
+		for _, binding := range info.Bindings {
+			if info.Name == "admin" && binding.Handler == "tController.Hello" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Controller binding not found in catalog: %s", recorder.Body)
+	}
+}
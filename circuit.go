@@ -0,0 +1,275 @@
+package nrv
+
+import (
+	"sync"
+	"time"
+)
+
+// States of a circuit, as exported in the nrv_circuit_breaker_state gauge
+const (
+	CIRCUIT_CLOSED    = 0
+	CIRCUIT_HALF_OPEN = 1
+	CIRCUIT_OPEN      = 2
+)
+
+// Stops sending requests of a binding to nodes that keep failing. The circuit of a
+// node opens when the ratio of failed requests over Window reaches ErrorRate, with
+// at least MinRequests requests, and requests to it then fail fast with
+// ERROR_CIRCUIT_OPEN. After OpenDuration, a single probe request is let through
+// (half-open): the circuit closes if it succeeds and opens again if it fails.
+//
+// Failures are replies with ERROR_UNAVAILABLE, ERROR_TIMEOUT, ERROR_BUSY or
+// ERROR_INTERNAL, timeouts needing the binding's Timeout to be set. Only requests
+// waiting for a reply go through the breaker. Resolvers prefer nodes whose circuit
+// is closed.
+//
+// ex: service.Bind(&nrv.Binding{Path: "/users", Timeout: 500, CircuitBreaker: &nrv.CircuitBreaker{}})
+type CircuitBreaker struct {
+	BaseHandler
+
+	ErrorRate    float64
+	MinRequests  int
+	Window       time.Duration
+	OpenDuration time.Duration
+
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+	rejected *Counter
+}
+
+// Circuit of a node
+type circuit struct {
+	node  *Node
+	state int
+	gauge *Gauge
+
+	// requests of the current window
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	openedAt time.Time
+	probeAt  time.Time
+	probing  bool
+}
+
+func (cb *CircuitBreaker) InitHandler(binding *Binding) {
+	cb.BaseHandler.InitHandler(binding)
+
+	if cb.ErrorRate <= 0 {
+		cb.ErrorRate = 0.5
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = 10
+	}
+	if cb.Window <= 0 {
+		cb.Window = 10 * time.Second
+	}
+	if cb.OpenDuration <= 0 {
+		cb.OpenDuration = 5 * time.Second
+	}
+
+	cb.circuits = make(map[string]*circuit)
+	cb.rejected = binding.RequestMetrics.Registry.Counter("nrv_circuit_breaker_rejected_total", "Number of requests failed because circuits of their destinations were open", Labels{
+		"service": binding.service.Name,
+		"binding": binding.Path,
+	})
+}
+
+// Returns the state of the circuit of a node
+func (cb *CircuitBreaker) State(node *Node) int {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if c, found := cb.circuits[node.String()]; found {
+		return c.state
+	}
+	return CIRCUIT_CLOSED
+}
+
+// Returns true if a request sent now to the node would go through: its circuit is
+// closed or a probe can be sent
+func (cb *CircuitBreaker) Available(node *Node) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c, found := cb.circuits[node.String()]
+	if !found {
+		return true
+	}
+
+	now := time.Now()
+	switch c.state {
+	case CIRCUIT_OPEN:
+		return now.Sub(c.openedAt) >= cb.OpenDuration
+	case CIRCUIT_HALF_OPEN:
+		return !c.probing || now.Sub(c.probeAt) >= cb.OpenDuration
+	}
+	return true
+}
+
+// must be called with the mutex locked
+func (cb *CircuitBreaker) getCircuit(node *Node) *circuit {
+	key := node.String()
+	c, found := cb.circuits[key]
+	if !found {
+		c = &circuit{
+			node:        node,
+			windowStart: time.Now(),
+			gauge: cb.binding.RequestMetrics.Registry.Gauge("nrv_circuit_breaker_state", "State of circuits by node: 0 closed, 1 half-open, 2 open", Labels{
+				"service": cb.binding.service.Name,
+				"binding": cb.binding.Path,
+				"node":    key,
+			}),
+		}
+		cb.circuits[key] = c
+	}
+	return c
+}
+
+func (cb *CircuitBreaker) setState(c *circuit, state int) {
+	c.state = state
+	c.gauge.Set(float64(state))
+}
+
+// Returns true if a request can be sent to the node, marking it as the probe of a
+// circuit whose open duration has elapsed. A probe that never gets a reply is
+// replaced after OpenDuration.
+func (cb *CircuitBreaker) allow(node *Node) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c := cb.getCircuit(node)
+	now := time.Now()
+	switch c.state {
+	case CIRCUIT_OPEN:
+		if now.Sub(c.openedAt) < cb.OpenDuration {
+			return false
+		}
+		Log.Info("CircuitBreaker> Probing %s for %s", node, cb.binding)
+		cb.setState(c, CIRCUIT_HALF_OPEN)
+
+	case CIRCUIT_HALF_OPEN:
+		if c.probing && now.Sub(c.probeAt) < cb.OpenDuration {
+			return false
+		}
+
+	default:
+		return true
+	}
+
+	c.probing = true
+	c.probeAt = now
+	return true
+}
+
+// Accounts the result of a request sent to a node
+func (cb *CircuitBreaker) record(node *Node, failed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	c := cb.getCircuit(node)
+	now := time.Now()
+	switch c.state {
+	case CIRCUIT_HALF_OPEN:
+		c.probing = false
+		if failed {
+			cb.open(c, now)
+		} else {
+			Log.Info("CircuitBreaker> Closing circuit of %s for %s", node, cb.binding)
+			cb.setState(c, CIRCUIT_CLOSED)
+			c.windowStart, c.requests, c.failures = now, 0, 0
+		}
+
+	case CIRCUIT_CLOSED:
+		if now.Sub(c.windowStart) >= cb.Window {
+			c.windowStart, c.requests, c.failures = now, 0, 0
+		}
+
+		c.requests++
+		if failed {
+			c.failures++
+		}
+		if c.requests >= cb.MinRequests && float64(c.failures)/float64(c.requests) >= cb.ErrorRate {
+			cb.open(c, now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) open(c *circuit, now time.Time) {
+	Log.Warning("CircuitBreaker> Opening circuit of %s for %s after %d failures out of %d requests", c.node, cb.binding, c.failures, c.requests)
+	cb.setState(c, CIRCUIT_OPEN)
+	c.openedAt = now
+}
+
+func isCircuitFailure(code uint16) bool {
+	switch code {
+	case ERROR_UNAVAILABLE, ERROR_TIMEOUT, ERROR_BUSY, ERROR_INTERNAL:
+		return true
+	}
+	return false
+}
+
+func (cb *CircuitBreaker) HandleRequestSend(request *Request) *Request {
+	if request.Message.DestinationRdv > 0 || !request.NeedReply() || request.Message.Destination.Empty() {
+		return cb.nextHandler.HandleRequestSend(request)
+	}
+
+	allowed := NewServiceMembers()
+	for _, dest := range request.Message.Destination.Slice() {
+		if cb.allow(dest.Node) {
+			allowed.Add(dest)
+		} else {
+			Log.Debug("CircuitBreaker> Not sending %s to %s, circuit is open", request, dest.Node)
+		}
+	}
+
+	if allowed.Empty() {
+		cb.rejected.Inc()
+		request.handleReply(&ReceivedRequest{
+			Message: &Message{
+				Source: request.Message.Destination,
+				Error:  Error{"Circuit breaker is open", ERROR_CIRCUIT_OPEN},
+			},
+		})
+		return request
+	}
+	request.Message.Destination = allowed
+	request.respNeeded = allowed.Len()
+
+	// destinations that haven't replied yet, all failed if the request times out
+	var mutex sync.Mutex
+	pending := make([]*Node, allowed.Len())
+	for i, dest := range allowed.Slice() {
+		pending[i] = dest.Node
+	}
+
+	onReply := request.OnReply
+	request.OnReply = func(reply *ReceivedRequest) {
+		var replied []*Node
+
+		mutex.Lock()
+		if !reply.Message.Source.Empty() {
+			source := reply.Message.Source.Get(0).Node
+			for i, node := range pending {
+				if node.Is(source) {
+					replied = append(replied, node)
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+		} else if reply.Message.Error.Code == ERROR_TIMEOUT {
+			replied, pending = pending, nil
+		}
+		mutex.Unlock()
+
+		failed := isCircuitFailure(reply.Message.Error.Code)
+		for _, node := range replied {
+			cb.record(node, failed)
+		}
+
+		onReply(reply)
+	}
+
+	return cb.nextHandler.HandleRequestSend(request)
+}
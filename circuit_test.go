@@ -0,0 +1,119 @@
+package nrv
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPatternRequestReplyTimeout(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		service.Bind(&Binding{
+			Path:    "/never",
+			Timeout: 50,
+			Closure: func(request *ReceivedRequest) {},
+		})
+	})
+	defer stopClusters(clusters)
+
+	start := time.Now()
+	resp := clusters[0].GetService("mem").CallWait("/never", &Message{})
+	if resp.Error.Code != ERROR_TIMEOUT {
+		t.Fatalf("Expected a timeout, got %v %s", resp.Data, resp.Error)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Request timed out after %s", elapsed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 3, func(cluster *StaticCluster, service *Service) {
+		node := cluster.GetLocalNode().Address
+		service.Bind(&Binding{
+			Path:    "/work",
+			Timeout: 100,
+			CircuitBreaker: &CircuitBreaker{
+				MinRequests:  3,
+				OpenDuration: 100 * time.Millisecond,
+			},
+			Closure: func(request *ReceivedRequest) {
+				if node == "node1" && atomic.LoadInt32(&failing) == 1 {
+					request.ReplyMessage(&Message{Error: Error{"Failing", ERROR_INTERNAL}})
+					return
+				}
+				request.Reply(Map{"node": node})
+			},
+		})
+	})
+	defer stopClusters(clusters)
+
+	service := clusters[0].GetService("mem")
+	binding := service.GetBinding("/work")
+	breaker := binding.CircuitBreaker
+	node1 := clusters[1].GetLocalNode()
+	call := func() *ReceivedRequest {
+		return service.CallWait("/work", &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node1})})
+	}
+	gauge := Metrics.Gauge("nrv_circuit_breaker_state", "", Labels{"service": "mem", "binding": "/work", "node": node1.String()})
+
+	for i := 0; i < 3; i++ {
+		if resp := call(); resp.Error.Code != ERROR_INTERNAL {
+			t.Fatalf("Expected an error from node1, got %s", resp.Error)
+		}
+	}
+	if breaker.State(node1) != CIRCUIT_OPEN || gauge.Value() != CIRCUIT_OPEN {
+		t.Fatalf("Circuit should be open after failures, got %d", breaker.State(node1))
+	}
+
+	// fails fast, and node1's token resolves to the next replica
+	if resp := call(); resp.Error.Code != ERROR_CIRCUIT_OPEN {
+		t.Fatalf("Expected an open circuit error, got %s", resp.Error)
+	}
+	if members := binding.resolve(Token(1<<30+5), 1); members.Get(0).Node.Address != "node2" {
+		t.Fatalf("Expected node1's replica to be resolved, got %s", members)
+	}
+	if members := binding.resolve(Token(1<<30+5), 3); members.Len() != 3 {
+		t.Fatalf("Node with an open circuit should still be used if needed, got %s", members)
+	}
+
+	// half-open probe fails and opens it again
+	time.Sleep(100 * time.Millisecond)
+	if !breaker.Available(node1) {
+		t.Fatalf("A probe should be allowed after the open duration")
+	}
+	if resp := call(); resp.Error.Code != ERROR_INTERNAL || breaker.State(node1) != CIRCUIT_OPEN {
+		t.Fatalf("Failed probe should open the circuit again, got %s %d", resp.Error, breaker.State(node1))
+	}
+
+	// successful probe closes it
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(100 * time.Millisecond)
+	if resp := call(); resp.Data["node"] != "node1" || breaker.State(node1) != CIRCUIT_CLOSED || gauge.Value() != CIRCUIT_CLOSED {
+		t.Fatalf("Successful probe should close the circuit, got %v %s %d", resp.Data, resp.Error, breaker.State(node1))
+	}
+}
+
+func TestCircuitBreakerTimeouts(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		service.Bind(&Binding{
+			Path:           "/never",
+			Timeout:        20,
+			CircuitBreaker: &CircuitBreaker{MinRequests: 2},
+			Closure:        func(request *ReceivedRequest) {},
+		})
+	})
+	defer stopClusters(clusters)
+
+	service := clusters[0].GetService("mem")
+	node1 := clusters[1].GetLocalNode()
+	for i := 0; i < 2; i++ {
+		resp := service.CallWait("/never", &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node1})})
+		if resp.Error.Code != ERROR_TIMEOUT {
+			t.Fatalf("Expected a timeout, got %s", resp.Error)
+		}
+	}
+	if state := service.GetBinding("/never").CircuitBreaker.State(node1); state != CIRCUIT_OPEN {
+		t.Fatalf("Timeouts should open the circuit, got %d", state)
+	}
+}
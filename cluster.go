@@ -1,18 +1,32 @@
 package nrv
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"sync"
+)
+
+const (
+	// internal service used by nodes of a cluster to talk to each other
+	CLUSTER_SERVICE = "nrv"
 )
 
 type Cluster interface {
-	Start()
+	Start() error
+	Stop(ctx context.Context) error
 	GetService(name string) *Service
+	GetServices() []*Service
 	GetLocalNode() *Node
 	GetBindingURL(bUrl *url.URL) (*Binding, Map)
 
 	RegisterProtocol(protocol Protocol)
 	GetDefaultProtocol() Protocol
+
+	AddInterceptor(factory InterceptorFactory)
+	GetInterceptors() []InterceptorFactory
+
+	getRequestTracker() *requestTracker
 }
 
 type Nodes []*Node
@@ -41,25 +55,54 @@ type StaticCluster struct {
 	services        map[string]*Service
 	protocols       []Protocol
 	defaultProtocol Protocol
+	interceptors    []InterceptorFactory
+	requests        *requestTracker
+	mutex           sync.Mutex
 }
 
 func NewStaticCluster(localNode *Node) *StaticCluster {
+	return NewStaticClusterWithProtocol(localNode, &ProtocolNrv{
+		LocalAddress: localNode.Address,
+		TCPPort:      localNode.TCPPort,
+		UDPPort:      localNode.UDPPort,
+	})
+}
+
+// Creates a cluster using the given protocol as default protocol
+func NewStaticClusterWithProtocol(localNode *Node, protocol Protocol) *StaticCluster {
 	c := &StaticCluster{
 		localNode: localNode,
 		services:  make(map[string]*Service),
+		requests:  newRequestTracker(),
 	}
 
-	nrvProto := &ProtocolNrv{
-		LocalAddress: localNode.Address,
-		TCPPort:      localNode.TCPPort,
-		UDPPort:      localNode.UDPPort,
-	}
-	c.RegisterProtocol(nrvProto)
-	c.defaultProtocol = nrvProto
+	c.RegisterProtocol(protocol)
+	c.defaultProtocol = protocol
+
+	c.bindClusterService()
 
 	return c
 }
 
+func (c *StaticCluster) bindClusterService() {
+	service := c.GetService(CLUSTER_SERVICE)
+	service.BindClosure("/leave", func(request *ReceivedRequest) {
+		node := &Node{}
+		if err := request.Data.Into(node); err != nil {
+			Log.Error("Cluster> Got an invalid leave announcement: %s", err)
+			return
+		}
+
+		Log.Info("Cluster> Node %s is leaving the cluster", node)
+		for _, service := range c.GetServices() {
+			service.Members.Remove(node)
+		}
+	})
+	service.BindClosure(CATALOG_PATH, func(request *ReceivedRequest) {
+		handleCatalogRequest(c, request)
+	})
+}
+
 func (c *StaticCluster) GetLocalNode() *Node {
 	return c.localNode
 }
@@ -73,18 +116,97 @@ func (c *StaticCluster) GetDefaultProtocol() Protocol {
 	return c.defaultProtocol
 }
 
+// Adds an interceptor to every binding bound after this call
+func (c *StaticCluster) AddInterceptor(factory InterceptorFactory) {
+	c.interceptors = append(c.interceptors, factory)
+}
+
+func (c *StaticCluster) GetInterceptors() []InterceptorFactory {
+	return c.interceptors
+}
+
 func (c *StaticCluster) GetBindingURL(bUrl *url.URL) (*Binding, Map) {
 	service := c.GetService(bUrl.Host)
 	return service.FindBinding(bUrl.Path)
 }
 
-func (c *StaticCluster) Start() {
+func (c *StaticCluster) getRequestTracker() *requestTracker {
+	return c.requests
+}
+
+func (c *StaticCluster) Start() error {
+	c.requests.start()
+
+	for _, service := range c.GetServices() {
+		for _, binding := range service.bindings {
+			binding.start()
+		}
+	}
+
+	for _, protocol := range c.protocols {
+		if err := protocol.start(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stops accepting new requests, announces the departure of this node to its peers
+// and waits for handlers and pending replies until the context is done. Bindings
+// and protocols are then stopped, and the cluster can be started again.
+func (c *StaticCluster) Stop(ctx context.Context) error {
+	c.requests.stop()
+	c.announceLeave()
+
+	err := c.requests.wait(ctx)
+	if err != nil {
+		Log.Warning("Cluster> Stopping with %d requests still in flight: %s", c.requests.count(), err)
+	}
+	c.requests.cancel()
+
+	for _, service := range c.GetServices() {
+		for _, binding := range service.bindings {
+			binding.stop()
+		}
+	}
+
 	for _, protocol := range c.protocols {
-		protocol.start()
+		if protoErr := protocol.stop(ctx); protoErr != nil && err == nil {
+			err = protoErr
+		}
+	}
+
+	return err
+}
+
+func (c *StaticCluster) announceLeave() {
+	peers := make(map[string]*Node)
+	for _, service := range c.GetServices() {
+		for _, member := range service.Members.Slice() {
+			if !member.Node.Is(c.localNode) {
+				peers[member.Node.String()] = member.Node
+			}
+		}
+	}
+
+	service := c.GetService(CLUSTER_SERVICE)
+	for _, node := range peers {
+		service.Call("/leave", &Message{
+			Destination: NewServiceMembers(ServiceMember{Token(0), node}),
+			Data: Map{
+				"Address": c.localNode.Address,
+				"TCPPort": c.localNode.TCPPort,
+				"UDPPort": c.localNode.UDPPort,
+			},
+		})
 	}
 }
 
 func (c *StaticCluster) GetService(name string) *Service {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	service, found := c.services[name]
 	if !found {
 		service = newService(c)
@@ -93,3 +215,117 @@ func (c *StaticCluster) GetService(name string) *Service {
 	}
 	return service
 }
+
+func (c *StaticCluster) GetServices() []*Service {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	services := make([]*Service, 0, len(c.services))
+	for _, service := range c.services {
+		services = append(services, service)
+	}
+	return services
+}
+
+// Counts requests being handled or waiting for a reply so that a stopping
+// cluster can wait for them
+type requestTracker struct {
+	mutex    sync.Mutex
+	inFlight int
+	stopping bool
+	idle     chan bool
+
+	// parent context of requests being handled, done once the cluster is stopped
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+}
+
+func newRequestTracker() *requestTracker {
+	t := &requestTracker{}
+	t.ctx, t.cancelFunc = context.WithCancel(context.Background())
+	return t
+}
+
+func (t *requestTracker) start() {
+	t.mutex.Lock()
+	t.stopping = false
+	if t.ctx.Err() != nil {
+		t.ctx, t.cancelFunc = context.WithCancel(context.Background())
+	}
+	t.mutex.Unlock()
+}
+
+// Cancels the context of requests still being handled
+func (t *requestTracker) cancel() {
+	t.mutex.Lock()
+	t.cancelFunc()
+	t.mutex.Unlock()
+}
+
+func (t *requestTracker) context() context.Context {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.ctx
+}
+
+func (t *requestTracker) stop() {
+	t.mutex.Lock()
+	t.stopping = true
+	t.mutex.Unlock()
+}
+
+// Tracks a new request received. Returns false if the cluster is stopping.
+func (t *requestTracker) enter() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.stopping {
+		return false
+	}
+	t.inFlight++
+	return true
+}
+
+// Tracks a request sent, even if the cluster is stopping
+func (t *requestTracker) enterPending() {
+	t.mutex.Lock()
+	t.inFlight++
+	t.mutex.Unlock()
+}
+
+func (t *requestTracker) leave() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.inFlight--
+	if t.inFlight == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+func (t *requestTracker) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.inFlight
+}
+
+func (t *requestTracker) wait(ctx context.Context) error {
+	t.mutex.Lock()
+	if t.inFlight == 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan bool)
+	}
+	idle := t.idle
+	t.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,74 @@
+package nrv
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClusterStopWaitsHandlers(t *testing.T) {
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("stop")
+	service.Members.Add(ServiceMember{Token(0), node})
+
+	started := make(chan bool, 1)
+	service.BindClosure("/slow", func(request *ReceivedRequest) {
+		started <- true
+		time.Sleep(50 * time.Millisecond)
+		request.Reply(Map{"done": true})
+	})
+
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("Couldn't start cluster: %s", err)
+	}
+
+	reply := service.CallChan("/slow", &Message{})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cluster.Stop(ctx); err != nil {
+		t.Fatalf("Couldn't stop cluster: %s", err)
+	}
+
+	select {
+	case resp := <-reply:
+		if resp.Data["done"] != true {
+			t.Fatalf("Unexpected reply: %s", resp.Error)
+		}
+	default:
+		t.Fatalf("Stop returned before the in-flight request got its reply")
+	}
+
+	// new requests are refused by a stopped cluster
+	resp := service.CallWait("/slow", &Message{})
+	if resp.Error.Code != ERROR_UNAVAILABLE {
+		t.Fatalf("Request to a stopped cluster should fail, got %s", resp.Error)
+	}
+}
+
+func TestClusterRestart(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	cluster.GetService("restart").BindClosure("/test", func(request *ReceivedRequest) {})
+
+	for i := 0; i < 3; i++ {
+		if err := cluster.Start(); err != nil {
+			t.Fatalf("Couldn't start cluster: %s", err)
+		}
+		if err := cluster.Stop(context.Background()); err != nil {
+			t.Fatalf("Couldn't stop cluster: %s", err)
+		}
+	}
+
+	// let exited goroutines be collected
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("Goroutines leaked: %d before, %d after", before, after)
+	}
+}
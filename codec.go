@@ -0,0 +1,334 @@
+package nrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	CODEC_GOB     = 1
+	CODEC_JSON    = 2
+	CODEC_MSGPACK = 3
+
+	// maximum size of an encoded message in a frame
+	MAX_FRAME_SIZE = 64 * 1024 * 1024
+)
+
+// Encodes whole messages sent by protocols. Each frame is flagged with the id of
+// its codec so that a node can receive messages of any registered codec, replies
+// being encoded with the codec of their request.
+//
+// Gob keeps every Go type and the request logger. JSON and MessagePack can be used
+// by clients written in other languages, but only carry maps, arrays and basic
+// values in Data: messages with objects marshalled by a ProtocolMarshaller can't be
+// encoded with them.
+type Codec interface {
+	CodecId() byte
+	CodecName() string
+	Marshal(message *Message) ([]byte, error)
+	Unmarshal(data []byte) (*Message, error)
+}
+
+var (
+	codecsMutex sync.Mutex
+	codecs      = make(map[byte]Codec)
+)
+
+func init() {
+	RegisterCodec(GobCodec{})
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(MsgpackCodec{})
+}
+
+// Registers a codec so that frames flagged with its id can be decoded
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	codecs[codec.CodecId()] = codec
+	codecsMutex.Unlock()
+}
+
+func getCodec(id byte) (Codec, error) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codec, found := codecs[id]
+	if !found {
+		return nil, fmt.Errorf("Unknown codec %d", id)
+	}
+	return codec, nil
+}
+
+// Writes a frame: codec id, big endian uint32 length and the encoded message
+func writeFrame(writer io.Writer, message *Message, codec Codec) error {
+	data, err := codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(data) > MAX_FRAME_SIZE {
+		return fmt.Errorf("Message of %d bytes is over maximum frame size", len(data))
+	}
+
+	header := make([]byte, 5)
+	header[0] = codec.CodecId()
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// Reads the codec id and encoded message of a frame without decoding it, so that
+// a stream stays readable after a message that can't be decoded
+func readRawFrame(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MAX_FRAME_SIZE {
+		return 0, nil, fmt.Errorf("Frame of %d bytes is over maximum frame size", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+// Codec using encoding/gob, the default one
+type GobCodec struct{}
+
+func (c GobCodec) CodecId() byte     { return CODEC_GOB }
+func (c GobCodec) CodecName() string { return "gob" }
+
+func (c GobCodec) Marshal(message *Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(message)
+	return buf.Bytes(), err
+}
+
+func (c GobCodec) Unmarshal(data []byte) (*Message, error) {
+	message := &Message{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(message)
+	return message, err
+}
+
+// Returns an error if data contains an object marshalled by a ProtocolMarshaller,
+// that the codec would send as a plain map never unmarshalled by the receiver
+func checkWireData(codec Codec, value interface{}) error {
+	switch val := value.(type) {
+	case *MarshalledObject:
+		return fmt.Errorf("Codec %s can't encode objects marshalled by %s, use gob", codec.CodecName(), val.Name)
+	case Map:
+		for _, v := range val {
+			if err := checkWireData(codec, v); err != nil {
+				return err
+			}
+		}
+	case Array:
+		for _, v := range val {
+			if err := checkWireData(codec, v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range val {
+			if err := checkWireData(codec, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Message as encoded by codecs that don't know Go types
+type wireMessage struct {
+	ServiceName    string       `nrv:"service" json:"service"`
+	Path           string       `nrv:"path" json:"path"`
+	Method         string       `nrv:"method,omitempty" json:"method,omitempty"`
+	Destination    []wireMember `nrv:"destination,omitempty" json:"destination,omitempty"`
+	DestinationRdv uint32       `nrv:"destination_rdv,omitempty" json:"destination_rdv,omitempty"`
+	Source         []wireMember `nrv:"source,omitempty" json:"source,omitempty"`
+	SourceRdv      uint32       `nrv:"source_rdv,omitempty" json:"source_rdv,omitempty"`
+	TraceId        uint64       `nrv:"trace_id,omitempty" json:"trace_id,omitempty"`
+	SpanId         uint64       `nrv:"span_id,omitempty" json:"span_id,omitempty"`
+	Timeout        uint32       `nrv:"timeout,omitempty" json:"timeout,omitempty"`
+	Data           Map          `nrv:"data,omitempty" json:"data,omitempty"`
+	Error          *wireError   `nrv:"error,omitempty" json:"error,omitempty"`
+}
+
+type wireMember struct {
+	Token   uint32 `nrv:"token" json:"token"`
+	Address string `nrv:"address" json:"address"`
+	TCPPort int    `nrv:"tcp_port" json:"tcp_port"`
+	UDPPort int    `nrv:"udp_port" json:"udp_port"`
+}
+
+type wireError struct {
+	Message string `nrv:"message" json:"message"`
+	Code    uint16 `nrv:"code" json:"code"`
+}
+
+func toWireMembers(members *ServiceMembers) []wireMember {
+	if members.Empty() {
+		return nil
+	}
+
+	wire := make([]wireMember, members.Len())
+	for i, member := range members.Slice() {
+		wire[i] = wireMember{uint32(member.Token), member.Node.Address, member.Node.TCPPort, member.Node.UDPPort}
+	}
+	return wire
+}
+
+func fromWireMembers(wire []wireMember) *ServiceMembers {
+	members := NewServiceMembers()
+	for _, member := range wire {
+		members.Add(ServiceMember{Token(member.Token), &Node{member.Address, member.TCPPort, member.UDPPort}})
+	}
+	return members
+}
+
+func toWireMessage(message *Message) *wireMessage {
+	wire := &wireMessage{
+		ServiceName:    message.ServiceName,
+		Path:           message.Path,
+		Method:         message.Method,
+		Destination:    toWireMembers(message.Destination),
+		DestinationRdv: message.DestinationRdv,
+		Source:         toWireMembers(message.Source),
+		SourceRdv:      message.SourceRdv,
+		TraceId:        message.TraceId,
+		SpanId:         message.SpanId,
+		Timeout:        message.Timeout,
+		Data:           message.Data,
+	}
+	if !message.Error.Empty() {
+		wire.Error = &wireError{message.Error.Message, message.Error.Code}
+	}
+	return wire
+}
+
+func (wire *wireMessage) toMessage() *Message {
+	message := &Message{
+		ServiceName:    wire.ServiceName,
+		Path:           wire.Path,
+		Method:         wire.Method,
+		Destination:    fromWireMembers(wire.Destination),
+		DestinationRdv: wire.DestinationRdv,
+		Source:         fromWireMembers(wire.Source),
+		SourceRdv:      wire.SourceRdv,
+		TraceId:        wire.TraceId,
+		SpanId:         wire.SpanId,
+		Timeout:        wire.Timeout,
+		Data:           wire.Data,
+	}
+	if message.Data == nil {
+		message.Data = NewMap()
+	}
+	if wire.Error != nil {
+		message.Error = Error{wire.Error.Message, wire.Error.Code}
+	}
+	return message
+}
+
+// Codec using JSON. Numbers in Data are decoded as int64 if they are integers,
+// float64 otherwise.
+type JSONCodec struct{}
+
+func (c JSONCodec) CodecId() byte     { return CODEC_JSON }
+func (c JSONCodec) CodecName() string { return "json" }
+
+func (c JSONCodec) Marshal(message *Message) ([]byte, error) {
+	if err := checkWireData(c, message.Data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(toWireMessage(message))
+}
+
+func (c JSONCodec) Unmarshal(data []byte) (*Message, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	wire := &wireMessage{}
+	if err := decoder.Decode(wire); err != nil {
+		return nil, err
+	}
+	if wire.Data != nil {
+		wire.Data = fromJSONValue(wire.Data).(Map)
+	}
+	return wire.toMessage(), nil
+}
+
+// Converts values decoded by encoding/json to maps, arrays and numbers
+func fromJSONValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case Map:
+		for k, v := range val {
+			val[k] = fromJSONValue(v)
+		}
+		return val
+	case map[string]interface{}:
+		return fromJSONValue(Map(val))
+	case []interface{}:
+		ar := NewArraySize(len(val))
+		for i, v := range val {
+			ar[i] = fromJSONValue(v)
+		}
+		return ar
+	case json.Number:
+		if num, err := val.Int64(); err == nil {
+			return num
+		}
+		num, _ := val.Float64()
+		return num
+	}
+	return value
+}
+
+// Codec using MessagePack, see msgpack.go
+type MsgpackCodec struct{}
+
+func (c MsgpackCodec) CodecId() byte     { return CODEC_MSGPACK }
+func (c MsgpackCodec) CodecName() string { return "msgpack" }
+
+func (c MsgpackCodec) Marshal(message *Message) ([]byte, error) {
+	if err := checkWireData(c, message.Data); err != nil {
+		return nil, err
+	}
+	wire, err := NewMapFromStruct(toWireMessage(message))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	err = writeMsgpack(buf, wire)
+	return buf.Bytes(), err
+}
+
+func (c MsgpackCodec) Unmarshal(data []byte) (*Message, error) {
+	reader := bytes.NewReader(data)
+	value, err := readMsgpack(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	mp, ok := value.(Map)
+	if !ok {
+		return nil, fmt.Errorf("Expected a map, got %T", value)
+	}
+
+	wire := &wireMessage{}
+	if err := mp.Into(wire); err != nil {
+		return nil, err
+	}
+	return wire.toMessage(), nil
+}
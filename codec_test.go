@@ -0,0 +1,158 @@
+package nrv
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testCodecMessage() *Message {
+	node := &Node{"127.0.0.1", 1000, 1001}
+	return &Message{
+		ServiceName:    "codec",
+		Path:           "/test",
+		Destination:    NewServiceMembers(ServiceMember{Token(12), node}),
+		Source:         NewServiceMembers(ServiceMember{Token(0), node}),
+		SourceRdv:      3,
+		DestinationRdv: 4,
+		TraceId:        1<<63 + 5,
+		SpanId:         6,
+		Data: Map{
+			"int":    -300,
+			"uint":   uint64(1) << 40,
+			"float":  1.5,
+			"string": "hello",
+			"bool":   true,
+			"nil":    nil,
+			"array":  Array{1, "two", Map{"three": 3}},
+			"map":    Map{"nested": Map{"value": "deep"}},
+			"bytes":  []byte{1, 2, 3},
+		},
+		Error: Error{"failed", ERROR_INTERNAL},
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}, MsgpackCodec{}} {
+		buf := &bytes.Buffer{}
+		if err := writeFrame(buf, testCodecMessage(), codec); err != nil {
+			t.Fatalf("Couldn't write %s frame: %s", codec.CodecName(), err)
+		}
+		if buf.Bytes()[0] != codec.CodecId() {
+			t.Fatalf("Frame isn't flagged with %s codec", codec.CodecName())
+		}
+
+		message, err := readMessage(buf, nil)
+		if err != nil {
+			t.Fatalf("Couldn't read %s frame: %s", codec.CodecName(), err)
+		}
+		if message.codec.CodecId() != codec.CodecId() {
+			t.Fatalf("Frame read with wrong codec %s", message.codec.CodecName())
+		}
+
+		if message.ServiceName != "codec" || message.Path != "/test" || message.SourceRdv != 3 || message.DestinationRdv != 4 ||
+			message.TraceId != 1<<63+5 || message.SpanId != 6 || message.Error.Code != ERROR_INTERNAL {
+			t.Fatalf("%s message wasn't decoded: %+v", codec.CodecName(), message)
+		}
+		if message.Destination.Len() != 1 || message.Destination.Get(0).Token != 12 || message.Destination.Get(0).Node.UDPPort != 1001 {
+			t.Fatalf("%s destination wasn't decoded: %s", codec.CodecName(), message.Destination)
+		}
+
+		decoded := &struct {
+			Int    int
+			Uint   uint64
+			Float  float64
+			String string
+			Bool   bool
+			Array  []interface{}
+			Map    map[string]map[string]string
+		}{}
+		if err := message.Data.Into(decoded); err != nil {
+			t.Fatalf("Couldn't decode %s data: %s", codec.CodecName(), err)
+		}
+		if decoded.Int != -300 || decoded.Uint != 1<<40 || decoded.Float != 1.5 || decoded.String != "hello" || !decoded.Bool ||
+			len(decoded.Array) != 3 || decoded.Map["nested"]["value"] != "deep" {
+			t.Fatalf("%s data wasn't decoded: %+v", codec.CodecName(), decoded)
+		}
+	}
+}
+
+// Marshals strings prefixed by "marshal:" as their suffix
+type testMarshaller struct{}
+
+func (m testMarshaller) MarshallerName() string { return "test" }
+
+func (m testMarshaller) CanMarshal(obj interface{}) bool {
+	str, ok := obj.(string)
+	return ok && strings.HasPrefix(str, "marshal:")
+}
+
+func (m testMarshaller) Marshal(obj interface{}) ([]byte, error) {
+	return []byte(strings.TrimPrefix(obj.(string), "marshal:")), nil
+}
+
+func (m testMarshaller) Unmarshal(bytes []byte) (interface{}, error) {
+	return "marshal:" + string(bytes), nil
+}
+
+func TestCodecsMarshaller(t *testing.T) {
+	marshallers := map[string]ProtocolMarshaller{"test": testMarshaller{}}
+	data := Map{"value": "marshal:hello", "array": Array{Map{"nested": "marshal:deep"}}}
+
+	buf := &bytes.Buffer{}
+	if err := writeMessage(buf, &Message{Data: data}, GobCodec{}, marshallers); err != nil {
+		t.Fatalf("Couldn't write gob frame: %s", err)
+	}
+	message, err := readMessage(buf, marshallers)
+	if err != nil || message.Data["value"] != "marshal:hello" || fmt.Sprint(message.Data["array"]) != "[map[nested:marshal:deep]]" {
+		t.Fatalf("Marshalled objects weren't decoded: %v %s", message, err)
+	}
+
+	// other codecs would send them as plain maps, never unmarshalled
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		err := writeMessage(&bytes.Buffer{}, &Message{Data: data}, codec, marshallers)
+		if err == nil || !strings.Contains(err.Error(), "marshalled by test") {
+			t.Fatalf("Marshalled objects shouldn't be encoded with %s, got %v", codec.CodecName(), err)
+		}
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeMsgpack(buf, Map{"a": Array{1, -1, 200, "b"}})
+
+	expected := []byte{0x81, 0xa1, 'a', 0x94, 0x01, 0xff, 0xcc, 0xc8, 0xa1, 'b'}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("Unexpected encoding: % x", buf.Bytes())
+	}
+
+	if _, err := readMsgpack(bytes.NewReader([]byte{0x92, 0x01})); err == nil {
+		t.Fatalf("Truncated array should return an error")
+	}
+}
+
+func TestCodecReplyWithRequestCodec(t *testing.T) {
+	codecs := []Codec{JSONCodec{}, MsgpackCodec{}}
+	i := 0
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		cluster.GetDefaultProtocol().(*ProtocolMemory).Codec = codecs[i]
+		i++
+
+		service.BindClosure("/echo", func(request *ReceivedRequest) {
+			request.Reply(Map{"codec": request.Message.codec.CodecName(), "value": request.Data["value"]})
+		})
+	})
+	defer stopClusters(clusters)
+
+	resp := <-clusters[0].GetService("mem").CallChan("/echo", &Message{
+		Destination: NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()}),
+		Data:        Map{"value": 42},
+	})
+	if resp.Data["codec"] != "json" || resp.Data["value"] != int64(42) {
+		t.Fatalf("Request wasn't received with sender's codec: %v", resp.Data)
+	}
+	if resp.Message.codec.CodecName() != "json" {
+		t.Fatalf("Reply wasn't sent with request's codec: %s", resp.Message.codec.CodecName())
+	}
+}
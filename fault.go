@@ -0,0 +1,286 @@
+package nrv
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	FAULT_DROP = iota
+	FAULT_DELAY
+	FAULT_DUPLICATE
+	FAULT_REORDER
+)
+
+// Injects network faults in messages delivered between nodes of a MemorySwitchboard.
+// Rules apply to a pair of nodes, a nil node matching any node. Random decisions
+// are drawn from a seeded source so that scenarios are reproducible.
+type FaultInjector struct {
+	mutex      sync.Mutex
+	rand       *rand.Rand
+	rules      []*faultRule
+	partitions map[string]int
+	stats      FaultStats
+
+	// message held by a reorder rule, by pair of nodes
+	held map[string]*heldMessage
+}
+
+// Message held until the next one between the same nodes is delivered or its
+// window has elapsed
+type heldMessage struct {
+	deliver func()
+	timer   *time.Timer
+}
+
+type faultRule struct {
+	kind        int
+	from        *Node
+	to          *Node
+	probability float64
+	minDelay    time.Duration
+	maxDelay    time.Duration
+}
+
+func (r *faultRule) matches(from, to *Node) bool {
+	return (r.from == nil || r.from.Is(from)) && (r.to == nil || r.to.Is(to))
+}
+
+// Counters of what happened to messages that went through the injector
+type FaultStats struct {
+	Delivered  int
+	Dropped    int
+	Delayed    int
+	Duplicated int
+	Reordered  int
+}
+
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{
+		rand: rand.New(rand.NewSource(seed)),
+		held: make(map[string]*heldMessage),
+	}
+}
+
+func (fi *FaultInjector) addRule(rule *faultRule) *FaultInjector {
+	fi.mutex.Lock()
+	fi.rules = append(fi.rules, rule)
+	fi.mutex.Unlock()
+	return fi
+}
+
+// Drops messages from a node to another with the given probability
+func (fi *FaultInjector) Drop(from, to *Node, probability float64) *FaultInjector {
+	return fi.addRule(&faultRule{kind: FAULT_DROP, from: from, to: to, probability: probability})
+}
+
+// Delays every message from a node to another by a random duration in [min, max]
+func (fi *FaultInjector) Delay(from, to *Node, min, max time.Duration) *FaultInjector {
+	return fi.addRule(&faultRule{kind: FAULT_DELAY, from: from, to: to, probability: 1, minDelay: min, maxDelay: max})
+}
+
+// Delivers messages from a node to another twice with the given probability
+func (fi *FaultInjector) Duplicate(from, to *Node, probability float64) *FaultInjector {
+	return fi.addRule(&faultRule{kind: FAULT_DUPLICATE, from: from, to: to, probability: probability})
+}
+
+// Holds messages from a node to another with the given probability until the next
+// message between them is delivered, so that they are swapped. A held message is
+// delivered after window if no other message came.
+func (fi *FaultInjector) Reorder(from, to *Node, probability float64, window time.Duration) *FaultInjector {
+	return fi.addRule(&faultRule{kind: FAULT_REORDER, from: from, to: to, probability: probability, maxDelay: window})
+}
+
+// Splits nodes in groups that can't talk to each other. Nodes that are in no
+// group can still talk to every node.
+func (fi *FaultInjector) Partition(groups ...Nodes) *FaultInjector {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	fi.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			fi.partitions[node.String()] = i
+		}
+	}
+	return fi
+}
+
+// Removes partitions
+func (fi *FaultInjector) Heal() *FaultInjector {
+	fi.mutex.Lock()
+	fi.partitions = nil
+	fi.mutex.Unlock()
+	return fi
+}
+
+// Removes partitions and every rule
+func (fi *FaultInjector) Clear() *FaultInjector {
+	fi.mutex.Lock()
+	fi.partitions = nil
+	fi.rules = nil
+	fi.mutex.Unlock()
+	return fi
+}
+
+func (fi *FaultInjector) Stats() FaultStats {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	return fi.stats
+}
+
+func (fi *FaultInjector) partitioned(from, to *Node) bool {
+	if fi.partitions == nil {
+		return false
+	}
+
+	fromGroup, fromFound := fi.partitions[from.String()]
+	toGroup, toFound := fi.partitions[to.String()]
+	return fromFound && toFound && fromGroup != toGroup
+}
+
+func (fi *FaultInjector) randomDelay(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(fi.rand.Int63n(int64(max-min)+1))
+}
+
+// Delivers a message from a node to another by calling deliver according to the
+// rules: never, after a delay, many times, or after the next message between them
+func (fi *FaultInjector) inject(from, to *Node, deliver func()) {
+	fi.mutex.Lock()
+	copies, delay, reorder := fi.plan(from, to)
+
+	pair := from.String() + ">" + to.String()
+	held := fi.held[pair]
+	if copies > 0 && reorder && held == nil {
+		held = &heldMessage{deliver: deliver}
+		held.timer = time.AfterFunc(fi.reorderWindow(from, to), func() {
+			fi.release(pair, held)
+		})
+		fi.held[pair] = held
+		fi.stats.Reordered++
+		fi.mutex.Unlock()
+		return
+	}
+
+	// the held message is delivered after this one, or when its window elapses if
+	// this one is dropped
+	if copies > 0 && held != nil {
+		held.timer.Stop()
+		delete(fi.held, pair)
+	} else {
+		held = nil
+	}
+	fi.stats.Delivered += copies
+	fi.mutex.Unlock()
+
+	send := func() {
+		for i := 0; i < copies; i++ {
+			deliver()
+		}
+		if held != nil {
+			held.deliver()
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, send)
+	} else {
+		send()
+	}
+}
+
+// Delivers a held message whose window elapsed, if it's still held
+func (fi *FaultInjector) release(pair string, held *heldMessage) {
+	fi.mutex.Lock()
+	if fi.held[pair] != held {
+		fi.mutex.Unlock()
+		return
+	}
+	delete(fi.held, pair)
+	fi.stats.Delivered++
+	fi.mutex.Unlock()
+
+	held.deliver()
+}
+
+// Returns the window of the first reorder rule matching a pair of nodes, must be
+// called with the mutex locked
+func (fi *FaultInjector) reorderWindow(from, to *Node) time.Duration {
+	for _, rule := range fi.rules {
+		if rule.kind == FAULT_REORDER && rule.matches(from, to) {
+			return rule.maxDelay
+		}
+	}
+	return 0
+}
+
+// Returns how many copies of a message from a node to another must be delivered,
+// none if it's dropped, after which delay, and whether it must be reordered. Must
+// be called with the mutex locked.
+func (fi *FaultInjector) plan(from, to *Node) (copies int, delay time.Duration, reorder bool) {
+	if fi.partitioned(from, to) {
+		fi.stats.Dropped++
+		return 0, 0, false
+	}
+
+	copies = 1
+	for _, rule := range fi.rules {
+		if !rule.matches(from, to) || fi.rand.Float64() >= rule.probability {
+			continue
+		}
+
+		switch rule.kind {
+		case FAULT_DROP:
+			fi.stats.Dropped++
+			return 0, 0, false
+		case FAULT_DELAY:
+			delay += fi.randomDelay(rule.minDelay, rule.maxDelay)
+			fi.stats.Delayed++
+		case FAULT_DUPLICATE:
+			copies++
+			fi.stats.Duplicated++
+		case FAULT_REORDER:
+			reorder = true
+		}
+	}
+	return copies, delay, reorder
+}
+
+// Steps changing faults over time, played by a FaultInjector
+type FaultScenario struct {
+	steps []faultStep
+}
+
+type faultStep struct {
+	after  time.Duration
+	action func(fi *FaultInjector)
+}
+
+func NewFaultScenario() *FaultScenario {
+	return &FaultScenario{}
+}
+
+// Adds a step executed the given duration after the previous one
+func (s *FaultScenario) Then(after time.Duration, action func(fi *FaultInjector)) *FaultScenario {
+	s.steps = append(s.steps, faultStep{after, action})
+	return s
+}
+
+// Plays the scenario in background. The returned channel is closed once every
+// step has been executed.
+func (fi *FaultInjector) Play(scenario *FaultScenario) chan bool {
+	done := make(chan bool)
+	go func() {
+		for _, step := range scenario.steps {
+			if step.after > 0 {
+				time.Sleep(step.after)
+			}
+			step.action(fi)
+		}
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,167 @@
+package nrv
+
+import (
+	"testing"
+	"time"
+)
+
+// messages are sent synchronously through the injector so its stats can be checked
+// right after a call, replies being waited for at most this long in case of a bug
+const faultTestWait = 5 * time.Second
+
+func newFaultClusters(t *testing.T, faults *FaultInjector, handled chan interface{}) []*StaticCluster {
+	sb := NewMemorySwitchboard()
+	sb.Faults = faults
+	return newMemoryClusters(t, sb, 2, func(cluster *StaticCluster, service *Service) {
+		service.BindClosure("/ping", func(request *ReceivedRequest) {
+			handled <- request.Data["i"]
+			request.Reply(Map{"node": cluster.GetLocalNode().Address})
+		})
+		// handled one at a time, in the order they are received
+		service.Bind(&Binding{
+			Path:           "/order",
+			MaxConcurrency: 1,
+			MaxQueue:       10,
+			Closure: func(request *ReceivedRequest) {
+				handled <- request.Data["i"]
+			},
+		})
+	})
+}
+
+func pingNode(t *testing.T, cluster *StaticCluster, node *Node) *ReceivedRequest {
+	req := &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node})}
+	select {
+	case resp := <-cluster.GetService("mem").CallChan("/ping", req):
+		return resp
+	case <-time.After(faultTestWait):
+		t.Fatalf("No reply from %s", node)
+		return nil
+	}
+}
+
+// sends a request without waiting for a reply, that can't come if it's dropped
+func sendNode(cluster *StaticCluster, node *Node, path string, i int) {
+	cluster.GetService("mem").Call(path, &Message{
+		Destination: NewServiceMembers(ServiceMember{Token(0), node}),
+		Data:        Map{"i": i},
+	})
+}
+
+func waitHandled(t *testing.T, handled chan interface{}) interface{} {
+	select {
+	case i := <-handled:
+		return i
+	case <-time.After(faultTestWait):
+		t.Fatalf("Request was never handled")
+		return nil
+	}
+}
+
+func TestFaultPartition(t *testing.T) {
+	handled := make(chan interface{}, 10)
+	faults := NewFaultInjector(1)
+	clusters := newFaultClusters(t, faults, handled)
+	defer stopClusters(clusters)
+	node0, node1 := clusters[0].GetLocalNode(), clusters[1].GetLocalNode()
+
+	faults.Partition(Nodes{node0}, Nodes{node1})
+	sendNode(clusters[0], node1, "/ping", 0)
+	if faults.Stats().Dropped != 1 {
+		t.Fatalf("Request to a partitioned node should be dropped: %+v", faults.Stats())
+	}
+	pingNode(t, clusters[0], node0)
+	waitHandled(t, handled)
+
+	faults.Heal()
+	if resp := pingNode(t, clusters[0], node1); resp.Data["node"] != node1.Address {
+		t.Fatalf("Healed node should reply, got %v", resp.Data)
+	}
+}
+
+func TestFaultDropDelayDuplicate(t *testing.T) {
+	handled := make(chan interface{}, 10)
+	faults := NewFaultInjector(1)
+	clusters := newFaultClusters(t, faults, handled)
+	defer stopClusters(clusters)
+	node0, node1 := clusters[0].GetLocalNode(), clusters[1].GetLocalNode()
+
+	faults.Drop(node0, node1, 1)
+	sendNode(clusters[0], node1, "/ping", 0)
+	if stats := faults.Stats(); stats.Dropped != 1 || stats.Delivered != 0 {
+		t.Fatalf("Drop wasn't counted: %+v", stats)
+	}
+
+	faults.Clear().Delay(node1, node0, 30*time.Millisecond, 30*time.Millisecond)
+	start := time.Now()
+	pingNode(t, clusters[0], node1)
+	waitHandled(t, handled)
+	if time.Now().Sub(start) < 30*time.Millisecond {
+		t.Fatalf("Reply wasn't delayed")
+	}
+
+	faults.Clear().Duplicate(node0, node1, 1)
+	sendNode(clusters[0], node1, "/ping", 1)
+	if waitHandled(t, handled) != 1 || waitHandled(t, handled) != 1 {
+		t.Fatalf("Duplicated request should be handled twice")
+	}
+}
+
+func TestFaultReorder(t *testing.T) {
+	handled := make(chan interface{}, 10)
+	faults := NewFaultInjector(1)
+	clusters := newFaultClusters(t, faults, handled)
+	defer stopClusters(clusters)
+	node0, node1 := clusters[0].GetLocalNode(), clusters[1].GetLocalNode()
+
+	// each held message is swapped with the next one
+	faults.Reorder(node0, node1, 1, time.Hour)
+	for i := 0; i < 4; i++ {
+		sendNode(clusters[0], node1, "/order", i)
+	}
+	for _, expected := range []int{1, 0, 3, 2} {
+		if i := waitHandled(t, handled); i != expected {
+			t.Fatalf("Expected message %d, got %v", expected, i)
+		}
+	}
+	if faults.Stats().Reordered != 2 {
+		t.Fatalf("Reorders weren't counted: %+v", faults.Stats())
+	}
+
+	// a held message is delivered once its window has elapsed
+	faults.Clear().Reorder(node0, node1, 1, 10*time.Millisecond)
+	sendNode(clusters[0], node1, "/order", 4)
+	if i := waitHandled(t, handled); i != 4 {
+		t.Fatalf("Expected held message to be delivered, got %v", i)
+	}
+}
+
+func TestFaultScenario(t *testing.T) {
+	handled := make(chan interface{}, 10)
+	faults := NewFaultInjector(1)
+	clusters := newFaultClusters(t, faults, handled)
+	defer stopClusters(clusters)
+	node0, node1 := clusters[0].GetLocalNode(), clusters[1].GetLocalNode()
+
+	// the scenario waits for the request to be sent during the partition
+	partitioned, sent := make(chan bool), make(chan bool)
+	done := faults.Play(NewFaultScenario().
+		Then(0, func(fi *FaultInjector) {
+			fi.Partition(Nodes{node0}, Nodes{node1})
+			close(partitioned)
+			<-sent
+		}).
+		Then(10*time.Millisecond, func(fi *FaultInjector) { fi.Heal() }))
+
+	<-partitioned
+	sendNode(clusters[0], node1, "/ping", 0)
+	if faults.Stats().Dropped != 1 {
+		t.Fatalf("Request during partition should be dropped: %+v", faults.Stats())
+	}
+	close(sent)
+
+	<-done
+	if resp := pingNode(t, clusters[0], node1); resp.Data["node"] != node1.Address {
+		t.Fatalf("Request after scenario should get a reply, got %v", resp.Data)
+	}
+}
@@ -0,0 +1,105 @@
+package nrv
+
+import (
+	"sync"
+)
+
+// Policies of a binding to shed requests when its receive queue is full
+const (
+	// refuses the request just received
+	SHED_NEWEST = 0
+	// refuses the request that has waited the most, to handle the new one
+	SHED_OLDEST = 1
+)
+
+// Bounds the number of requests received by a binding that are handled at once.
+// Requests over the binding's MaxConcurrency wait in a queue of at most MaxQueue
+// requests, and are shed when it's full: their sender gets an ERROR_BUSY reply.
+// Replies to requests sent by this node are never queued.
+type receiveLimiter struct {
+	binding *Binding
+
+	mutex   sync.Mutex
+	running int
+	queue   []*ReceivedRequest
+
+	queueGauge *Gauge
+	shedCount  *Counter
+}
+
+func newReceiveLimiter(binding *Binding) *receiveLimiter {
+	labels := Labels{
+		"service": binding.service.Name,
+		"binding": binding.Path,
+	}
+	registry := binding.RequestMetrics.Registry
+	return &receiveLimiter{
+		binding:    binding,
+		queueGauge: registry.Gauge("nrv_receive_queue_size", "Number of received requests waiting to be handled", labels),
+		shedCount:  registry.Counter("nrv_requests_shed_total", "Number of received requests refused because the binding was busy", labels),
+	}
+}
+
+// Handles a received request in its own goroutine if the binding isn't saturated,
+// otherwise queues or sheds it
+func (l *receiveLimiter) submit(request *ReceivedRequest) {
+	if l.binding.MaxConcurrency <= 0 || request.Message.DestinationRdv > 0 {
+		go l.handle(request)
+		return
+	}
+
+	l.mutex.Lock()
+	if l.running < l.binding.MaxConcurrency {
+		l.running++
+		l.mutex.Unlock()
+		go l.run(request)
+		return
+	}
+
+	var shed *ReceivedRequest
+	if len(l.queue) < l.binding.MaxQueue {
+		l.queue = append(l.queue, request)
+	} else if l.binding.Shedding == SHED_OLDEST && len(l.queue) > 0 {
+		shed = l.queue[0]
+		l.queue = append(l.queue[1:], request)
+	} else {
+		shed = request
+	}
+	l.queueGauge.Set(float64(len(l.queue)))
+	l.mutex.Unlock()
+
+	if shed != nil {
+		l.shed(shed)
+	}
+}
+
+// Handles requests until the queue is empty, freeing a slot after
+func (l *receiveLimiter) run(request *ReceivedRequest) {
+	for request != nil {
+		l.handle(request)
+
+		l.mutex.Lock()
+		request = nil
+		if len(l.queue) > 0 {
+			request = l.queue[0]
+			l.queue[0] = nil
+			l.queue = l.queue[1:]
+		} else {
+			l.running--
+		}
+		l.queueGauge.Set(float64(len(l.queue)))
+		l.mutex.Unlock()
+	}
+}
+
+func (l *receiveLimiter) handle(request *ReceivedRequest) {
+	l.binding.getFirstBackwardHandler().HandleRequestReceive(request)
+}
+
+// Passes a refused request in the binding's chain like any other so that it's
+// logged, traced and measured, the binding replying busy instead of handling it
+func (l *receiveLimiter) shed(request *ReceivedRequest) {
+	l.shedCount.Inc()
+	request.shed = true
+	go l.handle(request)
+}
@@ -0,0 +1,93 @@
+package nrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiveLimiterShedding(t *testing.T) {
+	for _, policy := range []int{SHED_NEWEST, SHED_OLDEST} {
+		release := make(chan bool)
+		started := make(chan bool, 10)
+		registries := make(map[string]*MetricsRegistry)
+		clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+			registries[cluster.GetLocalNode().Address] = NewMetricsRegistry()
+			service.Bind(&Binding{
+				Path:           "/slow",
+				RequestMetrics: &RequestMetrics{Registry: registries[cluster.GetLocalNode().Address]},
+				MaxConcurrency: 1,
+				MaxQueue:       1,
+				Shedding:       policy,
+				Closure: func(request *ReceivedRequest) {
+					started <- true
+					<-release
+					request.Reply(Map{"id": request.Data["id"]})
+				},
+			})
+		})
+
+		service := clusters[0].GetService("mem")
+		limiter := clusters[1].GetService("mem").GetBinding("/slow").limiter
+		call := func(id int) chan *ReceivedRequest {
+			return service.CallChan("/slow", &Message{
+				Destination: NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()}),
+				Data:        Map{"id": id},
+			})
+		}
+		queued := func() int {
+			limiter.mutex.Lock()
+			defer limiter.mutex.Unlock()
+			return len(limiter.queue)
+		}
+
+		// first one is handled, second one waits in the queue
+		replies := []chan *ReceivedRequest{call(0)}
+		<-started
+		replies = append(replies, call(1))
+		for queued() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		replies = append(replies, call(2))
+
+		shed, kept := 2, 1
+		if policy == SHED_OLDEST {
+			shed, kept = 1, 2
+		}
+
+		resp := <-replies[shed]
+		if resp.Error.Code != ERROR_BUSY {
+			t.Fatalf("Policy %d: request %d should have been shed, got %v %s", policy, shed, resp.Data, resp.Error)
+		}
+
+		// shed requests are measured like others
+		registry := registries[clusters[1].GetLocalNode().Address]
+		labels := Labels{"service": "mem", "binding": "/slow", "side": "receive", "code": "429"}
+		if errors := registry.Counter("nrv_request_errors_total", "", labels).Value(); errors != 1 {
+			t.Fatalf("Policy %d: shed request wasn't measured, got %v errors", policy, errors)
+		}
+
+		close(release)
+		for _, id := range []int{0, kept} {
+			resp := <-replies[id]
+			if !resp.Error.Empty() || resp.Data["id"] != id {
+				t.Fatalf("Policy %d: expected reply of request %d, got %v %s", policy, id, resp.Data, resp.Error)
+			}
+		}
+
+		// the slot is freed once the handler returns
+		deadline := time.Now().Add(time.Second)
+		for {
+			limiter.mutex.Lock()
+			running := limiter.running
+			limiter.mutex.Unlock()
+			if running == 0 && queued() == 0 {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("Policy %d: limiter still has %d running and %d queued", policy, running, queued())
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		stopClusters(clusters)
+	}
+}
@@ -0,0 +1,164 @@
+package nrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+var (
+	contextType         = reflect.TypeOf((*context.Context)(nil)).Elem()
+	receivedRequestType = reflect.TypeOf((*ReceivedRequest)(nil))
+	errorType           = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Handler of the form func(ctx context.Context, request *ReceivedRequest, in *In) (*Out, error)
+// where In and Out are structs. The request's data is decoded into In, Out is encoded
+// in the reply's data and a returned error is sent as the reply's error. Data that
+// can't be decoded is replied with a bad request error without calling the handler.
+type typedHandler struct {
+	fn       reflect.Value
+	receiver *reflect.Value
+	inType   reflect.Type
+}
+
+// Checks the signature of a typed handler function. If receiver is given, fn is a
+// method expression whose first argument is the receiver.
+func newTypedHandler(fn reflect.Value, receiver *reflect.Value) (*typedHandler, error) {
+	typ := fn.Type()
+	if typ.Kind() != reflect.Func {
+		return nil, fmt.Errorf("Handler must be a function, got %s", typ)
+	}
+
+	offset := 0
+	if receiver != nil {
+		offset = 1
+	}
+
+	if typ.NumIn() != offset+3 || typ.In(offset) != contextType || typ.In(offset+1) != receivedRequestType || !isStructPtr(typ.In(offset+2)) {
+		return nil, fmt.Errorf("Handler must take (context.Context, *ReceivedRequest, *struct), got %s", typ)
+	}
+	if typ.NumOut() != 2 || !isStructPtr(typ.Out(0)) || typ.Out(1) != errorType {
+		return nil, fmt.Errorf("Handler must return (*struct, error), got %s", typ)
+	}
+
+	return &typedHandler{
+		fn:       fn,
+		receiver: receiver,
+		inType:   typ.In(offset + 2).Elem(),
+	}, nil
+}
+
+func isStructPtr(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Ptr && typ.Elem().Kind() == reflect.Struct
+}
+
+// Returns true if a method looks like a typed handler, ie: takes a context first
+func isTypedMethod(method reflect.Method) bool {
+	typ := method.Func.Type()
+	return typ.NumIn() > 1 && typ.In(1) == contextType
+}
+
+func (h *typedHandler) call(request *ReceivedRequest) {
+	in := reflect.New(h.inType)
+	if err := request.Data.Into(in.Interface()); err != nil {
+		request.Logger.Warning("Handler> Couldn't decode request %s: %s", request, err)
+		if request.NeedReply() {
+			request.ReplyMessage(&Message{Error: Error{err.Error(), ERROR_BAD_REQUEST}})
+		}
+		return
+	}
+
+	values := make([]reflect.Value, 0, 4)
+	if h.receiver != nil {
+		values = append(values, *h.receiver)
+	}
+	values = append(values, reflect.ValueOf(request.Context()), reflect.ValueOf(request), in)
+	results := h.fn.Call(values)
+
+	if !request.NeedReply() {
+		return
+	}
+
+	if errVal := results[1].Interface(); errVal != nil {
+		request.ReplyMessage(&Message{Error: toError(errVal.(error))})
+		return
+	}
+
+	if out := results[0]; !out.IsNil() {
+		request.ReplyStruct(out.Interface())
+	} else {
+		request.Reply(NewMap())
+	}
+}
+
+// Converts an error returned by a handler to a message error, keeping its code if
+// it's already an nrv Error
+func toError(err error) Error {
+	var nrvErr Error
+	if errors.As(err, &nrvErr) {
+		return nrvErr
+	}
+
+	var nrvErrPtr *Error
+	if errors.As(err, &nrvErrPtr) && nrvErrPtr != nil {
+		return *nrvErrPtr
+	}
+
+	return Error{err.Error(), ERROR_INTERNAL}
+}
+
+// Controller method of the form func(request *ReceivedRequest, params...) whose
+// other arguments are the path's parameters in order, converted to their types
+type methodHandler struct {
+	fn       reflect.Value
+	receiver reflect.Value
+	params   []pathParam
+}
+
+// Checks that a controller method takes a request and at most as many arguments
+// as the path has parameters
+func newMethodHandler(method reflect.Method, receiver reflect.Value, path *bindingPath) (*methodHandler, error) {
+	typ := method.Func.Type()
+	if typ.NumIn() < 2 || typ.In(1) != receivedRequestType {
+		return nil, fmt.Errorf("Method must take a *ReceivedRequest first, got %s", typ)
+	}
+	if typ.NumIn()-2 > len(path.params) {
+		return nil, fmt.Errorf("Method takes %d parameters but the path only has %d", typ.NumIn()-2, len(path.params))
+	}
+
+	return &methodHandler{
+		fn:       method.Func,
+		receiver: receiver,
+		params:   path.params[:typ.NumIn()-2],
+	}, nil
+}
+
+func (h *methodHandler) call(request *ReceivedRequest) {
+	typ := h.fn.Type()
+	values := []reflect.Value{h.receiver, reflect.ValueOf(request)}
+
+	errs := &DecodeError{}
+	for i, param := range h.params {
+		// named parameters are already converted to their type
+		val, found := request.Data[param.name]
+		if param.name == "" || !found {
+			val = request.Data[strconv.Itoa(i)]
+		}
+
+		arg := reflect.New(typ.In(i + 2)).Elem()
+		decodeValue(strconv.Itoa(i), val, arg, errs)
+		values = append(values, arg)
+	}
+	if err := errs.orNil(); err != nil {
+		request.Logger.Warning("Handler> Couldn't decode path parameters of request %s: %s", request, err)
+		if request.NeedReply() {
+			request.ReplyMessage(&Message{Error: Error{err.Error(), ERROR_BAD_REQUEST}})
+		}
+		return
+	}
+
+	h.fn.Call(values)
+}
@@ -0,0 +1,175 @@
+package nrv
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Sends requests resolved to many replicas to the first one only, trying the next
+// replica if no reply arrived within a delay based on the binding's latency. The
+// first reply is used and later ones are ignored. The delay is the Percentile of
+// the durations of requests sent through it once MinSamples requests have been
+// measured, and Delay before that. Up to MaxHedges replicas are tried after the
+// first one.
+//
+// Each replica is sent its own request through the binding's circuit breaker, which
+// only accounts for replicas that were tried. A replica whose circuit is open is
+// skipped right away.
+//
+// ex: service.Bind(&nrv.Binding{Path: "/users/{id}", Resolver: &nrv.ResolverParam{Count: 2}, Hedging: &nrv.Hedging{}})
+type Hedging struct {
+	BaseHandler
+
+	Percentile float64
+	Delay      time.Duration
+	MinSamples uint64
+	MaxHedges  int
+
+	durations *Histogram
+	hedges    *Counter
+}
+
+func (h *Hedging) InitHandler(binding *Binding) {
+	h.BaseHandler.InitHandler(binding)
+
+	if h.Percentile <= 0 {
+		h.Percentile = 0.95
+	}
+	if h.Delay <= 0 {
+		h.Delay = 10 * time.Millisecond
+	}
+	if h.MinSamples == 0 {
+		h.MinSamples = 100
+	}
+	if h.MaxHedges <= 0 {
+		h.MaxHedges = 1
+	}
+
+	labels := Labels{
+		"service": binding.service.Name,
+		"binding": binding.Path,
+	}
+	h.hedges = binding.RequestMetrics.Registry.Counter("nrv_hedged_requests_total", "Number of requests sent again to another replica for lack of reply", labels)
+
+	// measured by this instance only, the registry's histogram being shared by
+	// bindings of other clusters with the same service and path
+	h.durations = newHistogram(DefaultLatencyBuckets)
+}
+
+// Returns a callback recording the time a replica took to reply before calling
+// onReply. Replies of open circuits aren't recorded since they don't come from the
+// replica.
+func (h *Hedging) measure(onReply func(reply *ReceivedRequest)) func(reply *ReceivedRequest) {
+	start := time.Now()
+	var once sync.Once
+	return func(reply *ReceivedRequest) {
+		if reply.Message.Error.Code != ERROR_CIRCUIT_OPEN {
+			once.Do(func() { h.durations.ObserveDuration(time.Now().Sub(start)) })
+		}
+		onReply(reply)
+	}
+}
+
+// Returns the time to wait for a reply before trying another replica
+func (h *Hedging) delay() time.Duration {
+	if h.durations.Count() < h.MinSamples {
+		return h.Delay
+	}
+
+	seconds := h.durations.Quantile(h.Percentile)
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return h.Delay
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (h *Hedging) HandleRequestSend(request *Request) *Request {
+	if request.Message.DestinationRdv > 0 || !request.NeedReply() {
+		return h.nextHandler.HandleRequestSend(request)
+	} else if request.Message.Destination.Len() < 2 {
+		request.OnReply = h.measure(request.OnReply)
+		return h.nextHandler.HandleRequestSend(request)
+	}
+
+	replicas := request.Message.Destination.Slice()
+	if len(replicas) > h.MaxHedges+1 {
+		replicas = replicas[:h.MaxHedges+1]
+	}
+
+	// copies of the request for other replicas have their own rendez-vous, data
+	// being copied before sending since a local handler may modify it
+	message := *request.Message
+	message.Data = NewMap()
+	message.Data.Merge(request.Message.Data)
+
+	var mutex sync.Mutex
+	var timer *time.Timer
+	replied := false
+	next, pending := 1, 1
+
+	var hedge func()
+	onReply := request.OnReply
+	handleReply := func(reply *ReceivedRequest) {
+		mutex.Lock()
+		if replied {
+			mutex.Unlock()
+			return
+		}
+		pending--
+		if reply.Message.Error.Code == ERROR_CIRCUIT_OPEN && (next < len(replicas) || pending > 0) {
+			// replica refused by its circuit breaker, try the next one without waiting
+			mutex.Unlock()
+			hedge()
+			return
+		}
+		replied = true
+		if timer != nil {
+			timer.Stop()
+		}
+		mutex.Unlock()
+
+		onReply(reply)
+	}
+
+	hedge = func() {
+		mutex.Lock()
+		if replied || next >= len(replicas) {
+			mutex.Unlock()
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		replica := replicas[next]
+		next++
+		pending++
+		if next < len(replicas) {
+			timer = time.AfterFunc(h.delay(), hedge)
+		}
+		mutex.Unlock()
+
+		Log.Debug("Hedging> No reply for %s, trying replica %s", request, replica.Node)
+		h.hedges.Inc()
+
+		copied := message
+		copied.Destination = NewServiceMembers(replica)
+		h.nextHandler.HandleRequestSend(&Request{
+			Message:     &copied,
+			Binding:     request.Binding,
+			InitRequest: request.InitRequest,
+			OnReply:     h.measure(handleReply),
+			respNeeded:  1,
+		})
+	}
+
+	request.Message.Destination = NewServiceMembers(replicas[0])
+	request.respNeeded = 1
+	request.OnReply = h.measure(handleReply)
+
+	mutex.Lock()
+	timer = time.AfterFunc(h.delay(), hedge)
+	mutex.Unlock()
+
+	return h.nextHandler.HandleRequestSend(request)
+}
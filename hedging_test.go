@@ -0,0 +1,127 @@
+package nrv
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedging(t *testing.T) {
+	var handled [3]int32
+	release := make(chan bool)
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 3, func(cluster *StaticCluster, service *Service) {
+		node := cluster.GetLocalNode()
+		service.Bind(&Binding{
+			Path:    "/read",
+			Hedging: &Hedging{Delay: 20 * time.Millisecond},
+			Closure: func(request *ReceivedRequest) {
+				atomic.AddInt32(&handled[node.TCPPort-1000], 1)
+				if node.Address == "node1" && request.Data["slow"] == true {
+					<-release
+				}
+				request.Reply(Map{"node": node.Address})
+			},
+		})
+	})
+	defer stopClusters(clusters)
+	defer close(release)
+
+	service := clusters[0].GetService("mem")
+	replicas := NewServiceMembers(
+		ServiceMember{Token(0), clusters[1].GetLocalNode()},
+		ServiceMember{Token(0), clusters[2].GetLocalNode()},
+	)
+	hedges := Metrics.Counter("nrv_hedged_requests_total", "", Labels{"service": "mem", "binding": "/read"})
+	before := hedges.Value()
+
+	// slow primary, the replica's reply is used
+	start := time.Now()
+	resp := service.CallWait("/read", &Message{Destination: replicas, Data: Map{"slow": true}})
+	if resp.Data["node"] != "node2" || time.Now().Sub(start) > 200*time.Millisecond {
+		t.Fatalf("Expected a quick reply from the replica, got %v %s after %s", resp.Data, resp.Error, time.Now().Sub(start))
+	}
+	if hedges.Value() != before+1 {
+		t.Fatalf("Expected one hedged request, got %v", hedges.Value()-before)
+	}
+
+	// fast primary, the replica is never asked
+	resp = service.CallWait("/read", &Message{
+		Destination: NewServiceMembers(replicas.Slice()...),
+		Data:        Map{"slow": false},
+	})
+	time.Sleep(60 * time.Millisecond)
+	if resp.Data["node"] != "node1" || atomic.LoadInt32(&handled[2]) != 1 {
+		t.Fatalf("Replica shouldn't be asked when the primary replies, got %v and %d requests on replica", resp.Data, atomic.LoadInt32(&handled[2]))
+	}
+}
+
+func TestHedgingDelay(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	hedging := &Hedging{Delay: time.Second, MinSamples: 10}
+	cluster.GetService("hedging").Bind(&Binding{
+		Path:           "/read",
+		Hedging:        hedging,
+		RequestMetrics: &RequestMetrics{Registry: NewMetricsRegistry()},
+		Closure:        func(request *ReceivedRequest) {},
+	})
+
+	if delay := hedging.delay(); delay != time.Second {
+		t.Fatalf("Expected the default delay without samples, got %s", delay)
+	}
+	for i := 0; i < 10; i++ {
+		hedging.durations.Observe(0.04)
+	}
+	if delay := hedging.delay(); delay < 25*time.Millisecond || delay > 50*time.Millisecond {
+		t.Fatalf("Expected a delay based on durations, got %s", delay)
+	}
+}
+
+func TestHedgingCircuitBreaker(t *testing.T) {
+	breakers := make(map[string]*CircuitBreaker)
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 3, func(cluster *StaticCluster, service *Service) {
+		node := cluster.GetLocalNode()
+		breakers[node.Address] = &CircuitBreaker{MinRequests: 1, OpenDuration: time.Hour}
+		service.Bind(&Binding{
+			Path:           "/read",
+			Hedging:        &Hedging{Delay: time.Hour},
+			CircuitBreaker: breakers[node.Address],
+			Closure: func(request *ReceivedRequest) {
+				if request.Data["fail"] == true {
+					request.ReplyMessage(&Message{Error: Error{"failed", ERROR_UNAVAILABLE}})
+					return
+				}
+				request.Reply(Map{"node": node.Address})
+			},
+		})
+	})
+	defer stopClusters(clusters)
+
+	service := clusters[0].GetService("mem")
+	breaker := breakers["node0"]
+	node1, node2 := clusters[1].GetLocalNode(), clusters[2].GetLocalNode()
+
+	// fast primary, the replica isn't accounted by the breaker
+	resp := service.CallWait("/read", &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node1}, ServiceMember{Token(0), node2})})
+	if resp.Data["node"] != "node1" {
+		t.Fatalf("Expected a reply from the primary, got %v %s", resp.Data, resp.Error)
+	}
+	breaker.mutex.Lock()
+	_, found := breaker.circuits[node2.String()]
+	breaker.mutex.Unlock()
+	if found {
+		t.Fatalf("Replica that wasn't tried shouldn't be accounted by the breaker")
+	}
+
+	// primary's circuit is open, the replica is tried right away
+	service.CallWait("/read", &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node1}), Data: Map{"fail": true}})
+	if state := breaker.State(node1); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected primary's circuit to be open, got %d", state)
+	}
+	resp = service.CallWait("/read", &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node1}, ServiceMember{Token(0), node2})})
+	if resp.Data["node"] != "node2" {
+		t.Fatalf("Expected a reply from the replica, got %v %s", resp.Data, resp.Error)
+	}
+	if state := breaker.State(node2); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected replica's circuit to be closed, got %d", state)
+	}
+}
@@ -3,6 +3,8 @@ package nrv
 import (
 	"fmt"
 	golog "log"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -15,6 +17,9 @@ type Logger interface {
 	Warning(msg string, v ...interface{})
 	Error(msg string, v ...interface{})
 	Fatal(msg string, v ...interface{})
+
+	// returns a child logger with key/value pairs added to every line
+	With(fields ...interface{}) Logger
 }
 
 type loggerTrace interface {
@@ -26,14 +31,21 @@ func EndTrace(t loggerTrace) {
 	t.End()
 }
 
-// Wrapper for Go logging system
+// Wrapper for Go logging system. If a sink is given, log entries are written to
+// it with their fields instead of going through Go's log package.
 type GoLogger struct {
-	first time.Time
-	level uint8
+	first  time.Time
+	level  uint8
+	fields []LogField
+	sink   LogSink
 }
 
 func NewLogger(level uint8) Logger {
-	return &GoLogger{time.Now(), level}
+	return &GoLogger{first: time.Now(), level: level}
+}
+
+func NewStructuredLogger(level uint8, sink LogSink) Logger {
+	return &GoLogger{first: time.Now(), level: level, sink: sink}
 }
 
 func (gl *GoLogger) GetLevel() uint8 {
@@ -44,52 +56,68 @@ func (gl *GoLogger) SetLevel(level uint8) {
 	gl.level = level
 }
 
+// Returns a child logger that adds the given key/value pairs to every line
+func (gl *GoLogger) With(fields ...interface{}) Logger {
+	return &GoLogger{
+		first:  gl.first,
+		level:  gl.level,
+		fields: appendFields(gl.fields, fields),
+		sink:   gl.sink,
+	}
+}
+
 func (gl *GoLogger) Trace(metric string) loggerTrace {
 	context := &glTrace{gl, metric, time.Now()}
 	if gl.level >= 10 {
-		golog.Printf(fmt.Sprintf("TRACE START %s", metric))
+		gl.log(10, "TRACE START "+metric, nil)
 	}
 	return context
 }
 
 func (gl *GoLogger) Debug(msg string, v ...interface{}) {
 	if gl.level >= 4 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		golog.Printf("%dms > DEBUG > %s", (time.Now().Sub(gl.first))/1000000, msg)
+		gl.log(4, msg, v)
 	}
 }
 
 func (gl *GoLogger) Info(msg string, v ...interface{}) {
 	if gl.level >= 3 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		golog.Printf("%dms > INFO > %s", (time.Now().Sub(gl.first))/1000000, msg)
+		gl.log(3, msg, v)
 	}
 }
 
 func (gl *GoLogger) Warning(msg string, v ...interface{}) {
 	if gl.level >= 2 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		golog.Printf("%dms > WARN > %s", (time.Now().Sub(gl.first))/1000000, msg)
+		gl.log(2, msg, v)
 	}
 }
 
 func (gl *GoLogger) Error(msg string, v ...interface{}) {
 	if gl.level >= 1 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		golog.Printf("%dms > ERROR > %s", (time.Now().Sub(gl.first))/1000000, msg)
+		gl.log(1, msg, v)
 	}
 }
 
 func (gl *GoLogger) Fatal(msg string, v ...interface{}) {
-	golog.Fatalf("%dms > FATAL > %s", (gl.first.Sub(time.Now()))/1000000, fmt.Sprintf(msg, v...))
+	gl.log(0, msg, v)
+	os.Exit(1)
+}
+
+func (gl *GoLogger) log(level uint8, msg string, v []interface{}) {
+	if len(v) > 0 {
+		msg = fmt.Sprintf(msg, v...)
+	}
+
+	if gl.sink != nil {
+		gl.sink.WriteEntry(&LogEntry{
+			Time:    time.Now(),
+			Level:   level,
+			Message: msg,
+			Fields:  gl.fields,
+		})
+	} else {
+		golog.Printf("%dms > %s > %s%s", (time.Now().Sub(gl.first))/1000000, levelName(level), msg, formatFields(gl.fields))
+	}
 }
 
 type glTrace struct {
@@ -99,7 +127,26 @@ type glTrace struct {
 }
 
 func (glt *glTrace) End() {
-	glt.logger.Debug(fmt.Sprintf("TRACE END (%d ms)", glt.metric, (time.Now().Sub(glt.start))/1000000))
+	glt.logger.Debug("TRACE END %s (%d ms)", glt.metric, (time.Now().Sub(glt.start))/1000000)
+}
+
+func levelName(level uint8) string {
+	switch level {
+	case 0:
+		return "FATAL"
+	case 1:
+		return "ERROR"
+	case 2:
+		return "WARN"
+	case 3:
+		return "INFO"
+	case 4:
+		return "DEBUG"
+	case 10:
+		return "TRACE"
+	}
+
+	return "UNKNOWN"
 }
 
 // Request logger
@@ -107,9 +154,12 @@ type RequestLogger struct {
 	FirstLine *logLine
 	Level     uint8
 
+	// lines are added by loggers of the request, its replies and child requests
+	mutex        sync.Mutex
 	curStackLine []*logLine
 	lastPop      *logLine
 
+	binding     *Binding
 	nextHandler CallHandler
 	prevHandler CallHandler
 }
@@ -119,6 +169,7 @@ func NewRequestLogger(level uint8) Logger {
 }
 
 func (rl *RequestLogger) InitHandler(binding *Binding) {
+	rl.binding = binding
 }
 
 func (rl *RequestLogger) GetLevel() uint8 {
@@ -143,15 +194,34 @@ func (rl *RequestLogger) HandleRequestSend(request *Request) *Request {
 			Level: Log.GetLevel(),
 		}
 	}
+	setRequestLogger(request.Message)
 
 	// start a trace if it's not a reply
 	if request.Message.DestinationRdv == 0 {
 		request.sendTrace = request.Trace("req_send " + request.Binding.service.Name + ":" + request.Path)
 
+		var traceId, parentId uint64
+		if request.parentSpan != nil {
+			traceId, parentId = request.parentSpan.TraceId, request.parentSpan.Id
+		}
+		request.span = rl.startSpan("send "+request.Binding.service.Name+":"+request.Path, SPAN_CLIENT, traceId, parentId)
+		request.Message.TraceId = request.span.TraceId
+		request.Message.SpanId = request.span.Id
+
+		if !request.NeedReply() {
+			defer request.span.Finish()
+		}
+
 	} else if request.InitRequest != nil {
 		// it's a reply
 		request.Logger = request.InitRequest.Logger
+		setRequestLogger(request.Message)
 
+		if span := request.InitRequest.span; span != nil {
+			request.Message.TraceId = span.TraceId
+			request.Message.SpanId = span.Id
+			span.finishReply(request.Message)
+		}
 	}
 
 	return rl.nextHandler.HandleRequestSend(request)
@@ -163,18 +233,48 @@ func (rl *RequestLogger) HandleRequestReceive(request *ReceivedRequest) *Receive
 			Level: Log.GetLevel(),
 		}
 	}
+	setRequestLogger(request.Message)
 
 	// if we have received a response for a request, we end the tracing
-	if request.InitRequest != nil && request.InitRequest.sendTrace != nil && request.InitRequest.Logger != request.Logger {
-		sendTrace := request.InitRequest.sendTrace
-		sendTrace.End()
-		sendTrace.(*logLine).Attach(request.Logger.(*RequestLogger))
+	if request.InitRequest != nil {
+		logger := requestLoggerOf(request.Logger)
+		if request.InitRequest.sendTrace != nil && requestLoggerOf(request.InitRequest.Logger) != logger {
+			request.InitRequest.sendTraceOnce.Do(func() {
+				sendTrace := request.InitRequest.sendTrace
+				sendTrace.End()
+				if logger != nil {
+					sendTrace.(*logLine).Attach(logger)
+				}
+			})
+		}
+
+		if span := request.InitRequest.span; span != nil {
+			span.finishReply(request.Message)
+		}
+
+	} else {
+		// new request, continue the sender's trace if any
+		request.span = rl.startSpan("receive "+rl.binding.service.Name+":"+request.Path, SPAN_SERVER, request.Message.TraceId, request.Message.SpanId)
+		if !request.NeedReply() {
+			defer request.span.Finish()
+		}
 	}
 
 	return rl.prevHandler.HandleRequestReceive(request)
 }
 
+func (rl *RequestLogger) startSpan(name, kind string, traceId, parentId uint64) *Span {
+	span := Tracing.StartSpan(name, kind, traceId, parentId)
+	span.ServiceName = rl.binding.service.Name
+	span.Node = rl.binding.cluster.GetLocalNode()
+	span.SetTag("nrv.path", rl.binding.Path)
+	return span
+}
+
 func (c *RequestLogger) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if c.FirstLine != nil {
 		return c.FirstLine.stringDepth(0)
 	}
@@ -183,6 +283,9 @@ func (c *RequestLogger) String() string {
 }
 
 func (c *RequestLogger) addLine(line *logLine, newStack bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if line.Type <= c.Level {
 		if c.curStackLine == nil {
 			emptyLine := newLogLine(0, "")
@@ -209,6 +312,9 @@ func (c *RequestLogger) addLine(line *logLine, newStack bool) {
 }
 
 func (c *RequestLogger) stackPop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	// TODO: should unstack to the right line
 	c.lastPop = c.curStackLine[len(c.curStackLine)-1]
 	c.curStackLine = c.curStackLine[:len(c.curStackLine)-1]
@@ -236,47 +342,168 @@ func (c *RequestLogger) Trace(metric string) loggerTrace {
 }
 
 func (c *RequestLogger) Debug(msg string, v ...interface{}) {
-	if c.Level >= 4 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		Log.Debug(msg)
-		c.addLine(newLogLine(4, msg), false)
-	}
+	c.log(4, nil, nil, msg, v)
 }
 
 func (c *RequestLogger) Info(msg string, v ...interface{}) {
-	if c.Level >= 3 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		Log.Info(msg)
-		c.addLine(newLogLine(3, msg), false)
-	}
+	c.log(3, nil, nil, msg, v)
 }
 
 func (c *RequestLogger) Warning(msg string, v ...interface{}) {
-	if c.Level >= 2 {
-		if len(v) > 0 {
-			msg = fmt.Sprintf(msg, v...)
-		}
-		Log.Warning(msg)
-		c.addLine(newLogLine(2, msg), false)
-	}
+	c.log(2, nil, nil, msg, v)
 }
 
 func (c *RequestLogger) Error(msg string, v ...interface{}) {
-	if c.Level >= 1 {
+	c.log(1, nil, nil, msg, v)
+}
+
+func (c *RequestLogger) Fatal(msg string, v ...interface{}) {
+	c.logger(nil, nil).Fatal(msg, v...)
+}
+
+// Returns a child logger that adds the given key/value pairs to every line. Lines
+// are still added to this request logger.
+func (c *RequestLogger) With(fields ...interface{}) Logger {
+	return &requestLoggerChild{c, nil, appendFields(nil, fields)}
+}
+
+func (c *RequestLogger) log(level uint8, message *Message, fields []LogField, msg string, v []interface{}) {
+	if c.Level >= level {
 		if len(v) > 0 {
 			msg = fmt.Sprintf(msg, v...)
 		}
-		Log.Error(msg)
-		c.addLine(newLogLine(1, msg), false)
+
+		logger := c.logger(message, fields)
+		switch level {
+		case 1:
+			logger.Error(msg)
+		case 2:
+			logger.Warning(msg)
+		case 3:
+			logger.Info(msg)
+		default:
+			logger.Debug(msg)
+		}
+		c.addLine(newLogLine(level, msg), false)
 	}
 }
 
-func (c *RequestLogger) Fatal(msg string, v ...interface{}) {
-	Log.Fatal(fmt.Sprintf(msg, v...))
+// Global logger with the fields of a request's message attached
+func (c *RequestLogger) logger(message *Message, fields []LogField) Logger {
+	all := requestFields(message)
+	all = append(all, fields...)
+	if len(all) == 0 {
+		return Log
+	}
+
+	args := make([]interface{}, 0, len(all)*2)
+	for _, field := range all {
+		args = append(args, field.Key, field.Value)
+	}
+	return Log.With(args...)
+}
+
+func requestFields(message *Message) []LogField {
+	if message == nil {
+		return nil
+	}
+
+	fields := []LogField{
+		{"service", message.ServiceName},
+		{"path", message.Path},
+	}
+	if message.SourceRdv > 0 {
+		fields = append(fields, LogField{"source_rdv", message.SourceRdv})
+	}
+	if message.DestinationRdv > 0 {
+		fields = append(fields, LogField{"destination_rdv", message.DestinationRdv})
+	}
+	if message.TraceId > 0 {
+		fields = append(fields, LogField{"trace_id", fmt.Sprintf("%016x", message.TraceId)})
+	}
+	return fields
+}
+
+// Gives a request's message its own logger so that its fields are logged. Lines
+// are still added to the request logger shared with replies and child requests.
+func setRequestLogger(message *Message) {
+	if logger := requestLoggerOf(message.Logger); logger != nil {
+		message.Logger = &messageLogger{logger, message}
+	}
+}
+
+// Returns the request logger to which a logger adds lines, if any
+func requestLoggerOf(logger Logger) *RequestLogger {
+	switch l := logger.(type) {
+	case *RequestLogger:
+		return l
+	case *messageLogger:
+		return l.RequestLogger
+	case *requestLoggerChild:
+		return l.RequestLogger
+	}
+	return nil
+}
+
+// Logger of a message, adding its fields to lines of its request logger
+type messageLogger struct {
+	*RequestLogger
+	message *Message
+}
+
+func (c *messageLogger) Debug(msg string, v ...interface{}) {
+	c.log(4, c.message, nil, msg, v)
+}
+
+func (c *messageLogger) Info(msg string, v ...interface{}) {
+	c.log(3, c.message, nil, msg, v)
+}
+
+func (c *messageLogger) Warning(msg string, v ...interface{}) {
+	c.log(2, c.message, nil, msg, v)
+}
+
+func (c *messageLogger) Error(msg string, v ...interface{}) {
+	c.log(1, c.message, nil, msg, v)
+}
+
+func (c *messageLogger) Fatal(msg string, v ...interface{}) {
+	c.logger(c.message, nil).Fatal(msg, v...)
+}
+
+func (c *messageLogger) With(fields ...interface{}) Logger {
+	return &requestLoggerChild{c.RequestLogger, c.message, appendFields(nil, fields)}
+}
+
+// Logger returned by RequestLogger.With
+type requestLoggerChild struct {
+	*RequestLogger
+	message *Message
+	fields  []LogField
+}
+
+func (c *requestLoggerChild) Debug(msg string, v ...interface{}) {
+	c.log(4, c.message, c.fields, msg, v)
+}
+
+func (c *requestLoggerChild) Info(msg string, v ...interface{}) {
+	c.log(3, c.message, c.fields, msg, v)
+}
+
+func (c *requestLoggerChild) Warning(msg string, v ...interface{}) {
+	c.log(2, c.message, c.fields, msg, v)
+}
+
+func (c *requestLoggerChild) Error(msg string, v ...interface{}) {
+	c.log(1, c.message, c.fields, msg, v)
+}
+
+func (c *requestLoggerChild) Fatal(msg string, v ...interface{}) {
+	c.logger(c.message, c.fields).Fatal(msg, v...)
+}
+
+func (c *requestLoggerChild) With(fields ...interface{}) Logger {
+	return &requestLoggerChild{c.RequestLogger, c.message, appendFields(c.fields, fields)}
 }
 
 type logLine struct {
@@ -307,6 +534,8 @@ func (ll *logLine) End() {
 }
 
 func (ll *logLine) Attach(c *RequestLogger) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	ll.Child = c.FirstLine
 }
 
@@ -0,0 +1,267 @@
+package nrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key/value pair attached to a log line
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Line written by a structured logger
+type LogEntry struct {
+	Time    time.Time
+	Level   uint8
+	Message string
+	Fields  []LogField
+}
+
+// Returns the value of the given field, or nil if the entry doesn't have it
+func (e *LogEntry) Field(key string) interface{} {
+	for i := len(e.Fields) - 1; i >= 0; i-- {
+		if e.Fields[i].Key == key {
+			return e.Fields[i].Value
+		}
+	}
+	return nil
+}
+
+// Appends key/value pairs to fields, copying them so that parents aren't modified
+func appendFields(fields []LogField, keyValues []interface{}) []LogField {
+	ret := make([]LogField, len(fields), len(fields)+len(keyValues)/2+1)
+	copy(ret, fields)
+
+	for i := 0; i < len(keyValues); i += 2 {
+		key := fmt.Sprint(keyValues[i])
+		if i+1 < len(keyValues) {
+			ret = append(ret, LogField{key, keyValues[i+1]})
+		} else {
+			ret = append(ret, LogField{"extra", keyValues[i]})
+		}
+	}
+
+	return ret
+}
+
+func formatFields(fields []LogField) string {
+	ret := ""
+	for _, field := range fields {
+		value := fmt.Sprint(field.Value)
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		ret += " " + field.Key + "=" + value
+	}
+	return ret
+}
+
+// Formats a log entry into a line, including the line ending
+type LogFormat func(entry *LogEntry) []byte
+
+func TextLogFormat(entry *LogEntry) []byte {
+	return []byte(fmt.Sprintf("%s %s > %s%s\n", entry.Time.Format("2006/01/02 15:04:05.000000"), levelName(entry.Level), entry.Message, formatFields(entry.Fields)))
+}
+
+func JSONLogFormat(entry *LogEntry) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, entry.Time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, strings.ToLower(levelName(entry.Level)))
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, entry.Message)
+
+	for _, field := range entry.Fields {
+		buf.WriteByte(',')
+		writeJSONValue(buf, field.Key)
+		buf.WriteByte(':')
+		writeJSONValue(buf, field.Value)
+	}
+
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		bytes, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(bytes)
+}
+
+// Destination of log entries written by a structured logger
+type LogSink interface {
+	WriteEntry(entry *LogEntry)
+}
+
+// Writes formatted entries to a writer
+type WriterLogSink struct {
+	Writer io.Writer
+	Format LogFormat
+
+	mutex sync.Mutex
+}
+
+func NewWriterLogSink(writer io.Writer, format LogFormat) *WriterLogSink {
+	return &WriterLogSink{Writer: writer, Format: format}
+}
+
+func NewStderrLogSink(format LogFormat) *WriterLogSink {
+	return NewWriterLogSink(os.Stderr, format)
+}
+
+func (ws *WriterLogSink) WriteEntry(entry *LogEntry) {
+	line := ws.Format(entry)
+
+	ws.mutex.Lock()
+	ws.Writer.Write(line)
+	ws.mutex.Unlock()
+}
+
+// Writes formatted entries to a file, rotating it when it reaches MaxSize bytes.
+// Rotated files are renamed path.1, path.2, ... up to MaxFiles.
+type RotatingFileLogSink struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+	Format   LogFormat
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func NewRotatingFileLogSink(path string, maxSize int64, maxFiles int, format LogFormat) (*RotatingFileLogSink, error) {
+	rs := &RotatingFileLogSink{
+		Path:     path,
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
+		Format:   format,
+	}
+
+	if err := rs.open(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *RotatingFileLogSink) open() error {
+	file, err := os.OpenFile(rs.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rs.file = file
+	rs.size = stat.Size()
+	return nil
+}
+
+func (rs *RotatingFileLogSink) rotate() error {
+	rs.file.Close()
+
+	for i := rs.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rs.Path, i), fmt.Sprintf("%s.%d", rs.Path, i+1))
+	}
+	if rs.MaxFiles > 0 {
+		os.Rename(rs.Path, rs.Path+".1")
+	} else {
+		os.Remove(rs.Path)
+	}
+
+	return rs.open()
+}
+
+func (rs *RotatingFileLogSink) WriteEntry(entry *LogEntry) {
+	line := rs.Format(entry)
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.file == nil {
+		return
+	}
+
+	if rs.MaxSize > 0 && rs.size > 0 && rs.size+int64(len(line)) > rs.MaxSize {
+		if err := rs.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "RotatingFileLogSink> Couldn't rotate %s: %s\n", rs.Path, err)
+			rs.file = nil
+			return
+		}
+	}
+
+	n, _ := rs.file.Write(line)
+	rs.size += int64(n)
+}
+
+func (rs *RotatingFileLogSink) Close() error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.file == nil {
+		return nil
+	}
+	err := rs.file.Close()
+	rs.file = nil
+	return err
+}
+
+// Keeps the last entries in memory, mostly for tests
+type RingLogSink struct {
+	mutex   sync.Mutex
+	entries []*LogEntry
+	next    int
+	full    bool
+}
+
+func NewRingLogSink(size int) *RingLogSink {
+	return &RingLogSink{
+		entries: make([]*LogEntry, size),
+	}
+}
+
+func (rs *RingLogSink) WriteEntry(entry *LogEntry) {
+	rs.mutex.Lock()
+	rs.entries[rs.next] = entry
+	rs.next = (rs.next + 1) % len(rs.entries)
+	if rs.next == 0 {
+		rs.full = true
+	}
+	rs.mutex.Unlock()
+}
+
+// Returns kept entries, oldest first
+func (rs *RingLogSink) Entries() []*LogEntry {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if !rs.full {
+		ret := make([]*LogEntry, rs.next)
+		copy(ret, rs.entries[:rs.next])
+		return ret
+	}
+
+	ret := make([]*LogEntry, 0, len(rs.entries))
+	ret = append(ret, rs.entries[rs.next:]...)
+	return append(ret, rs.entries[:rs.next]...)
+}
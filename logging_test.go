@@ -0,0 +1,101 @@
+package nrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLoggingWithFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewStructuredLogger(4, NewWriterLogSink(buf, JSONLogFormat))
+	logger.With("a", 1).With("b", "two").Info("hello %s", "world")
+
+	line := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Invalid JSON line %s: %s", buf, err)
+	}
+	if line["msg"] != "hello world" || line["level"] != "info" || line["a"] != float64(1) || line["b"] != "two" {
+		t.Fatalf("Unexpected line: %s", buf)
+	}
+}
+
+func TestLoggingRequestFields(t *testing.T) {
+	sink := NewRingLogSink(100)
+	oldLog := Log
+	Log = NewStructuredLogger(4, sink)
+	defer func() { Log = oldLog }()
+
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("logging")
+	service.Members.Add(ServiceMember{Token(0), node})
+	service.BindClosure("/log", func(request *ReceivedRequest) {
+		request.Logger.With("user", "bob").Info("handling")
+		request.Reply(Map{})
+	})
+	service.CallWait("/log", &Message{})
+
+	for _, entry := range sink.Entries() {
+		if entry.Message == "handling" {
+			if entry.Field("service") != "logging" || entry.Field("path") != "/log" || entry.Field("user") != "bob" {
+				t.Fatalf("Missing request fields: %v", entry.Fields)
+			}
+			if entry.Field("source_rdv") == nil || entry.Field("trace_id") == nil {
+				t.Fatalf("Missing rdv or trace fields: %v", entry.Fields)
+			}
+			return
+		}
+	}
+	t.Fatalf("Line wasn't logged")
+}
+
+func TestLoggingChildRequestFields(t *testing.T) {
+	sink := NewRingLogSink(100)
+	oldLog := Log
+	Log = NewStructuredLogger(4, sink)
+	defer func() { Log = oldLog }()
+
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("logging")
+	service.Members.Add(ServiceMember{Token(0), node})
+	service.BindClosure("/child", func(request *ReceivedRequest) {
+		request.Logger.Info("child")
+		request.Reply(Map{})
+	})
+	service.BindClosure("/parent", func(request *ReceivedRequest) {
+		// children sent concurrently don't change the fields of the parent
+		done := make(chan bool)
+		for i := 0; i < 5; i++ {
+			go func() {
+				service.CallWait("/child", request.ChildRequest(Map{}))
+				done <- true
+			}()
+		}
+		for i := 0; i < 5; i++ {
+			<-done
+		}
+		request.Logger.Info("parent")
+		request.Reply(Map{})
+	})
+	service.CallWait("/parent", &Message{})
+
+	children := 0
+	for _, entry := range sink.Entries() {
+		switch entry.Message {
+		case "parent":
+			if entry.Field("path") != "/parent" {
+				t.Fatalf("Parent line got fields of a child request: %v", entry.Fields)
+			}
+		case "child":
+			if entry.Field("path") != "/child" {
+				t.Fatalf("Child line got wrong fields: %v", entry.Fields)
+			}
+			children++
+		}
+	}
+	if children != 5 {
+		t.Fatalf("Expected 5 child lines, got %d", children)
+	}
+}
@@ -0,0 +1,405 @@
+package nrv
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Struct tag used to name fields in a Map. A "-" name skips the field and the
+// "omitempty" option skips it when encoding a zero value.
+const MAP_TAG = "nrv"
+
+// Field of a struct that couldn't be decoded from a Map
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+// Error returned when decoding a Map, listing every field that couldn't be set
+type DecodeError struct {
+	Fields []FieldError
+}
+
+func (e *DecodeError) Error() string {
+	fields := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		fields[i] = fmt.Sprintf("%s: %s", field.Field, field.Reason)
+	}
+	return "Couldn't decode " + strings.Join(fields, ", ")
+}
+
+func (e *DecodeError) add(field string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+func (e *DecodeError) orNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Decodes the map into the struct pointed by dest. Nested maps are decoded into
+// structs and maps, arrays into slices and numbers or strings are converted to the
+// field's type. Fields are matched by their "nrv" tag, their name or their lower
+// cased name. Decoding is best effort: every field that can be set is set and a
+// *DecodeError lists the others.
+func (m Map) Into(dest interface{}) error {
+	rflDest := reflect.ValueOf(dest)
+	if rflDest.Kind() != reflect.Ptr || rflDest.IsNil() || rflDest.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Can only decode a map into a pointer to a struct, got %T", dest)
+	}
+
+	errs := &DecodeError{}
+	decodeStruct("", m, rflDest.Elem(), errs)
+	return errs.orNil()
+}
+
+// Appends the decoded values of the array to the slice pointed by slicePtr, the
+// structure giving the type of its elements
+func (a Array) IntoStructSlice(slicePtr interface{}, structure interface{}) error {
+	rflSlice := reflect.ValueOf(slicePtr).Elem()
+	structType := reflect.TypeOf(structure)
+
+	errs := &DecodeError{}
+	for i, val := range a {
+		newElm := reflect.New(structType).Elem()
+		decodeValue(fmt.Sprintf("[%d]", i), val, newElm, errs)
+		rflSlice.Set(reflect.Append(rflSlice, newElm))
+	}
+	return errs.orNil()
+}
+
+// Creates a map from the exported fields of a struct, or a pointer to one, using
+// the same keys as Into. Nested structs and maps are encoded as maps and slices as
+// arrays.
+func NewMapFromStruct(obj interface{}) (Map, error) {
+	m := NewMap()
+	if err := m.From(obj); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Sets the exported fields of a struct, or a pointer to one, in the map
+func (m Map) From(obj interface{}) error {
+	rflObj := reflect.ValueOf(obj)
+	for rflObj.Kind() == reflect.Ptr && !rflObj.IsNil() {
+		rflObj = rflObj.Elem()
+	}
+	if rflObj.Kind() != reflect.Struct {
+		return fmt.Errorf("Can only encode a struct into a map, got %T", obj)
+	}
+
+	encodeStruct(rflObj, m)
+	return nil
+}
+
+func encodeStruct(val reflect.Value, m Map) {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		structField := typ.Field(i)
+		key := fieldKey(structField)
+		if key == "" {
+			continue
+		}
+
+		fieldVal := val.Field(i)
+		if hasTagOption(structField, "omitempty") && fieldVal.IsZero() {
+			continue
+		}
+		m[key] = encodeValue(fieldVal)
+	}
+}
+
+// Encodes a value as it would be found in a map. Structs without exported fields
+// (ex: time.Time) are kept as is.
+func encodeValue(val reflect.Value) interface{} {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return nil
+		}
+		return encodeValue(val.Elem())
+
+	case reflect.Struct:
+		if !hasExportedField(val.Type()) {
+			return val.Interface()
+		}
+		m := NewMap()
+		encodeStruct(val, m)
+		return m
+
+	case reflect.Map:
+		if val.Type().Key().Kind() != reflect.String {
+			return val.Interface()
+		}
+		m := NewMap()
+		iter := val.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = encodeValue(iter.Value())
+		}
+		return m
+
+	case reflect.Slice, reflect.Array:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return val.Interface()
+		}
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			return nil
+		}
+		ar := NewArraySize(val.Len())
+		for i := range ar {
+			ar[i] = encodeValue(val.Index(i))
+		}
+		return ar
+	}
+
+	return val.Interface()
+}
+
+func hasExportedField(typ reflect.Type) bool {
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).PkgPath == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTagOption(field reflect.StructField, option string) bool {
+	for _, opt := range strings.Split(field.Tag.Get(MAP_TAG), ",")[1:] {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key of a struct field in a map, or "" if it must be skipped
+func fieldKey(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+
+	tag := strings.Split(field.Tag.Get(MAP_TAG), ",")[0]
+	if tag == "-" {
+		return ""
+	} else if tag != "" {
+		return tag
+	}
+	return field.Name
+}
+
+func joinField(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func decodeStruct(path string, m Map, dest reflect.Value, errs *DecodeError) {
+	destTyp := dest.Type()
+	for i := 0; i < destTyp.NumField(); i++ {
+		structField := destTyp.Field(i)
+		key := fieldKey(structField)
+		if key == "" {
+			continue
+		}
+
+		val, found := m[key]
+		if !found && structField.Tag.Get(MAP_TAG) == "" {
+			key = strings.ToLower(key)
+			val, found = m[key]
+		}
+		if found {
+			decodeValue(joinField(path, key), val, dest.Field(i), errs)
+		}
+	}
+}
+
+// Decodes a value into dest, converting it if needed
+func decodeValue(path string, val interface{}, dest reflect.Value, errs *DecodeError) {
+	if val == nil {
+		return
+	}
+
+	rflVal := reflect.ValueOf(val)
+	if rflVal.Type().AssignableTo(dest.Type()) {
+		dest.Set(rflVal)
+		return
+	}
+
+	// values from HTTP forms are lists of strings, take the first one for scalars
+	if strs, ok := val.([]string); ok && dest.Kind() != reflect.Slice && dest.Kind() != reflect.Array {
+		if len(strs) == 0 {
+			return
+		}
+		decodeValue(path, strs[0], dest, errs)
+		return
+	}
+
+	switch dest.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(dest.Type().Elem())
+		decodeValue(path, val, elem.Elem(), errs)
+		dest.Set(elem)
+
+	case reflect.Struct:
+		if mp, ok := toMap(val); ok {
+			decodeStruct(path, mp, dest, errs)
+		} else {
+			errs.add(path, "expected a map, got %T", val)
+		}
+
+	case reflect.Map:
+		mp, ok := toMap(val)
+		if !ok || dest.Type().Key().Kind() != reflect.String {
+			errs.add(path, "can't decode %T into %s", val, dest.Type())
+			return
+		}
+		newMap := reflect.MakeMapWithSize(dest.Type(), len(mp))
+		for k, v := range mp {
+			elem := reflect.New(dest.Type().Elem()).Elem()
+			decodeValue(joinField(path, k), v, elem, errs)
+			newMap.SetMapIndex(reflect.ValueOf(k).Convert(dest.Type().Key()), elem)
+		}
+		dest.Set(newMap)
+
+	case reflect.Slice:
+		if rflVal.Kind() != reflect.Slice && rflVal.Kind() != reflect.Array {
+			errs.add(path, "expected a list, got %T", val)
+			return
+		}
+		newSlice := reflect.MakeSlice(dest.Type(), rflVal.Len(), rflVal.Len())
+		for i := 0; i < rflVal.Len(); i++ {
+			decodeValue(fmt.Sprintf("%s[%d]", path, i), rflVal.Index(i).Interface(), newSlice.Index(i), errs)
+		}
+		dest.Set(newSlice)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, err := toInt(val)
+		if err != nil {
+			errs.add(path, "%s", err)
+		} else if dest.OverflowInt(num) {
+			errs.add(path, "%v doesn't fit in %s", val, dest.Type())
+		} else {
+			dest.SetInt(num)
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if kind := rflVal.Kind(); kind >= reflect.Uint && kind <= reflect.Uint64 {
+			if dest.OverflowUint(rflVal.Uint()) {
+				errs.add(path, "%v doesn't fit in %s", val, dest.Type())
+			} else {
+				dest.SetUint(rflVal.Uint())
+			}
+			return
+		}
+
+		num, err := toInt(val)
+		if err != nil {
+			errs.add(path, "%s", err)
+		} else if num < 0 || dest.OverflowUint(uint64(num)) {
+			errs.add(path, "%v doesn't fit in %s", val, dest.Type())
+		} else {
+			dest.SetUint(uint64(num))
+		}
+
+	case reflect.Float32, reflect.Float64:
+		num, err := toFloat(val)
+		if err != nil {
+			errs.add(path, "%s", err)
+		} else {
+			dest.SetFloat(num)
+		}
+
+	case reflect.Bool:
+		if str, ok := val.(string); ok {
+			b, err := strconv.ParseBool(str)
+			if err != nil {
+				errs.add(path, "invalid boolean %q", str)
+				return
+			}
+			dest.SetBool(b)
+		} else {
+			errs.add(path, "expected a boolean, got %T", val)
+		}
+
+	case reflect.String:
+		switch rflVal.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+			dest.SetString(fmt.Sprint(val))
+		default:
+			errs.add(path, "expected a string, got %T", val)
+		}
+
+	default:
+		if rflVal.Type().ConvertibleTo(dest.Type()) {
+			dest.Set(rflVal.Convert(dest.Type()))
+		} else {
+			errs.add(path, "can't decode %T into %s", val, dest.Type())
+		}
+	}
+}
+
+func toMap(val interface{}) (Map, bool) {
+	switch mp := val.(type) {
+	case Map:
+		return mp, true
+	case map[string]interface{}:
+		return Map(mp), true
+	}
+	return nil, false
+}
+
+// Converts an integral number or a string to an int
+func toInt(val interface{}) (int64, error) {
+	rflVal := reflect.ValueOf(val)
+	switch rflVal.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rflVal.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rflVal.Uint() > math.MaxInt64 {
+			return 0, fmt.Errorf("%v is too large", val)
+		}
+		return int64(rflVal.Uint()), nil
+	case reflect.String:
+		if num, err := strconv.ParseInt(rflVal.String(), 10, 64); err == nil {
+			return num, nil
+		}
+	}
+
+	num, err := toFloat(val)
+	if err != nil {
+		return 0, err
+	} else if num != math.Trunc(num) || num < math.MinInt64 || num >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v is not an integer", val)
+	}
+	return int64(num), nil
+}
+
+// Converts a number or a string to a float
+func toFloat(val interface{}) (float64, error) {
+	rflVal := reflect.ValueOf(val)
+	switch rflVal.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rflVal.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rflVal.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rflVal.Float(), nil
+	case reflect.String:
+		num, err := strconv.ParseFloat(rflVal.String(), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", rflVal.String())
+		}
+		return num, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %T", val)
+}
@@ -1,9 +1,11 @@
 package nrv
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"reflect"
-	"strings"
+	"sync"
+	"time"
 )
 
 type RequestBuilder interface {
@@ -14,8 +16,14 @@ type Request struct {
 	*Message
 	Binding *Binding
 
-	// used by logging to trace sent request 	
-	sendTrace loggerTrace
+	// used by logging to trace sent request, ended on first reply
+	sendTrace     loggerTrace
+	sendTraceOnce sync.Once
+
+	// distributed tracing span of this request, and parent span if sent while
+	// handling another request
+	span       *Span
+	parentSpan *Span
 
 	// Response variables
 	InitRequest *ReceivedRequest
@@ -25,6 +33,10 @@ type Request struct {
 	chanWait     chan *ReceivedRequest
 	respReceived int
 	respNeeded   int
+
+	// set by the request/reply pattern to stop waiting for replies, replying
+	// instead with the given reply
+	abandon func(reply *ReceivedRequest)
 }
 
 func (r *Request) handleReply(request *ReceivedRequest) {
@@ -57,34 +69,122 @@ type ReceivedRequest struct {
 
 	InitRequest *Request
 
-	OnReply func(msg *Message)
+	OnReply   func(msg *Message)
+	WaitReply bool
+
+	// refused by the binding's receive limiter, replied busy instead of handled
+	shed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	span   *Span
 }
 
-func (rq *ReceivedRequest) Reply(data Map) {
-	rq.ReplyMessage(&Message{Data: data})
+// Returns the context in which the request is handled
+func (rq *ReceivedRequest) Context() context.Context {
+	if rq.ctx == nil {
+		return context.Background()
+	}
+	return rq.ctx
 }
 
-func (rq *ReceivedRequest) ReplyMessage(msg *Message) {
-	if rq.OnReply != nil {
-		rq.OnReply(msg)
-	} else {
-		Log.Fatal("No 'OnReply' callback associated to received request")
+// Sets the context in which the request is handled, done once the sender stops
+// waiting for a reply, once replied or when stopping is done
+func (rq *ReceivedRequest) initContext(stopping context.Context) {
+	ctx, cancel := context.WithCancel(rq.Context())
+	cancelTimeout := context.CancelFunc(func() {})
+	if rq.Message.Timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(ctx, time.Duration(rq.Message.Timeout)*time.Millisecond)
+	}
+	stop := context.AfterFunc(stopping, cancel)
+
+	rq.ctx = ctx
+	rq.cancel = func() {
+		stop()
+		cancelTimeout()
+		cancel()
 	}
 }
 
+// Ends the context of the request
+func (rq *ReceivedRequest) done() {
+	if rq.cancel != nil {
+		rq.cancel()
+	}
+}
+
+// Returns true if the sender waits for a reply, either through a rendez-vous or
+// directly on the protocol (ex: HTTP)
+func (rq *ReceivedRequest) NeedReply() bool {
+	return rq.WaitReply || rq.Message.SourceRdv > 0
+}
+
+// Creates a new request whose trace span will be a child of this request's span
+func (rq *ReceivedRequest) ChildRequest(data Map) *Request {
+	return &Request{
+		Message: &Message{
+			Logger: rq.Logger,
+			Data:   data,
+		},
+		parentSpan: rq.span,
+	}
+}
+
+func (rq *ReceivedRequest) Span() *Span {
+	return rq.span
+}
+
+func (rq *ReceivedRequest) Reply(data Map) error {
+	return rq.ReplyMessage(&Message{Data: data})
+}
+
+// Replies with the fields of a struct as data, see NewMapFromStruct
+func (rq *ReceivedRequest) ReplyStruct(obj interface{}) error {
+	data, err := NewMapFromStruct(obj)
+	if err != nil {
+		return err
+	}
+	return rq.Reply(data)
+}
+
+func (rq *ReceivedRequest) ReplyMessage(msg *Message) error {
+	if rq.OnReply == nil {
+		return errors.New("No 'OnReply' callback associated to received request")
+	}
+
+	rq.OnReply(msg)
+	rq.done()
+	return nil
+}
+
 type Message struct {
 	Logger
 
 	ServiceName string
 	Path        string
 
+	// HTTP method of the request, one of the sending binding's methods. Replies
+	// have the method and path of their request so that they get back to the
+	// binding that sent it.
+	Method string
+
 	Destination    *ServiceMembers
 	DestinationRdv uint32
 	Source         *ServiceMembers
 	SourceRdv      uint32
 
+	// distributed tracing ids, SpanId being the span of the sender
+	TraceId uint64
+	SpanId  uint64
+
+	// milliseconds the sender waits for a reply, 0 if it doesn't time out
+	Timeout uint32
+
 	Data  Map
 	Error Error
+
+	// codec the message was received with, used to encode its reply
+	codec Codec
 }
 
 func (m *Message) IsDestinationEmpty() bool {
@@ -113,38 +213,6 @@ func (m Map) Merge(other Map) {
 	}
 }
 
-// TODO: return error if any error, but continue (best effort)
-func (m Map) Into(dest interface{}) {
-	rflDestPtr := reflect.ValueOf(dest)
-
-	// get pointed
-	rflDest := rflDestPtr.Elem()
-	destTyp := rflDest.Type()
-
-	for i := 0; i < destTyp.NumField(); i++ {
-		structField := destTyp.Field(i)
-		fieldVal := rflDest.Field(i)
-
-		if fieldVal.CanSet() {
-			// TODO: support for recursive structures
-
-			if val, found := m[structField.Name]; found {
-				rflVal := reflect.ValueOf(val)
-				if structField.Type.AssignableTo(rflVal.Type()) {
-					fieldVal.Set(rflVal)
-				}
-
-			} else if val, found := m[strings.ToLower(structField.Name)]; found {
-				rflVal := reflect.ValueOf(val)
-				if structField.Type.AssignableTo(rflVal.Type()) {
-					fieldVal.Set(rflVal)
-				}
-			}
-		}
-
-	}
-}
-
 type Array []interface{}
 
 func NewArray(vals ...interface{}) Array {
@@ -154,32 +222,3 @@ func NewArray(vals ...interface{}) Array {
 func NewArraySize(size int) Array {
 	return Array(make([]interface{}, size))
 }
-
-func (a Array) IntoStructSlice(slicePtr interface{}, structure interface{}) {
-	rflStruct := reflect.ValueOf(structure)
-	rflSlicePtr := reflect.ValueOf(slicePtr)
-	rflSlice := rflSlicePtr.Elem()
-
-	structType := rflStruct.Type()
-	structIsPtr := false
-	if rflStruct.Kind() == reflect.Ptr {
-		structIsPtr = true
-		structType = rflStruct.Elem().Type()
-	}
-
-	for _, val := range a {
-		newElm := reflect.New(structType)
-
-		if mapVal, ok := val.(Map); ok {
-			mapVal.Into(newElm.Interface())
-
-			if !structIsPtr {
-				newElm = newElm.Elem()
-			}
-		} else {
-			newElm.Set(reflect.ValueOf(val))
-		}
-
-		rflSlice.Set(reflect.Append(rflSlice, newElm))
-	}
-}
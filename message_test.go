@@ -18,7 +18,7 @@ func TestMapInto(t *testing.T) {
 	ts := &tStruct{}
 	m.Into(ts)
 
-	fmt.Printf("%s", ts)
+	fmt.Printf("%v", ts)
 	if ts.A != 23 {
 		t.Fail()
 	}
@@ -28,5 +28,162 @@ func TestMapInto(t *testing.T) {
 
 	// shouldn't panic
 	m["a"] = "toto"
-	m.Into(ts)
+	if err := m.Into(ts); err == nil {
+		t.Fatalf("Decoding a string into an int should return an error")
+	}
+}
+
+type tAddress struct {
+	City string `nrv:"city"`
+	Zip  int
+}
+
+type tPerson struct {
+	Name     string
+	Age      uint8
+	Score    float64
+	Admin    bool
+	Address  tAddress
+	Previous []*tAddress
+	Tags     []string
+	Counts   map[string]int
+	Ignored  string `nrv:"-"`
+}
+
+func TestMapIntoRecursive(t *testing.T) {
+	m := Map{
+		"name":    []string{"bob"},
+		"age":     int64(42),
+		"score":   "3.5",
+		"admin":   "true",
+		"Ignored": "value",
+		"address": Map{"city": "Montreal", "zip": "123"},
+		"previous": Array{
+			Map{"city": "Paris", "Zip": 75},
+		},
+		"tags":   []interface{}{"a", "b"},
+		"counts": Map{"x": 1.0, "y": "2"},
+	}
+
+	p := &tPerson{}
+	if err := m.Into(p); err != nil {
+		t.Fatalf("Couldn't decode map: %s", err)
+	}
+
+	if p.Name != "bob" || p.Age != 42 || p.Score != 3.5 || !p.Admin || p.Ignored != "" {
+		t.Fatalf("Scalar fields weren't decoded: %+v", p)
+	}
+	if p.Address.City != "Montreal" || p.Address.Zip != 123 {
+		t.Fatalf("Nested struct wasn't decoded: %+v", p.Address)
+	}
+	if len(p.Previous) != 1 || p.Previous[0].City != "Paris" || p.Previous[0].Zip != 75 {
+		t.Fatalf("Slice of structs wasn't decoded: %+v", p.Previous)
+	}
+	if len(p.Tags) != 2 || p.Tags[1] != "b" {
+		t.Fatalf("Slice wasn't decoded: %+v", p.Tags)
+	}
+	if p.Counts["x"] != 1 || p.Counts["y"] != 2 {
+		t.Fatalf("Map wasn't decoded: %+v", p.Counts)
+	}
+}
+
+func TestMapIntoErrors(t *testing.T) {
+	m := Map{
+		"name":    "bob",
+		"age":     300,
+		"score":   "high",
+		"address": Map{"city": 12, "zip": 1.5},
+	}
+
+	p := &tPerson{}
+	err := m.Into(p)
+	decodeErr, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("Expected a decode error, got %v", err)
+	}
+
+	fields := make(map[string]bool)
+	for _, field := range decodeErr.Fields {
+		fields[field.Field] = true
+	}
+	if len(fields) != 3 || !fields["age"] || !fields["score"] || !fields["address.zip"] {
+		t.Fatalf("Expected errors on age, score and address.zip, got %s", err)
+	}
+
+	// decoding is best effort
+	if p.Name != "bob" || p.Address.City != "12" {
+		t.Fatalf("Valid fields should still be decoded: %+v", p)
+	}
+}
+
+func TestArrayIntoStructSlice(t *testing.T) {
+	a := NewArray(Map{"a": 1, "b": "x"}, Map{"a": "2"})
+
+	var structs []tStruct
+	if err := a.IntoStructSlice(&structs, tStruct{}); err != nil {
+		t.Fatalf("Couldn't decode array: %s", err)
+	}
+	if len(structs) != 2 || structs[0].B != "x" || structs[1].A != 2 {
+		t.Fatalf("Array wasn't decoded: %+v", structs)
+	}
+
+	var ptrs []*tStruct
+	if err := NewArray(Map{"a": "z"}).IntoStructSlice(&ptrs, &tStruct{}); err == nil {
+		t.Fatalf("Decoding an invalid element should return an error")
+	}
+}
+
+type tEncoded struct {
+	Name     string
+	Address  *tAddress
+	Previous []tAddress
+	Counts   map[string]int
+	Note     string `nrv:"note,omitempty"`
+	Ignored  string `nrv:"-"`
+	private  string
+}
+
+func TestMapFromStruct(t *testing.T) {
+	obj := &tEncoded{
+		Name:     "bob",
+		Address:  &tAddress{"Montreal", 123},
+		Previous: []tAddress{{"Paris", 75}},
+		Counts:   map[string]int{"x": 1},
+		Ignored:  "ignored",
+		private:  "private",
+	}
+
+	m, err := NewMapFromStruct(obj)
+	if err != nil {
+		t.Fatalf("Couldn't encode struct: %s", err)
+	}
+
+	if m["Name"] != "bob" || m["Address"].(Map)["city"] != "Montreal" || m["Counts"].(Map)["x"] != 1 {
+		t.Fatalf("Struct wasn't encoded: %v", m)
+	}
+	if ar, ok := m["Previous"].(Array); !ok || ar[0].(Map)["Zip"] != 75 {
+		t.Fatalf("Slice wasn't encoded as an array: %v", m["Previous"])
+	}
+	for _, key := range []string{"note", "Ignored", "private"} {
+		if _, found := m[key]; found {
+			t.Fatalf("Field %s shouldn't be encoded: %v", key, m)
+		}
+	}
+
+	decoded := &tEncoded{}
+	if err := m.Into(decoded); err != nil {
+		t.Fatalf("Couldn't decode encoded struct: %s", err)
+	}
+	if decoded.Address.Zip != 123 || decoded.Previous[0].City != "Paris" || decoded.Counts["x"] != 1 {
+		t.Fatalf("Struct didn't survive a round trip: %+v", decoded)
+	}
+
+	obj.Note = "note"
+	if m, _ := NewMapFromStruct(obj); m["note"] != "note" {
+		t.Fatalf("Non empty field should be encoded: %v", m)
+	}
+
+	if _, err := NewMapFromStruct("string"); err == nil {
+		t.Fatalf("Encoding a non struct should return an error")
+	}
 }
@@ -0,0 +1,433 @@
+package nrv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	Metrics *MetricsRegistry = NewMetricsRegistry()
+
+	// Default latency buckets, in seconds
+	DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+const (
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4"
+)
+
+// Labels of a metric, ex: service, binding
+type Labels map[string]string
+
+func (l Labels) key() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := ""
+	for i, name := range names {
+		if i > 0 {
+			ret += ","
+		}
+		ret += name + "=" + strconv.Quote(l[name])
+	}
+	return ret
+}
+
+func (l Labels) with(name, value string) Labels {
+	ret := make(Labels, len(l)+1)
+	for k, v := range l {
+		ret[k] = v
+	}
+	ret[name] = value
+	return ret
+}
+
+// Registry of all metrics of a process, exportable in Prometheus text format
+type MetricsRegistry struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	metrics map[string]interface{}
+	labels  map[string]Labels
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (r *MetricsRegistry) get(name, help, typ string, labels Labels, create func() interface{}) interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	family, found := r.families[name]
+	if !found {
+		family = &metricFamily{
+			name:    name,
+			help:    help,
+			typ:     typ,
+			metrics: make(map[string]interface{}),
+			labels:  make(map[string]Labels),
+		}
+		r.families[name] = family
+	} else if family.typ != typ {
+		panic(fmt.Sprintf("Metric %s already registered as a %s", name, family.typ))
+	}
+
+	key := labels.key()
+	metric, found := family.metrics[key]
+	if !found {
+		metric = create()
+		family.metrics[key] = metric
+		family.labels[key] = labels
+	}
+	return metric
+}
+
+// Returns the counter with the given name and labels, creating it if needed
+func (r *MetricsRegistry) Counter(name, help string, labels Labels) *Counter {
+	return r.get(name, help, "counter", labels, func() interface{} {
+		return &Counter{}
+	}).(*Counter)
+}
+
+// Returns the gauge with the given name and labels, creating it if needed
+func (r *MetricsRegistry) Gauge(name, help string, labels Labels) *Gauge {
+	return r.get(name, help, "gauge", labels, func() interface{} {
+		return &Gauge{}
+	}).(*Gauge)
+}
+
+// Returns the histogram with the given name and labels, creating it with the given
+// buckets if needed. Nil buckets use DefaultLatencyBuckets.
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64, labels Labels) *Histogram {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	return r.get(name, help, "histogram", labels, func() interface{} {
+		return newHistogram(buckets)
+	}).(*Histogram)
+}
+
+// Returns the metric with the given name and labels if it exists
+func (r *MetricsRegistry) Find(name string, labels Labels) interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if family, found := r.families[name]; found {
+		return family.metrics[labels.key()]
+	}
+	return nil
+}
+
+// Writes all metrics in Prometheus text exposition format
+func (r *MetricsRegistry) WritePrometheus(writer io.Writer) error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		family := r.families[name]
+		if family.help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", name, family.help)
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, family.typ)
+
+		keys := make([]string, 0, len(family.metrics))
+		for key := range family.metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			switch metric := family.metrics[key].(type) {
+			case *Counter:
+				fmt.Fprintf(buf, "%s%s %s\n", name, formatLabels(key), formatFloat(metric.Value()))
+			case *Gauge:
+				fmt.Fprintf(buf, "%s%s %s\n", name, formatLabels(key), formatFloat(metric.Value()))
+			case *Histogram:
+				labels := family.labels[key]
+				counts, count, sum := metric.snapshot()
+				for i, bound := range metric.buckets {
+					fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(labels.with("le", formatFloat(bound)).key()), counts[i])
+				}
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(labels.with("le", "+Inf").key()), count)
+				fmt.Fprintf(buf, "%s_sum%s %s\n", name, formatLabels(key), formatFloat(sum))
+				fmt.Fprintf(buf, "%s_count%s %d\n", name, formatLabels(key), count)
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+// Closure to bind on a service served by ProtocolHTTP to export metrics
+// ex: httpService.BindClosure("/metrics$", nrv.Metrics.HandleRequest)
+func (r *MetricsRegistry) HandleRequest(request *ReceivedRequest) {
+	buf := &bytes.Buffer{}
+	r.WritePrometheus(buf)
+	request.Reply(Map{
+		"content-type": METRICS_CONTENT_TYPE,
+		"body":         buf.String(),
+	})
+}
+
+func formatLabels(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "{" + key + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Monotonically increasing value
+type Counter struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(delta float64) {
+	c.mutex.Lock()
+	c.value += delta
+	c.mutex.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.value
+}
+
+// Value that can go up and down
+type Gauge struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(value float64) {
+	g.mutex.Lock()
+	g.value = value
+	g.mutex.Unlock()
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.mutex.Lock()
+	g.value += delta
+	g.mutex.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value
+}
+
+// Distribution of observed values in cumulative buckets
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	return &Histogram{
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+	h.mutex.Unlock()
+}
+
+func (h *Histogram) ObserveDuration(duration time.Duration) {
+	h.Observe(duration.Seconds())
+}
+
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+func (h *Histogram) Sum() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sum
+}
+
+// Estimates the value at the given quantile (0-1) by interpolating in buckets
+func (h *Histogram) Quantile(q float64) float64 {
+	counts, count, _ := h.snapshot()
+	if count == 0 || len(h.buckets) == 0 {
+		return math.NaN()
+	}
+
+	rank := q * float64(count)
+	var lowerBound float64 = 0
+	var lowerCount uint64 = 0
+	for i, bound := range h.buckets {
+		if float64(counts[i]) >= rank {
+			inBucket := counts[i] - lowerCount
+			if inBucket == 0 {
+				return bound
+			}
+			return lowerBound + (bound-lowerBound)*(rank-float64(lowerCount))/float64(inBucket)
+		}
+		lowerBound = bound
+		lowerCount = counts[i]
+	}
+
+	return h.buckets[len(h.buckets)-1]
+}
+
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	return counts, h.count, h.sum
+}
+
+// Records requests count, errors, in flight requests and latency of a binding, for
+// both sending and receiving side. Added by default in every binding's chain.
+type RequestMetrics struct {
+	BaseHandler
+	Registry *MetricsRegistry
+}
+
+func (rm *RequestMetrics) InitHandler(binding *Binding) {
+	rm.BaseHandler.InitHandler(binding)
+	if rm.Registry == nil {
+		rm.Registry = Metrics
+	}
+}
+
+func (rm *RequestMetrics) labels(side string) Labels {
+	return Labels{
+		"service": rm.binding.service.Name,
+		"binding": rm.binding.Path,
+		"side":    side,
+	}
+}
+
+func (rm *RequestMetrics) start(side string) func(reply *Message) {
+	labels := rm.labels(side)
+	rm.Registry.Counter("nrv_requests_total", "Number of requests", labels).Inc()
+	inFlight := rm.Registry.Gauge("nrv_requests_in_flight", "Number of requests waiting for a reply", labels)
+	inFlight.Inc()
+
+	start := time.Now()
+	var once sync.Once
+	return func(reply *Message) {
+		once.Do(func() {
+			inFlight.Dec()
+			rm.Registry.Histogram("nrv_request_duration_seconds", "Latency of requests", nil, labels).ObserveDuration(time.Now().Sub(start))
+		})
+
+		if reply != nil && !reply.Error.Empty() {
+			rm.Registry.Counter("nrv_request_errors_total", "Number of replies with an error, by error code", labels.with("code", strconv.Itoa(int(reply.Error.Code)))).Inc()
+		}
+	}
+}
+
+func (rm *RequestMetrics) HandleRequestSend(request *Request) *Request {
+	// replies are accounted on the receiving side of the initial request
+	if request.Message.DestinationRdv == 0 {
+		done := rm.start("send")
+
+		if request.NeedReply() {
+			onReply := request.OnReply
+			request.OnReply = func(reply *ReceivedRequest) {
+				done(reply.Message)
+				onReply(reply)
+			}
+		} else {
+			defer done(nil)
+		}
+	}
+
+	return rm.nextHandler.HandleRequestSend(request)
+}
+
+func (rm *RequestMetrics) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
+	// replies to our requests are accounted on the sending side
+	if request.InitRequest != nil {
+		return rm.previousHandler.HandleRequestReceive(request)
+	}
+
+	done := rm.start("receive")
+	if request.NeedReply() && request.OnReply != nil {
+		onReply := request.OnReply
+		request.OnReply = func(message *Message) {
+			done(message)
+			onReply(message)
+		}
+	} else {
+		defer done(nil)
+	}
+
+	return rm.previousHandler.HandleRequestReceive(request)
+}
+
+// Writes the metrics in a string, for debugging
+func (r *MetricsRegistry) String() string {
+	buf := &bytes.Buffer{}
+	r.WritePrometheus(buf)
+	return strings.TrimSpace(buf.String())
+}
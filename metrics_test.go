@@ -0,0 +1,61 @@
+package nrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsHistogramQuantile(t *testing.T) {
+	h := newHistogram([]float64{1, 2, 3, 4})
+	for i := 0; i < 100; i++ {
+		h.Observe(float64(i%4) + 0.5)
+	}
+
+	if h.Count() != 100 {
+		t.Fatalf("Wrong count: %d", h.Count())
+	}
+	if q := h.Quantile(0.5); q < 1.9 || q > 2.1 {
+		t.Fatalf("Wrong median: %f", q)
+	}
+}
+
+func TestMetricsRequests(t *testing.T) {
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("metrics")
+	service.Members.Add(ServiceMember{Token(0), node})
+	registry := NewMetricsRegistry()
+	service.Bind(&Binding{
+		Path:           "/fail",
+		RequestMetrics: &RequestMetrics{Registry: registry},
+		Closure: func(request *ReceivedRequest) {
+			request.ReplyMessage(&Message{Error: Error{"failed", 500}})
+		},
+	})
+
+	service.CallWait("/fail", &Message{})
+
+	for _, side := range []string{"send", "receive"} {
+		labels := Labels{"service": "metrics", "binding": "/fail", "side": side}
+		if registry.Counter("nrv_requests_total", "", labels).Value() != 1 {
+			t.Fatalf("Request wasn't counted on %s side", side)
+		}
+		if registry.Gauge("nrv_requests_in_flight", "", labels).Value() != 0 {
+			t.Fatalf("Request still in flight on %s side", side)
+		}
+		if registry.Histogram("nrv_request_duration_seconds", "", nil, labels).Count() != 1 {
+			t.Fatalf("Latency wasn't recorded on %s side", side)
+		}
+		if registry.Counter("nrv_request_errors_total", "", labels.with("code", "500")).Value() != 1 {
+			t.Fatalf("Error wasn't counted on %s side", side)
+		}
+	}
+
+	out := registry.String()
+	if !strings.Contains(out, `nrv_requests_total{binding="/fail",service="metrics",side="send"} 1`) {
+		t.Fatalf("Missing counter in prometheus output: %s", out)
+	}
+	if !strings.Contains(out, `nrv_request_duration_seconds_bucket{binding="/fail",le="+Inf",service="metrics",side="receive"} 1`) {
+		t.Fatalf("Missing histogram in prometheus output: %s", out)
+	}
+}
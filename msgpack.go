@@ -0,0 +1,320 @@
+package nrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Minimal MessagePack encoding of the values found in messages: nil, booleans,
+// numbers, strings, binaries, arrays and maps with string keys. Extension types
+// are not supported.
+
+// Writes a value, structs and slices being encoded as maps and arrays first
+func writeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch val := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if val {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		writeMsgpackInt(buf, int64(val))
+	case int8:
+		writeMsgpackInt(buf, int64(val))
+	case int16:
+		writeMsgpackInt(buf, int64(val))
+	case int32:
+		writeMsgpackInt(buf, int64(val))
+	case int64:
+		writeMsgpackInt(buf, val)
+	case uint:
+		writeMsgpackUint(buf, uint64(val))
+	case uint8:
+		writeMsgpackUint(buf, uint64(val))
+	case uint16:
+		writeMsgpackUint(buf, uint64(val))
+	case uint32:
+		writeMsgpackUint(buf, uint64(val))
+	case uint64:
+		writeMsgpackUint(buf, val)
+	case float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(val))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(val))
+	case string:
+		writeMsgpackHeader(buf, len(val), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(val)
+	case []byte:
+		writeMsgpackHeader(buf, len(val), 0, -1, 0xc4, 0xc5, 0xc6)
+		buf.Write(val)
+	case Array:
+		writeMsgpackHeader(buf, len(val), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, v := range val {
+			if err := writeMsgpack(buf, v); err != nil {
+				return err
+			}
+		}
+	case Map:
+		writeMsgpackHeader(buf, len(val), 0x80, 15, 0, 0xde, 0xdf)
+		for k, v := range val {
+			writeMsgpack(buf, k)
+			if err := writeMsgpack(buf, v); err != nil {
+				return err
+			}
+		}
+	default:
+		encoded := encodeValue(reflect.ValueOf(value))
+		switch encoded.(type) {
+		case Map, Array:
+			return writeMsgpack(buf, encoded)
+		}
+
+		rflVal := reflect.ValueOf(value)
+		switch rflVal.Kind() {
+		case reflect.String:
+			return writeMsgpack(buf, rflVal.String())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return writeMsgpack(buf, rflVal.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return writeMsgpack(buf, rflVal.Uint())
+		case reflect.Float32, reflect.Float64:
+			return writeMsgpack(buf, rflVal.Float())
+		case reflect.Bool:
+			return writeMsgpack(buf, rflVal.Bool())
+		}
+		return fmt.Errorf("Can't encode %T in MessagePack", value)
+	}
+	return nil
+}
+
+// Writes the header of a string, binary, array or map of the given length. The fix
+// format is used up to fixMax, and 8, 16 or 32 bits lengths after that (a 0 format
+// meaning that it doesn't exist).
+func writeMsgpackHeader(buf *bytes.Buffer, length int, fix byte, fixMax int, f8, f16, f32 byte) {
+	switch {
+	case length <= fixMax:
+		buf.WriteByte(fix | byte(length))
+	case f8 != 0 && length <= math.MaxUint8:
+		buf.WriteByte(f8)
+		buf.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buf.WriteByte(f16)
+		binary.Write(buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(f32)
+		binary.Write(buf, binary.BigEndian, uint32(length))
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, val int64) {
+	switch {
+	case val >= 0:
+		writeMsgpackUint(buf, uint64(val))
+	case val >= -32:
+		buf.WriteByte(byte(val))
+	case val >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(val))
+	case val >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(val))
+	case val >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(val))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, val)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, val uint64) {
+	switch {
+	case val <= 0x7f:
+		buf.WriteByte(byte(val))
+	case val <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(val))
+	case val <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(val))
+	case val <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(val))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, val)
+	}
+}
+
+// Reads a value. Integers are returned as int64, or uint64 if they don't fit, maps
+// as Map and arrays as Array.
+func readMsgpack(reader *bytes.Reader) (interface{}, error) {
+	format, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case format <= 0x7f:
+		return int64(format), nil
+	case format >= 0xe0:
+		return int64(int8(format)), nil
+	case format&0xf0 == 0x80:
+		return readMsgpackMap(reader, int(format&0x0f))
+	case format&0xf0 == 0x90:
+		return readMsgpackArray(reader, int(format&0x0f))
+	case format&0xe0 == 0xa0:
+		return readMsgpackString(reader, int(format&0x1f))
+	}
+
+	switch format {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		length, err := readMsgpackLength(reader, format-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(reader, length)
+	case 0xca:
+		var bits uint32
+		err := binary.Read(reader, binary.BigEndian, &bits)
+		return float64(math.Float32frombits(bits)), err
+	case 0xcb:
+		var bits uint64
+		err := binary.Read(reader, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		val, err := readMsgpackUint(reader, format-0xcc)
+		if err != nil || val > math.MaxInt64 {
+			return val, err
+		}
+		return int64(val), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return readMsgpackInt(reader, format-0xd0)
+	case 0xd9, 0xda, 0xdb:
+		length, err := readMsgpackLength(reader, format-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(reader, length)
+	case 0xdc, 0xdd:
+		length, err := readMsgpackLength(reader, format-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(reader, length)
+	case 0xde, 0xdf:
+		length, err := readMsgpackLength(reader, format-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(reader, length)
+	}
+
+	return nil, fmt.Errorf("Unsupported MessagePack format 0x%x", format)
+}
+
+// Reads an unsigned integer of 1, 2, 4 or 8 bytes given as size 0, 1, 2 or 3
+func readMsgpackUint(reader io.Reader, size byte) (uint64, error) {
+	data := make([]byte, 1<<size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, err
+	}
+
+	var val uint64
+	for _, b := range data {
+		val = val<<8 | uint64(b)
+	}
+	return val, nil
+}
+
+func readMsgpackInt(reader io.Reader, size byte) (int64, error) {
+	val, err := readMsgpackUint(reader, size)
+	if err != nil {
+		return 0, err
+	}
+
+	// sign extend
+	shift := 64 - 8*(uint(1)<<size)
+	return int64(val<<shift) >> shift, nil
+}
+
+func readMsgpackLength(reader io.Reader, size byte) (int, error) {
+	length, err := readMsgpackUint(reader, size)
+	if err != nil {
+		return 0, err
+	}
+	if length > MAX_FRAME_SIZE {
+		return 0, fmt.Errorf("Length %d is over maximum frame size", length)
+	}
+	return int(length), nil
+}
+
+func readMsgpackBytes(reader *bytes.Reader, length int) ([]byte, error) {
+	if length > reader.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return data, err
+}
+
+func readMsgpackString(reader *bytes.Reader, length int) (string, error) {
+	data, err := readMsgpackBytes(reader, length)
+	return string(data), err
+}
+
+func readMsgpackArray(reader *bytes.Reader, length int) (Array, error) {
+	if length > reader.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	ar := NewArraySize(length)
+	for i := range ar {
+		val, err := readMsgpack(reader)
+		if err != nil {
+			return nil, err
+		}
+		ar[i] = val
+	}
+	return ar, nil
+}
+
+func readMsgpackMap(reader *bytes.Reader, length int) (Map, error) {
+	if length > reader.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	mp := NewMap()
+	for i := 0; i < length; i++ {
+		key, err := readMsgpack(reader)
+		if err != nil {
+			return nil, err
+		}
+		strKey, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("Map keys must be strings, got %T", key)
+		}
+
+		val, err := readMsgpack(reader)
+		if err != nil {
+			return nil, err
+		}
+		mp[strKey] = val
+	}
+	return mp, nil
+}
@@ -9,6 +9,21 @@ var (
 	Log Logger = NewLogger(0)
 )
 
+// Error codes used by nrv, based on HTTP status codes
+const (
+	ERROR_BAD_REQUEST     = 400
+	ERROR_NOT_FOUND       = 404
+	ERROR_BUSY            = 429
+	ERROR_CANCELLED       = 499 // caller stopped waiting, as some HTTP servers use it
+	ERROR_INTERNAL        = 500
+	ERROR_NOT_IMPLEMENTED = 501
+	ERROR_UNAVAILABLE     = 503
+	ERROR_TIMEOUT         = 504
+
+	// not an HTTP status, returned without sending when a circuit breaker is open
+	ERROR_CIRCUIT_OPEN = 520
+)
+
 // Error with an error code
 type Error struct {
 	Message string
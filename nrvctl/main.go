@@ -0,0 +1,293 @@
+// Command line client to call and inspect services of an nrv cluster.
+//
+//	nrvctl [flags] call <service> <path> [json | key=value ...]
+//	nrvctl [flags] services
+//	nrvctl [flags] bindings <service>
+//	nrvctl [flags] members <service>
+//
+// nrvctl joins the cluster as a client node listening on -local so that replies
+// can reach it, and sends its requests to the node given by -node.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appaquet/nrv-go"
+)
+
+var (
+	localFlag   = flag.String("local", "127.0.0.1:12900:12900", "address:tcp_port:udp_port this client listens on for replies")
+	nodeFlag    = flag.String("node", "127.0.0.1:12345:12345", "address:tcp_port:udp_port of the node to send requests to")
+	timeoutFlag = flag.Duration("timeout", 5*time.Second, "time to wait for a reply")
+	traceFlag   = flag.Bool("trace", false, "print the request's trace")
+	codecFlag   = flag.String("codec", "gob", "codec used to encode requests: gob, json or msgpack")
+)
+
+var codecs = map[string]nrv.Codec{
+	"gob":     nrv.GobCodec{},
+	"json":    nrv.JSONCodec{},
+	"msgpack": nrv.MsgpackCodec{},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  nrvctl [flags] call <service> <path> [json | key=value ...]\n")
+	fmt.Fprintf(os.Stderr, "  nrvctl [flags] services\n")
+	fmt.Fprintf(os.Stderr, "  nrvctl [flags] bindings <service>\n")
+	fmt.Fprintf(os.Stderr, "  nrvctl [flags] members <service>\n\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(os.Stdout, os.Stderr, args[0], args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Runs a command, printing its result on out and the request's trace on traceOut.
+// The client's cluster is stopped before returning.
+func run(out, traceOut io.Writer, command string, args []string) error {
+	local, err := parseNode(*localFlag)
+	if err != nil {
+		return err
+	}
+	node, err := parseNode(*nodeFlag)
+	if err != nil {
+		return err
+	}
+
+	codec, found := codecs[*codecFlag]
+	if !found {
+		return fmt.Errorf("Unknown codec %s", *codecFlag)
+	}
+
+	nrv.Log.SetLevel(1)
+	cluster := nrv.NewStaticClusterWithProtocol(local, &nrv.ProtocolNrv{
+		LocalAddress: local.Address,
+		TCPPort:      local.TCPPort,
+		UDPPort:      local.UDPPort,
+		Codec:        codec,
+	})
+	if err := cluster.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+		defer cancel()
+		cluster.Stop(ctx)
+	}()
+
+	switch command {
+	case "call":
+		if len(args) < 2 {
+			return errors.New("call needs a service and a path")
+		}
+		return call(out, traceOut, cluster, node, args[0], args[1], args[2:])
+
+	case "services", "bindings", "members":
+		infos, err := fetchCatalog(cluster, node)
+		if err != nil {
+			return err
+		}
+		if command == "services" {
+			printServices(out, infos)
+			return nil
+		}
+
+		if len(args) < 1 {
+			return fmt.Errorf("%s needs a service", command)
+		}
+		for _, info := range infos {
+			if info.Name == args[0] {
+				if command == "bindings" {
+					printBindings(out, info)
+				} else {
+					printMembers(out, info)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("Service %s not found on %s", args[0], node)
+	}
+
+	usage()
+	return fmt.Errorf("Unknown command %s", command)
+}
+
+// Parses a node given as address:tcp_port:udp_port
+func parseNode(str string) (*nrv.Node, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid node %s, expected address:tcp_port:udp_port", str)
+	}
+
+	tcpPort, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TCP port in %s", str)
+	}
+	udpPort, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid UDP port in %s", str)
+	}
+	return &nrv.Node{Address: parts[0], TCPPort: tcpPort, UDPPort: udpPort}, nil
+}
+
+// Parses data given as a JSON object or as key=value pairs, values being parsed
+// as JSON if possible
+func parseData(args []string) (nrv.Map, error) {
+	if len(args) == 1 && strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(args[0]), &data); err != nil {
+			return nil, fmt.Errorf("Invalid JSON data: %s", err)
+		}
+		return fromJSON(data).(nrv.Map), nil
+	}
+
+	data := nrv.NewMap()
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid data %s, expected key=value", arg)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(parts[1]), &value); err == nil {
+			data[parts[0]] = fromJSON(value)
+		} else {
+			data[parts[0]] = parts[1]
+		}
+	}
+	return data, nil
+}
+
+// Converts decoded JSON to nrv maps and arrays so that they can be sent
+func fromJSON(value interface{}) interface{} {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		m := nrv.NewMap()
+		for k, v := range val {
+			m[k] = fromJSON(v)
+		}
+		return m
+	case []interface{}:
+		ar := nrv.NewArraySize(len(val))
+		for i, v := range val {
+			ar[i] = fromJSON(v)
+		}
+		return ar
+	}
+	return value
+}
+
+// Sends a request and waits for the reply. A binding matching any path is needed
+// on the client to send requests and receive their replies.
+func request(cluster *nrv.StaticCluster, node *nrv.Node, service, path string, data nrv.Map) (*nrv.ReceivedRequest, *nrv.Message, error) {
+	srv := cluster.GetService(service)
+	if binding, _ := srv.FindBinding(path); binding == nil {
+		if _, err := srv.BindClosure("(?:.*)", func(request *nrv.ReceivedRequest) {}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	message := &nrv.Message{
+		Destination: nrv.NewServiceMembers(nrv.ServiceMember{Token: nrv.Token(0), Node: node}),
+		Data:        data,
+	}
+	if *traceFlag {
+		message.Logger = nrv.NewRequestLogger(255)
+	}
+
+	select {
+	case resp := <-srv.CallChan(path, message):
+		return resp, message, nil
+	case <-time.After(*timeoutFlag):
+		return nil, message, fmt.Errorf("No reply from %s after %s", node, *timeoutFlag)
+	}
+}
+
+func call(out, traceOut io.Writer, cluster *nrv.StaticCluster, node *nrv.Node, service, path string, args []string) error {
+	data, err := parseData(args)
+	if err != nil {
+		return err
+	}
+
+	resp, message, err := request(cluster, node, service, path, data)
+	if *traceFlag && message.Logger != nil {
+		defer fmt.Fprintf(traceOut, "%s\n", message.Logger)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !resp.Error.Empty() {
+		return resp.Error
+	}
+
+	encoded, err := json.MarshalIndent(resp.Data, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(encoded))
+	return nil
+}
+
+func fetchCatalog(cluster *nrv.StaticCluster, node *nrv.Node) ([]nrv.ServiceInfo, error) {
+	type result struct {
+		infos []nrv.ServiceInfo
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		infos, err := nrv.FetchCatalog(cluster, node)
+		done <- result{infos, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.infos, res.err
+	case <-time.After(*timeoutFlag):
+		return nil, fmt.Errorf("No reply from %s after %s", node, *timeoutFlag)
+	}
+}
+
+func printServices(out io.Writer, infos []nrv.ServiceInfo) {
+	for _, info := range infos {
+		fmt.Fprintf(out, "%-20s protocol=%s bindings=%d members=%d\n", info.Name, info.Protocol, len(info.Bindings), len(info.Members))
+	}
+}
+
+func printBindings(out io.Writer, info nrv.ServiceInfo) {
+	for _, binding := range info.Bindings {
+		methods := "*"
+		if len(binding.Methods) > 0 {
+			methods = strings.Join(binding.Methods, ",")
+		}
+		fmt.Fprintf(out, "%-30s %-12s handler=%s pattern=%s resolver=%s protocol=%s\n", binding.Path, methods, binding.Handler, binding.Pattern, binding.Resolver, binding.Protocol)
+	}
+}
+
+func printMembers(out io.Writer, info nrv.ServiceInfo) {
+	for _, member := range info.Members {
+		fmt.Fprintf(out, "%-12d %s:%d:%d\n", member.Token, member.Address, member.TCPPort, member.UDPPort)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appaquet/nrv-go"
+)
+
+// Returns a node with TCP and UDP ports free at the time of the call
+func newLocalNode(t *testing.T) *nrv.Node {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't find a free TCP port: %s", err)
+	}
+	defer tcp.Close()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't find a free UDP port: %s", err)
+	}
+	defer udp.Close()
+
+	return &nrv.Node{Address: "127.0.0.1", TCPPort: tcp.Addr().(*net.TCPAddr).Port, UDPPort: udp.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func nodeFlagValue(node *nrv.Node) string {
+	return fmt.Sprintf("%s:%d:%d", node.Address, node.TCPPort, node.UDPPort)
+}
+
+// Sets a command line flag, restoring its value once the test is over
+func setFlag(t *testing.T, name, value string) {
+	previous := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("Couldn't set flag %s: %s", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, previous) })
+}
+
+func TestParseNode(t *testing.T) {
+	node, err := parseNode("10.0.0.1:1234:1235")
+	if err != nil || node.Address != "10.0.0.1" || node.TCPPort != 1234 || node.UDPPort != 1235 {
+		t.Fatalf("Couldn't parse node: %v %s", node, err)
+	}
+
+	for _, invalid := range []string{"10.0.0.1:1234", "10.0.0.1:a:1235", "10.0.0.1:1234:b"} {
+		if _, err := parseNode(invalid); err == nil {
+			t.Fatalf("Node %s should be invalid", invalid)
+		}
+	}
+}
+
+func TestParseData(t *testing.T) {
+	data, err := parseData([]string{`{"name": "nrv", "tags": ["a"]}`})
+	if err != nil || data["name"] != "nrv" || len(data["tags"].(nrv.Array)) != 1 {
+		t.Fatalf("Couldn't parse JSON data: %v %s", data, err)
+	}
+
+	data, err = parseData([]string{"id=12", "name=nrv", `user={"admin": true}`})
+	if err != nil || data["id"] != float64(12) || data["name"] != "nrv" || data["user"].(nrv.Map)["admin"] != true {
+		t.Fatalf("Couldn't parse key=value data: %v %s", data, err)
+	}
+
+	if _, err := parseData([]string{"name"}); err == nil {
+		t.Fatalf("Data without value should be invalid")
+	}
+	if _, err := parseData([]string{"{invalid"}); err == nil {
+		t.Fatalf("Invalid JSON data should be invalid")
+	}
+}
+
+func TestRun(t *testing.T) {
+	node := newLocalNode(t)
+	cluster := nrv.NewStaticCluster(node)
+	service := cluster.GetService("users")
+	service.Members.Add(nrv.ServiceMember{Token: nrv.Token(0), Node: node})
+	service.BindClosure("/echo/(.*)", func(request *nrv.ReceivedRequest) {
+		request.Reply(nrv.Map{"name": request.Data["name"], "path": request.Data["0"]})
+	})
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("Couldn't start cluster: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		cluster.Stop(ctx)
+		cancel()
+	}()
+
+	setFlag(t, "node", nodeFlagValue(node))
+	setFlag(t, "codec", "json")
+
+	expected := map[string][]string{
+		"call users /echo/hello name=nrv": {`"name": "nrv"`, `"path": "hello"`},
+		"services":                        {"users", "bindings=1 members=1"},
+		"bindings users":                  {"/echo/(.*)", "handler=closure"},
+		"members users":                   {nodeFlagValue(node)},
+	}
+	for command, contains := range expected {
+		local := newLocalNode(t)
+		setFlag(t, "local", nodeFlagValue(local))
+
+		args := strings.Fields(command)
+		out := &bytes.Buffer{}
+		if err := run(out, &bytes.Buffer{}, args[0], args[1:]); err != nil {
+			t.Fatalf("Command %q failed: %s", command, err)
+		}
+		for _, str := range contains {
+			if !strings.Contains(out.String(), str) {
+				t.Fatalf("Output of %q doesn't contain %q:\n%s", command, str, out)
+			}
+		}
+
+		// the client's cluster is stopped, its ports being free again
+		tcp, err := net.Listen("tcp", fmt.Sprintf("%s:%d", local.Address, local.TCPPort))
+		if err != nil {
+			t.Fatalf("Client of %q wasn't stopped: %s", command, err)
+		}
+		tcp.Close()
+		udp, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", local.Address, local.UDPPort))
+		if err != nil {
+			t.Fatalf("Client of %q wasn't stopped: %s", command, err)
+		}
+		udp.Close()
+	}
+
+	setFlag(t, "local", nodeFlagValue(newLocalNode(t)))
+	if err := run(&bytes.Buffer{}, &bytes.Buffer{}, "members", []string{"missing"}); err == nil || !strings.Contains(err.Error(), "Service missing not found") {
+		t.Fatalf("Command on a missing service should fail, got %v", err)
+	}
+	setFlag(t, "local", nodeFlagValue(newLocalNode(t)))
+	if err := run(&bytes.Buffer{}, &bytes.Buffer{}, "call", []string{"users"}); err == nil {
+		t.Fatalf("Call without path should fail")
+	}
+
+	// the trace is printed apart from the reply
+	setFlag(t, "local", nodeFlagValue(newLocalNode(t)))
+	setFlag(t, "trace", "true")
+	out, traceOut := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := run(out, traceOut, "call", []string{"users", "/echo/trace"}); err != nil {
+		t.Fatalf("Traced call failed: %s", err)
+	}
+	if !strings.Contains(out.String(), `"path": "trace"`) || !strings.Contains(traceOut.String(), "users:/echo/trace") {
+		t.Fatalf("Expected the reply and its trace apart, got:\n%s\n%s", out, traceOut)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Definition of services and the types they exchange
+//
+//	{
+//	  "package": "users",
+//	  "types": [
+//	    {"name": "GetUser", "fields": [{"name": "Id", "type": "int", "key": "id"}]},
+//	    {"name": "User", "fields": [{"name": "Id", "type": "int"}, {"name": "Name", "type": "string"}]}
+//	  ],
+//	  "services": [
+//	    {"name": "Users", "calls": [
+//	      {"name": "Get", "path": "/users/{id:int}", "methods": ["GET"], "request": "GetUser",
+//	       "response": "User", "resolver": "param", "resolver_param": "id"}
+//	    ]}
+//	  ]
+//	}
+type Definition struct {
+	Package  string              `json:"package"`
+	Types    []TypeDefinition    `json:"types"`
+	Services []ServiceDefinition `json:"services"`
+}
+
+type TypeDefinition struct {
+	Name   string            `json:"name"`
+	Doc    string            `json:"doc"`
+	Fields []FieldDefinition `json:"fields"`
+}
+
+// Field of a type, its key in data defaulting to its name
+type FieldDefinition struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Key       string `json:"key"`
+	OmitEmpty bool   `json:"omitempty"`
+}
+
+type ServiceDefinition struct {
+	Name  string           `json:"name"`
+	Doc   string           `json:"doc"`
+	Calls []CallDefinition `json:"calls"`
+}
+
+// Call of a service bound on a path. Pattern can only be "request_reply" for now
+// and resolver is "path" (default) or "param".
+type CallDefinition struct {
+	Name          string   `json:"name"`
+	Doc           string   `json:"doc"`
+	Path          string   `json:"path"`
+	Methods       []string `json:"methods"`
+	Request       string   `json:"request"`
+	Response      string   `json:"response"`
+	Pattern       string   `json:"pattern"`
+	Resolver      string   `json:"resolver"`
+	ResolverParam string   `json:"resolver_param"`
+	ResolverCount int      `json:"resolver_count"`
+}
+
+var identRegexp = regexp.MustCompile(`^[A-Z][A-Za-z0-9_]*$`)
+
+func ParseDefinition(data []byte) (*Definition, error) {
+	def := &Definition{}
+	if err := json.Unmarshal(data, def); err != nil {
+		return nil, err
+	}
+	if err := def.validate(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func (def *Definition) validate() error {
+	if def.Package == "" {
+		return fmt.Errorf("Missing package")
+	}
+
+	types := make(map[string]bool)
+	for _, typ := range def.Types {
+		if !identRegexp.MatchString(typ.Name) {
+			return fmt.Errorf("Invalid type name %q, must be an exported identifier", typ.Name)
+		} else if types[typ.Name] {
+			return fmt.Errorf("Type %s is defined twice", typ.Name)
+		}
+		types[typ.Name] = true
+
+		for _, field := range typ.Fields {
+			if !identRegexp.MatchString(field.Name) || field.Type == "" {
+				return fmt.Errorf("Invalid field %q in type %s", field.Name, typ.Name)
+			}
+		}
+	}
+
+	for _, service := range def.Services {
+		if !identRegexp.MatchString(service.Name) {
+			return fmt.Errorf("Invalid service name %q, must be an exported identifier", service.Name)
+		}
+
+		for _, call := range service.Calls {
+			if !identRegexp.MatchString(call.Name) {
+				return fmt.Errorf("Invalid call name %q in service %s", call.Name, service.Name)
+			} else if call.Path == "" {
+				return fmt.Errorf("Missing path for %s.%s", service.Name, call.Name)
+			} else if !types[call.Request] || !types[call.Response] {
+				return fmt.Errorf("Unknown request or response type for %s.%s", service.Name, call.Name)
+			} else if call.Pattern != "" && call.Pattern != "request_reply" {
+				return fmt.Errorf("Unsupported pattern %s for %s.%s", call.Pattern, service.Name, call.Name)
+			} else if call.Resolver != "" && call.Resolver != "path" && call.Resolver != "param" {
+				return fmt.Errorf("Unsupported resolver %s for %s.%s", call.Resolver, service.Name, call.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the struct tag of a field
+func (field FieldDefinition) Tag() string {
+	if field.Key == "" && !field.OmitEmpty {
+		return ""
+	}
+
+	tag := field.Key
+	if field.OmitEmpty {
+		tag += ",omitempty"
+	}
+	return fmt.Sprintf("`nrv:%q`", tag)
+}
+
+// Returns the Go expression of the call's resolver
+func (call CallDefinition) ResolverExpr() string {
+	count := call.ResolverCount
+	if count == 0 {
+		count = 1
+	}
+
+	if call.Resolver == "param" {
+		return fmt.Sprintf("&nrv.ResolverParam{Count: %d, Param: %q}", count, call.ResolverParam)
+	}
+	return fmt.Sprintf("&nrv.ResolverPath{Count: %d}", count)
+}
+
+// Method of the requests sent by clients, the first accepted by the call
+func (call CallDefinition) Method() string {
+	if len(call.Methods) == 0 {
+		return ""
+	}
+	return strings.ToUpper(call.Methods[0])
+}
+
+func (call CallDefinition) MethodsExpr() string {
+	if len(call.Methods) == 0 {
+		return "nil"
+	}
+
+	methods := make([]string, len(call.Methods))
+	for i, method := range call.Methods {
+		methods[i] = fmt.Sprintf("%q", strings.ToUpper(method))
+	}
+	return "[]string{" + strings.Join(methods, ", ") + "}"
+}
+
+func comment(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	return "// " + strings.ReplaceAll(strings.TrimSpace(doc), "\n", "\n// ") + "\n"
+}
+
+var codeTemplate = template.Must(template.New("code").Funcs(template.FuncMap{"comment": comment}).Parse(`// Code generated by nrvgen from {{.Source}}. DO NOT EDIT.
+
+package {{.Def.Package}}
+
+import (
+	"context"
+
+	"github.com/appaquet/nrv-go"
+)
+
+{{range .Def.Types}}
+{{comment .Doc}}type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} {{.Tag}}
+{{- end}}
+}
+{{end}}
+
+{{range $service := .Def.Services}}
+{{comment .Doc}}type {{.Name}}Server interface {
+{{- range .Calls}}
+	{{comment .Doc}}{{.Name}}(ctx context.Context, request *nrv.ReceivedRequest, in *{{.Request}}) (*{{.Response}}, error)
+{{- end}}
+}
+
+// Binds the calls of {{.Name}} implemented by server on the service
+func Bind{{.Name}}(service *nrv.Service, server {{.Name}}Server) error {
+{{- range .Calls}}
+	if _, err := service.Bind(&nrv.Binding{
+		Path:     {{printf "%q" .Path}},
+		Methods:  {{.MethodsExpr}},
+		Resolver: {{.ResolverExpr}},
+		Handler:  server.{{.Name}},
+	}); err != nil {
+		return err
+	}
+{{- end}}
+	return nil
+}
+
+// Client calling {{.Name}} on the nodes of a service
+type {{.Name}}Client struct {
+	service  *nrv.Service
+	bindings map[string]*nrv.Binding
+}
+
+// Creates a client for the service, binding its paths if the service doesn't have
+// them already (ex: if it's also a server)
+func New{{.Name}}Client(service *nrv.Service) (*{{.Name}}Client, error) {
+	client := &{{.Name}}Client{service, make(map[string]*nrv.Binding)}
+{{- range .Calls}}
+	if err := client.bind({{printf "%q" .Name}}, &nrv.Binding{
+		Path:     {{printf "%q" .Path}},
+		Methods:  {{.MethodsExpr}},
+		Resolver: {{.ResolverExpr}},
+	}); err != nil {
+		return nil, err
+	}
+{{- end}}
+	return client, nil
+}
+
+func (c *{{.Name}}Client) bind(call string, binding *nrv.Binding) error {
+	if existing := c.service.GetBindingMethods(binding.Path, binding.Methods...); existing != nil {
+		c.bindings[call] = existing
+		return nil
+	}
+
+	binding, err := c.service.Bind(binding)
+	c.bindings[call] = binding
+	return err
+}
+
+// Sends a request with the given data to the path of a call, filled with the
+// data's values, and waits for the reply until the context is done
+func (c *{{.Name}}Client) call(ctx context.Context, call string, method string, in interface{}, out interface{}) error {
+	data, err := nrv.NewMapFromStruct(in)
+	if err != nil {
+		return err
+	}
+	path, err := c.bindings[call].FormatPath(data)
+	if err != nil {
+		return err
+	}
+
+	resp := c.service.CallWaitContext(ctx, path, &nrv.Message{Path: path, Method: method, Data: data})
+	if !resp.Error.Empty() {
+		return resp.Error
+	}
+	return resp.Data.Into(out)
+}
+{{range .Calls}}
+{{comment .Doc}}func (c *{{$service.Name}}Client) {{.Name}}(ctx context.Context, in *{{.Request}}) (*{{.Response}}, error) {
+	out := &{{.Response}}{}
+	if err := c.call(ctx, {{printf "%q" .Name}}, {{printf "%q" .Method}}, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+{{end}}
+{{end}}
+`))
+
+// Generates the Go code of a definition, source being the name of its file
+func Generate(def *Definition, source string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := codeTemplate.Execute(buf, map[string]interface{}{
+		"Def":    def,
+		"Source": source,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("Generated invalid code: %s", err)
+	}
+	return code, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDefinition = `{
+  "package": "users",
+  "types": [
+    {"name": "GetUser", "fields": [{"name": "Id", "type": "int", "key": "id"}]},
+    {"name": "User", "fields": [{"name": "Id", "type": "int"}, {"name": "Tags", "type": "[]string", "key": "tags", "omitempty": true}]}
+  ],
+  "services": [
+    {"name": "Users", "calls": [
+      {"name": "Get", "path": "/users/{id:int}", "methods": ["get"], "request": "GetUser", "response": "User",
+       "resolver": "param", "resolver_param": "id"}
+    ]}
+  ]
+}`
+
+func TestGenerate(t *testing.T) {
+	def, err := ParseDefinition([]byte(testDefinition))
+	if err != nil {
+		t.Fatalf("Couldn't parse definition: %s", err)
+	}
+
+	code, err := Generate(def, "users.json")
+	if err != nil {
+		t.Fatalf("Couldn't generate code: %s", err)
+	}
+
+	expected := []string{
+		"// Code generated by nrvgen from users.json. DO NOT EDIT.",
+		"package users",
+		"Tags []string `nrv:\"tags,omitempty\"`",
+		"Get(ctx context.Context, request *nrv.ReceivedRequest, in *GetUser) (*User, error)",
+		"func BindUsers(service *nrv.Service, server UsersServer) error",
+		`Methods:  []string{"GET"}`,
+		`Resolver: &nrv.ResolverParam{Count: 1, Param: "id"}`,
+		"func NewUsersClient(service *nrv.Service) (*UsersClient, error)",
+		"func (c *UsersClient) Get(ctx context.Context, in *GetUser) (*User, error)",
+	}
+	for _, str := range expected {
+		if !strings.Contains(string(code), str) {
+			t.Fatalf("Generated code doesn't contain %q:\n%s", str, code)
+		}
+	}
+}
+
+func TestDefinitionErrors(t *testing.T) {
+	invalid := []string{
+		`{"types": []}`,
+		`{"package": "p", "types": [{"name": "lower"}]}`,
+		`{"package": "p", "types": [{"name": "A"}, {"name": "A"}]}`,
+		`{"package": "p", "types": [{"name": "A", "fields": [{"name": "F"}]}]}`,
+		`{"package": "p", "types": [{"name": "A"}], "services": [{"name": "S", "calls": [{"name": "C", "path": "/c", "request": "A", "response": "B"}]}]}`,
+		`{"package": "p", "types": [{"name": "A"}], "services": [{"name": "S", "calls": [{"name": "C", "path": "/c", "request": "A", "response": "A", "pattern": "pubsub"}]}]}`,
+	}
+	for _, def := range invalid {
+		if _, err := ParseDefinition([]byte(def)); err == nil {
+			t.Fatalf("Definition should be invalid: %s", def)
+		}
+	}
+}
+
+const testRunDefinition = `{
+  "package": "users",
+  "types": [
+    {"name": "GetUser", "fields": [{"name": "Id", "type": "int", "key": "id"}]},
+    {"name": "UpdateUser", "fields": [{"name": "Id", "type": "int", "key": "id"}, {"name": "Name", "type": "string", "key": "name"}]},
+    {"name": "User", "fields": [{"name": "Name", "type": "string", "key": "name"}]}
+  ],
+  "services": [
+    {"name": "Users", "calls": [
+      {"name": "Get", "path": "/users/{id:int}", "methods": ["get"], "request": "GetUser", "response": "User",
+       "resolver": "param", "resolver_param": "id"},
+      {"name": "Update", "path": "/users/{id:int}", "methods": ["post"], "request": "UpdateUser", "response": "User",
+       "resolver": "param", "resolver_param": "id"}
+    ]}
+  ]
+}`
+
+const testRunMain = `package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/appaquet/nrv-go"
+	"nrvgentest/users"
+)
+
+type server struct{}
+
+func (s *server) Get(ctx context.Context, request *nrv.ReceivedRequest, in *users.GetUser) (*users.User, error) {
+	if in.Id == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &users.User{Name: "get"}, nil
+}
+
+func (s *server) Update(ctx context.Context, request *nrv.ReceivedRequest, in *users.UpdateUser) (*users.User, error) {
+	return &users.User{Name: "update " + in.Name}, nil
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Printf(format+"\n", v...)
+	os.Exit(1)
+}
+
+func main() {
+	sb := nrv.NewMemorySwitchboard()
+	nodes := []*nrv.Node{{"node0", 1000, 0}, {"node1", 1001, 0}}
+	var clusters []*nrv.StaticCluster
+	for _, node := range nodes {
+		cluster := nrv.NewStaticClusterWithProtocol(node, &nrv.ProtocolMemory{Switchboard: sb})
+		service := cluster.GetService("users")
+		for i, member := range nodes {
+			service.Members.Add(nrv.ServiceMember{nrv.Token(uint32(i) * (1 << 31)), member})
+		}
+		if err := users.BindUsers(service, &server{}); err != nil {
+			fail("Couldn't bind server: %s", err)
+		}
+		if err := cluster.Start(); err != nil {
+			fail("Couldn't start cluster: %s", err)
+		}
+		clusters = append(clusters, cluster)
+	}
+	defer func() {
+		for _, cluster := range clusters {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			cluster.Stop(ctx)
+			cancel()
+		}
+	}()
+
+	client, err := users.NewUsersClient(clusters[0].GetService("users"))
+	if err != nil {
+		fail("Couldn't create client: %s", err)
+	}
+
+	for id := 1; id <= 4; id++ {
+		user, err := client.Get(context.Background(), &users.GetUser{Id: id})
+		if err != nil || user.Name != "get" {
+			fail("Get %d returned %v, %v", id, user, err)
+		}
+		user, err = client.Update(context.Background(), &users.UpdateUser{Id: id, Name: "nrv"})
+		if err != nil || user.Name != "update nrv" {
+			fail("Update %d returned %v, %v", id, user, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, &users.GetUser{Id: 0}); err == nil || err.(nrv.Error).Code != nrv.ERROR_TIMEOUT {
+		fail("Get should have returned when its context expired, got %v", err)
+	}
+	fmt.Println("ok")
+}
+`
+
+// Builds the code generated for a definition against the library in a temporary
+// module and runs calls through it over memory clusters
+func TestGenerateRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping build of generated code in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("Go tool isn't available")
+	}
+
+	def, err := ParseDefinition([]byte(testRunDefinition))
+	if err != nil {
+		t.Fatalf("Couldn't parse definition: %s", err)
+	}
+	code, err := Generate(def, "users.json")
+	if err != nil {
+		t.Fatalf("Couldn't generate code: %s", err)
+	}
+
+	// the library's package only uses the standard library, so it's copied in its
+	// own module to build without fetching anything
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "nrv")
+	sources, err := filepath.Glob(filepath.Join("..", "*.go"))
+	if err != nil {
+		t.Fatalf("Couldn't list library sources: %s", err)
+	}
+	files := map[string]string{
+		filepath.Join(lib, "go.mod"):            "module github.com/appaquet/nrv-go\n",
+		filepath.Join(dir, "go.mod"):            "module nrvgentest\n\nrequire github.com/appaquet/nrv-go v0.0.0\n\nreplace github.com/appaquet/nrv-go => ./nrv\n",
+		filepath.Join(dir, "users", "users.go"): string(code),
+		filepath.Join(dir, "main.go"):           testRunMain,
+	}
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(source)
+		if err != nil {
+			t.Fatalf("Couldn't read library source: %s", err)
+		}
+		files[filepath.Join(lib, filepath.Base(source))] = string(data)
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Couldn't create directory: %s", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Couldn't write %s: %s", path, err)
+		}
+	}
+
+	cmd := exec.Command(goBin, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod", "GOPROXY=off", "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Generated code failed: %s\n%s", err, out)
+	}
+}
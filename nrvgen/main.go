@@ -0,0 +1,62 @@
+// Generates typed servers and clients for nrv services from a JSON definition.
+//
+//	nrvgen -in users.json -out users_nrv.go
+//
+// It is meant to be run by go generate:
+//
+//	//go:generate go run github.com/appaquet/nrv-go/nrvgen -in users.json -out users_nrv.go
+//
+// See Definition for the format of the definition file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	inFlag  = flag.String("in", "", "definition file")
+	outFlag = flag.String("out", "", "generated Go file, <in>_nrv.go if not set")
+	pkgFlag = flag.String("package", "", "package of the generated file, overrides the definition's one")
+)
+
+func main() {
+	flag.Parse()
+	if *inFlag == "" {
+		fmt.Fprintf(os.Stderr, "Usage: nrvgen -in <definition.json> [-out <file.go>] [-package <name>]\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if err := run(*inFlag, *outFlag, *pkgFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "nrvgen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(in, out, pkg string) error {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+
+	def, err := ParseDefinition(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", in, err)
+	}
+	if pkg != "" {
+		def.Package = pkg
+	}
+
+	code, err := Generate(def, filepath.Base(in))
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		out = in[:len(in)-len(filepath.Ext(in))] + "_nrv.go"
+	}
+	return os.WriteFile(out, code, 0644)
+}
@@ -0,0 +1,312 @@
+package nrv
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Named placeholder of a binding path: {name} or {name:type}
+var pathPlaceholderRegexp = regexp.MustCompile(`^\{(\w+)(?::(\w+))?\}`)
+
+// Characters of a raw regex path that can't be formatted back into a path
+const pathRegexpMeta = `.*+?[]{}|()^$`
+
+// Regular expressions matched by typed path parameters
+var pathParamTypes = map[string]string{
+	"string": `[^/]+`,
+	"int":    `-?[0-9]+`,
+	"uint":   `[0-9]+`,
+	"float":  `-?[0-9]+(?:\.[0-9]+)?`,
+	"path":   `.+`,
+}
+
+// Segment of a path that is either static or a whole named placeholder
+var staticSegmentRegexp = regexp.MustCompile(`^[\w\-~%:@!,;=]*$`)
+var paramSegmentRegexp = regexp.MustCompile(`^\{(\w+)(?::(\w+))?\}$`)
+
+// Binding path compiled to a regex. Named placeholders such as /users/{id:int}
+// are captured under their name, converted to their type. Every placeholder,
+// named or a raw regex group, is also available under its position ("0", "1",
+// ...), groups nested in raw regex groups being ignored.
+//
+// Paths only made of static segments and placeholders can be routed by segments
+// and must match entirely. Others are raw regexes that only need to match a
+// prefix of the path.
+type bindingPath struct {
+	re       *regexp.Regexp
+	params   []pathParam
+	literals []string
+	segments []pathSegment
+
+	// error returned when formatting a raw regex path whose literal parts are
+	// not plain text
+	formatErr error
+}
+
+// Segment of a routable path, param being nil for static ones
+type pathSegment struct {
+	static string
+	param  *pathParam
+}
+
+type pathParam struct {
+	name string
+	typ  string
+
+	// index of the param's group in the path's regex, and regex matching a whole
+	// value of the param
+	group int
+	re    *regexp.Regexp
+}
+
+func compilePath(path string) (*bindingPath, error) {
+	bp := &bindingPath{segments: splitSegments(path)}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+
+	// literal parts of routable paths are plain text, regexes in others
+	literal := func(part string) {
+		bp.literals = append(bp.literals, part)
+		if bp.segments != nil {
+			pattern.WriteString(regexp.QuoteMeta(part))
+		} else {
+			pattern.WriteString(part)
+		}
+	}
+
+	group, last := 1, 0
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			i++
+
+		case '{':
+			m := pathPlaceholderRegexp.FindStringSubmatch(path[i:])
+			if m == nil {
+				continue
+			}
+			param := pathParam{name: m[1], typ: m[2], group: group}
+			if param.typ == "" {
+				param.typ = "string"
+			}
+
+			typePattern, found := pathParamTypes[param.typ]
+			if !found {
+				return nil, fmt.Errorf("Unknown type %s for path parameter %s", param.typ, param.name)
+			}
+			for _, other := range bp.params {
+				if other.name == param.name {
+					return nil, fmt.Errorf("Path parameter %s is defined twice", param.name)
+				}
+			}
+			param.re = regexp.MustCompile("^(?:" + typePattern + ")$")
+
+			literal(path[last:i])
+			pattern.WriteString("(" + typePattern + ")")
+			bp.params = append(bp.params, param)
+			group++
+			i += len(m[0]) - 1
+			last = i + 1
+
+		case '(':
+			end, err := closingParen(path, i)
+			if err != nil {
+				return nil, err
+			}
+			raw := path[i : end+1]
+			re, err := regexp.Compile(raw)
+			if err != nil {
+				return nil, err
+			}
+
+			// non capturing groups and flags are part of the literal regex
+			if strings.HasPrefix(raw, "(?") {
+				group += re.NumSubexp()
+				i = end
+				continue
+			}
+
+			literal(path[last:i])
+			pattern.WriteString(raw)
+			bp.params = append(bp.params, pathParam{group: group, re: regexp.MustCompile("^" + raw + "$")})
+			group += re.NumSubexp()
+			i = end
+			last = i + 1
+		}
+	}
+	literal(path[last:])
+
+	if bp.segments != nil {
+		pattern.WriteString("$")
+	} else {
+		bp.formatErr = bp.plainLiterals()
+	}
+
+	var err error
+	bp.re, err = regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+	return bp, nil
+}
+
+// Returns the index of the parenthesis closing the group opened at start,
+// skipping escaped characters and character classes
+func closingParen(path string, start int) (int, error) {
+	depth, class := 0, false
+	for i := start; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\':
+			i++
+		case class:
+			class = c != ']'
+		case c == '[':
+			class = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Unclosed group in path %s", path)
+}
+
+// Turns the literal regexes of a raw regex path into the plain text they match,
+// anchors excepted, or returns an error if one isn't plain text
+func (bp *bindingPath) plainLiterals() error {
+	for i, literal := range bp.literals {
+		if i == 0 {
+			literal = strings.TrimPrefix(literal, "^")
+		}
+		if i == len(bp.literals)-1 && !strings.HasSuffix(literal, `\$`) {
+			literal = strings.TrimSuffix(literal, "$")
+		}
+
+		var plain strings.Builder
+		for j := 0; j < len(literal); j++ {
+			c := literal[j]
+			if c == '\\' && j+1 < len(literal) && strings.IndexByte(pathRegexpMeta+`\/-`, literal[j+1]) >= 0 {
+				j++
+				c = literal[j]
+			} else if strings.IndexByte(pathRegexpMeta+`\`, c) >= 0 {
+				return fmt.Errorf("Path regex %q can't be formatted", literal)
+			}
+			plain.WriteByte(c)
+		}
+		bp.literals[i] = plain.String()
+	}
+	return nil
+}
+
+// Splits a path in segments, or returns nil if it's not routable by segments
+func splitSegments(path string) []pathSegment {
+	parts := strings.Split(path, "/")
+	segments := make([]pathSegment, len(parts))
+	for i, part := range parts {
+		if m := paramSegmentRegexp.FindStringSubmatch(part); m != nil {
+			param := &pathParam{name: m[1], typ: m[2]}
+			if param.typ == "" {
+				param.typ = "string"
+			}
+			// a path parameter catches the rest of the path
+			if param.typ == "path" && i != len(parts)-1 {
+				return nil
+			}
+			segments[i].param = param
+		} else if staticSegmentRegexp.MatchString(part) {
+			segments[i].static = part
+		} else {
+			return nil
+		}
+	}
+	return segments
+}
+
+// Returns the parameters captured in the path, or nil if it doesn't match
+func (bp *bindingPath) match(path string) Map {
+	m := bp.re.FindStringSubmatch(path)
+	if m == nil {
+		return nil
+	}
+
+	ret := NewMap()
+	for i, param := range bp.params {
+		capture := m[param.group]
+		ret[strconv.Itoa(i)] = capture
+
+		if param.name != "" {
+			val, err := convertPathParam(capture, param.typ)
+			if err != nil {
+				return nil
+			}
+			ret[param.name] = val
+		}
+	}
+	return ret
+}
+
+func convertPathParam(value, typ string) (interface{}, error) {
+	switch typ {
+	case "int":
+		return strconv.Atoi(value)
+	case "uint":
+		num, err := strconv.ParseUint(value, 10, 64)
+		return uint(num), err
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	}
+	return value, nil
+}
+
+// Formats a path by replacing its parameters. A single Map fills parameters by
+// name or position, otherwise parameters are given in order. Values must match
+// their parameter so that the path matches back.
+func (bp *bindingPath) format(params ...interface{}) (string, error) {
+	if bp.formatErr != nil {
+		return "", bp.formatErr
+	}
+
+	named, isMap := Map(nil), false
+	if len(params) == 1 {
+		named, isMap = params[0].(Map)
+	}
+
+	var path strings.Builder
+	for i, literal := range bp.literals {
+		path.WriteString(literal)
+		if i >= len(bp.params) {
+			break
+		}
+		param := bp.params[i]
+
+		var val interface{}
+		found := false
+		if isMap {
+			if param.name != "" {
+				val, found = named[param.name]
+			}
+			if !found {
+				val, found = named[strconv.Itoa(i)]
+			}
+		} else if i < len(params) {
+			val, found = params[i], true
+		}
+
+		if !found {
+			return "", fmt.Errorf("Missing path parameter %d %s", i, param.name)
+		}
+		str := fmt.Sprint(val)
+		if !param.re.MatchString(str) {
+			return "", fmt.Errorf("Value %q doesn't match path parameter %d %s", str, i, param.name)
+		}
+		path.WriteString(str)
+	}
+
+	return path.String(), nil
+}
@@ -1,6 +1,9 @@
 package nrv
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"time"
 )
 
@@ -10,21 +13,54 @@ type PatternRequestReply struct {
 	nextHandler     CallHandler
 	previousHandler CallHandler
 
-	rdvs   map[uint32]*Request
-	newRdv chan newRdv
-	getRdv chan *getRdv
-	rdvId  chan uint32
+	// table of requests waiting for a reply, recreated each time the handler is
+	// started
+	mutex sync.Mutex
+	rdvs  *rdvTable
+
+	rdvsGauge *Gauge
 }
 
 func (p *PatternRequestReply) InitHandler(binding *Binding) {
 	p.binding = binding
 
-	p.newRdv = make(chan newRdv, 1)
-	p.getRdv = make(chan *getRdv, 1)
-	p.rdvId = make(chan uint32, 100)
-	p.rdvs = make(map[uint32]*Request)
+	p.rdvsGauge = binding.RequestMetrics.Registry.Gauge("nrv_rdv_table_size", "Number of requests waiting for a reply in the rendez-vous table", Labels{
+		"service": binding.service.Name,
+		"binding": binding.Path,
+	})
+
+	p.StartHandler()
+}
+
+func (p *PatternRequestReply) StartHandler() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rdvs == nil {
+		p.rdvs = newRdvTable()
+	}
+}
+
+// Stops the rendez-vous table. Requests still waiting for a reply get an error.
+func (p *PatternRequestReply) StopHandler() {
+	p.mutex.Lock()
+	rdvs := p.rdvs
+	p.rdvs = nil
+	p.mutex.Unlock()
+
+	if rdvs != nil {
+		requests := rdvs.stop()
+		p.rdvsGauge.Add(-float64(len(requests)))
+		for _, request := range requests {
+			request.handleReply(newStoppedReply())
+		}
+	}
+}
 
-	p.handleRendezVous()
+func (p *PatternRequestReply) getRdvs() *rdvTable {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rdvs
 }
 
 func (p *PatternRequestReply) SetNextHandler(handler CallHandler) {
@@ -37,13 +73,33 @@ func (p *PatternRequestReply) SetPreviousHandler(handler CallHandler) {
 
 func (p *PatternRequestReply) HandleRequestSend(request *Request) *Request {
 	if request.NeedReply() {
-		// get a new rendez-vous id
-		request.Message.SourceRdv = <-p.rdvId
+		rdvs := p.getRdvs()
+		if rdvs == nil {
+			request.handleReply(newStoppedReply())
+			return request
+		}
 
 		// setup new rendez-vous
-		rdv := newRdv{request, make(chan bool)}
-		p.newRdv <- rdv
-		<-rdv.sync
+		rdvId := rdvs.add(request)
+		if rdvId == 0 {
+			request.handleReply(newStoppedReply())
+			return request
+		}
+		request.Message.SourceRdv = rdvId
+		p.rdvsGauge.Inc()
+
+		// the binding's timeout is in milliseconds, sent to the receiver so that it
+		// knows when to stop
+		if timeout := p.binding.Timeout; timeout > 0 {
+			request.Message.Timeout = uint32(timeout)
+			time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+				Log.Debug("PatternReqRep> Request %s timed out", request)
+				p.expire(rdvs, rdvId, newTimeoutReply(timeout))
+			})
+		}
+		request.abandon = func(reply *ReceivedRequest) {
+			p.expire(rdvs, rdvId, reply)
+		}
 
 		Log.Debug("PatternReqRep> Request %s will wait for a reply!", request)
 	}
@@ -51,17 +107,38 @@ func (p *PatternRequestReply) HandleRequestSend(request *Request) *Request {
 	return p.nextHandler.HandleRequestSend(request)
 }
 
+// Removes a request still waiting for replies, replying to it with the given reply
+func (p *PatternRequestReply) expire(rdvs *rdvTable, rdvId uint32, reply *ReceivedRequest) {
+	if req := rdvs.remove(rdvId); req != nil {
+		p.rdvsGauge.Dec()
+		req.handleReply(reply)
+	}
+}
+
 func (p *PatternRequestReply) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
 	Log.Debug("HandleReqReply> Received new request %s", request)
 
 	// if there is a destination rdv, it's a response! we set the initial request in it
 	if request.Message.DestinationRdv > 0 {
 		response := request
-		rdv := &getRdv{response, nil, make(chan bool)}
-		p.getRdv <- rdv
-		<-rdv.sync
 
-		response.InitRequest = rdv.request
+		rdvs := p.getRdvs()
+		if rdvs == nil {
+			Log.Error("PatternReqRep> Received a response while stopped: %s", response)
+			return request
+		}
+
+		initRequest, done := rdvs.reply(response.Message.DestinationRdv)
+		if initRequest == nil {
+			// replies of hedged or timed out requests arriving late, don't handle it
+			// as a new request
+			Log.Debug("PatternReqRep> Received a response for an unknown request: %s", response)
+			return request
+		}
+		if done {
+			p.rdvsGauge.Dec()
+		}
+		response.InitRequest = initRequest
 
 	} else {
 		// set the OnReply callback so that a call to Reply() works
@@ -87,52 +164,32 @@ func (p *PatternRequestReply) HandleRequestReceive(request *ReceivedRequest) *Re
 	return p.previousHandler.HandleRequestReceive(request)
 }
 
-type newRdv struct {
-	request *Request
-	sync    chan bool
+func newTimeoutReply(timeout int) *ReceivedRequest {
+	return &ReceivedRequest{
+		Message: &Message{
+			Error: Error{fmt.Sprintf("No reply received after %dms", timeout), ERROR_TIMEOUT},
+		},
+	}
 }
 
-type getRdv struct {
-	response *ReceivedRequest
-	request  *Request
-	sync     chan bool
+func newContextReply(err error) *ReceivedRequest {
+	code := uint16(ERROR_CANCELLED)
+	if err == context.DeadlineExceeded {
+		code = ERROR_TIMEOUT
+	}
+	return &ReceivedRequest{
+		Message: &Message{
+			Error: Error{err.Error(), code},
+		},
+	}
 }
 
-func (p *PatternRequestReply) handleRendezVous() {
-	go func() {
-		var rdvId uint32 = 0
-		for {
-			rdvId++
-			p.rdvId <- rdvId
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case rdv := <-p.newRdv:
-				p.rdvs[rdv.request.Message.SourceRdv] = rdv.request
-				rdv.sync <- true
-
-			case rdv := <-p.getRdv:
-				resp := rdv.response
-				if req, found := p.rdvs[resp.Message.DestinationRdv]; found {
-					rdv.request = req
-					req.respReceived++
-					if req.respNeeded >= req.respReceived {
-						delete(p.rdvs, resp.Message.DestinationRdv)
-					}
-				} else {
-					Log.Error("PatternReqRep> Received a response for an unknown request: %s", resp)
-				}
-				rdv.sync <- true
-
-			case <-time.After(1000000000):
-				// TODO: Handle timeouts!
-			}
-
-		}
-
-	}()
+func newStoppedReply() *ReceivedRequest {
+	return &ReceivedRequest{
+		Message: &Message{
+			Error: Error{"Request/reply pattern is stopped", ERROR_UNAVAILABLE},
+		},
+	}
 }
 
 /*
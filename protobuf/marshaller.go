@@ -0,0 +1,114 @@
+// Protocol Buffers support for nrv: messages can be put in the Data of requests
+// and replies and are sent as google.protobuf.Any so that receivers know their type.
+//
+//	cluster.GetDefaultProtocol().AddMarshaller(protobuf.NewMarshaller())
+//	...
+//	request.Reply(nrv.Map{"user": &pb.User{Name: "bob"}})
+//	...
+//	user := &pb.User{}
+//	err := protobuf.Get(resp.Data, "user", user)
+//
+// The same marshaller can be added to ProtocolHTTP to decode request bodies and
+// encode reply bodies whose content type is application/x-protobuf.
+package protobuf
+
+import (
+	"fmt"
+
+	"github.com/appaquet/nrv-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	MARSHALLER_NAME = "protobuf"
+	CONTENT_TYPE    = "application/x-protobuf"
+)
+
+// Marshaller of proto.Message values. Received messages are created from the types
+// of a registry, the global one of generated messages if Types is not set.
+type Marshaller struct {
+	Types *protoregistry.Types
+}
+
+func NewMarshaller() *Marshaller {
+	return &Marshaller{}
+}
+
+// Creates a marshaller only knowing the given messages' types
+func NewMarshallerWithTypes(messages ...proto.Message) (*Marshaller, error) {
+	types := &protoregistry.Types{}
+	for _, message := range messages {
+		if err := types.RegisterMessage(message.ProtoReflect().Type()); err != nil {
+			return nil, err
+		}
+	}
+	return &Marshaller{Types: types}, nil
+}
+
+func (m *Marshaller) MarshallerName() string {
+	return MARSHALLER_NAME
+}
+
+func (m *Marshaller) ContentType() string {
+	return CONTENT_TYPE
+}
+
+func (m *Marshaller) CanMarshal(obj interface{}) bool {
+	_, ok := obj.(proto.Message)
+	return ok
+}
+
+func (m *Marshaller) Marshal(obj interface{}) ([]byte, error) {
+	message, ok := obj.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("Can't marshal %T, not a proto message", obj)
+	}
+
+	any, err := anypb.New(message)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(any)
+}
+
+func (m *Marshaller) Unmarshal(bytes []byte) (interface{}, error) {
+	any := &anypb.Any{}
+	if err := proto.Unmarshal(bytes, any); err != nil {
+		return nil, err
+	}
+
+	resolver := protoregistry.GlobalTypes
+	if m.Types != nil {
+		resolver = m.Types
+	}
+
+	message, err := anypb.UnmarshalNew(any, proto.UnmarshalOptions{Resolver: resolver})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't unmarshal %s: %s", any.TypeUrl, err)
+	}
+	return message, nil
+}
+
+// Copies the proto message found under key in data into dest, which must be of the
+// same type
+func Get(data nrv.Map, key string, dest proto.Message) error {
+	val, found := data[key]
+	if !found || val == nil {
+		return fmt.Errorf("No message found for %s", key)
+	}
+
+	message, ok := val.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Value of %s is a %T, not a proto message", key, val)
+	}
+
+	if message.ProtoReflect().Descriptor().FullName() != dest.ProtoReflect().Descriptor().FullName() {
+		return fmt.Errorf("Value of %s is a %s, not a %s", key, message.ProtoReflect().Descriptor().FullName(), dest.ProtoReflect().Descriptor().FullName())
+	}
+
+	proto.Reset(dest)
+	proto.Merge(dest, message)
+	return nil
+}
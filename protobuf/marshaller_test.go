@@ -0,0 +1,147 @@
+package protobuf
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/appaquet/nrv-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestMarshallerRoundTrip(t *testing.T) {
+	marshaller := NewMarshaller()
+	msg := wrapperspb.String("hello")
+	if !marshaller.CanMarshal(msg) || marshaller.CanMarshal("hello") {
+		t.Fatalf("Only proto messages should be marshalled")
+	}
+
+	data, err := marshaller.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Couldn't marshal: %s", err)
+	}
+	obj, err := marshaller.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Couldn't unmarshal: %s", err)
+	}
+	if !proto.Equal(obj.(proto.Message), msg) {
+		t.Fatalf("Expected %v, got %v", msg, obj)
+	}
+
+	// registry not knowing the type
+	restricted, err := NewMarshallerWithTypes(&timestamppb.Timestamp{})
+	if err != nil {
+		t.Fatalf("Couldn't create marshaller: %s", err)
+	}
+	if _, err := restricted.Unmarshal(data); err == nil {
+		t.Fatalf("Unknown types shouldn't be unmarshalled")
+	}
+}
+
+func TestGet(t *testing.T) {
+	data := nrv.Map{"name": wrapperspb.String("bob"), "other": "bob"}
+
+	name := &wrapperspb.StringValue{}
+	if err := Get(data, "name", name); err != nil || name.Value != "bob" {
+		t.Fatalf("Expected bob, got %v %v", name, err)
+	}
+	if err := Get(data, "name", &timestamppb.Timestamp{}); err == nil {
+		t.Fatalf("Getting a message of another type should fail")
+	}
+	if err := Get(data, "other", name); err == nil {
+		t.Fatalf("Getting a value that isn't a message should fail")
+	}
+	if err := Get(data, "missing", name); err == nil {
+		t.Fatalf("Getting a missing message should fail")
+	}
+}
+
+func TestProtocolMemory(t *testing.T) {
+	sb := nrv.NewMemorySwitchboard()
+	nodes := []*nrv.Node{{Address: "node0", TCPPort: 1000}, {Address: "node1", TCPPort: 1001}}
+
+	clusters := make([]*nrv.StaticCluster, len(nodes))
+	for i, node := range nodes {
+		protocol := &nrv.ProtocolMemory{Switchboard: sb}
+		clusters[i] = nrv.NewStaticClusterWithProtocol(node, protocol)
+		protocol.AddMarshaller(NewMarshaller())
+
+		service := clusters[i].GetService("mem")
+		service.Members.Add(nrv.ServiceMember{Token: nrv.Token(0), Node: nodes[1]})
+		service.BindClosure("/echo", func(request *nrv.ReceivedRequest) {
+			name := &wrapperspb.StringValue{}
+			if err := Get(request.Message.Data, "name", name); err != nil {
+				request.Reply(nrv.Map{"error": err.Error()})
+				return
+			}
+			request.Reply(nrv.Map{"name": wrapperspb.String("hello " + name.Value)})
+		})
+
+		if err := clusters[i].Start(); err != nil {
+			t.Fatalf("Couldn't start cluster %d: %s", i, err)
+		}
+	}
+	defer func() {
+		for _, cluster := range clusters {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			cluster.Stop(ctx)
+			cancel()
+		}
+	}()
+
+	data := nrv.Map{"name": wrapperspb.String("bob")}
+	resp := clusters[0].GetService("mem").CallWait("/echo", &nrv.Message{Data: data})
+	name := &wrapperspb.StringValue{}
+	if err := Get(resp.Data, "name", name); err != nil || name.Value != "hello bob" {
+		t.Fatalf("Expected hello bob, got %v %v (%v)", name, err, resp.Data)
+	}
+
+	// the sender's data is marshalled in a copy
+	if _, ok := data["name"].(*wrapperspb.StringValue); !ok {
+		t.Fatalf("Sent data shouldn't be changed, got %v", data)
+	}
+}
+
+func TestProtocolHTTP(t *testing.T) {
+	cluster := nrv.NewStaticCluster(&nrv.Node{Address: "127.0.0.1"})
+	service := cluster.GetService("http")
+	ph := &nrv.ProtocolHTTP{DefaultService: service}
+	ph.AddMarshaller(NewMarshaller())
+
+	service.BindClosure("/echo", func(request *nrv.ReceivedRequest) {
+		name := &wrapperspb.StringValue{}
+		if err := Get(request.Message.Data, "body", name); err != nil {
+			request.Reply(nrv.Map{"body": err.Error()})
+			return
+		}
+		request.Reply(nrv.Map{"body": wrapperspb.String("hello " + name.Value)})
+	})
+
+	body, _ := NewMarshaller().Marshal(wrapperspb.String("bob"))
+	req := httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(body))
+	req.Header.Set("Content-Type", CONTENT_TYPE)
+	recorder := httptest.NewRecorder()
+	ph.ServeHTTP(recorder, req)
+
+	if recorder.Header().Get("Content-Type") != CONTENT_TYPE {
+		t.Fatalf("Expected a protobuf reply, got %q: %s", recorder.Header().Get("Content-Type"), recorder.Body)
+	}
+	obj, err := NewMarshaller().Unmarshal(recorder.Body.Bytes())
+	if err != nil || obj.(*wrapperspb.StringValue).Value != "hello bob" {
+		t.Fatalf("Expected hello bob, got %v %v", obj, err)
+	}
+
+	// invalid body
+	req = httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader([]byte("garbage")))
+	req.Header.Set("Content-Type", CONTENT_TYPE)
+	recorder = httptest.NewRecorder()
+	ph.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad request, got %d", recorder.Code)
+	}
+}
@@ -1,7 +1,11 @@
 package nrv
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -16,15 +20,16 @@ type ProtocolHTTP struct {
 	Port           int
 	DefaultService *Service
 
-	server  *http.Server
-	cluster Cluster
+	server      *http.Server
+	cluster     Cluster
+	marshallers []HTTPMarshaller
 }
 
 func (ph *ProtocolHTTP) init(cluster Cluster) {
 	ph.cluster = cluster
 }
 
-func (ph *ProtocolHTTP) start() {
+func (ph *ProtocolHTTP) start() error {
 	adr := fmt.Sprintf("%s:%d", ph.LocalAddress, ph.Port)
 
 	ph.server = &http.Server{
@@ -34,18 +39,92 @@ func (ph *ProtocolHTTP) start() {
 		WriteTimeout: 5000000000, // 5 seconds
 	}
 
+	// listen here so that errors are returned to the caller
+	listener, err := net.Listen("tcp", adr)
+	if err != nil {
+		return fmt.Errorf("Couldn't start HTTP protocol: %s", err)
+	}
+
+	server := ph.server
 	go func() {
-		err := ph.server.ListenAndServe()
-		if err != nil {
-			Log.Fatal("ProtocolHTTP> Couldn't start HTTP protocol: %s", err)
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			Log.Error("ProtocolHTTP> HTTP server stopped: %s", err)
 		}
 	}()
 
 	Log.Info("ProtocolHTTP> Started")
+	return nil
+}
+
+// Stops accepting connections and waits for active ones until the context is done
+func (ph *ProtocolHTTP) stop(ctx context.Context) error {
+	if ph.server == nil {
+		return nil
+	}
+
+	err := ph.server.Shutdown(ctx)
+	ph.server = nil
+	Log.Info("ProtocolHTTP> Stopped")
+	return err
 }
 
+// Adds a marshaller used to decode request bodies and encode reply bodies of its
+// content type. Only marshallers implementing HTTPMarshaller can be used.
 func (ph *ProtocolHTTP) AddMarshaller(marshaller ProtocolMarshaller) {
-	panic("ProtocolHTTP doesn't support protocol marshaller yet")
+	httpMarshaller, ok := marshaller.(HTTPMarshaller)
+	if !ok {
+		Log.Error("ProtocolHTTP> Marshaller %s has no content type, ignoring it", marshaller.MarshallerName())
+		return
+	}
+	ph.marshallers = append(ph.marshallers, httpMarshaller)
+}
+
+func (ph *ProtocolHTTP) findMarshaller(contentType string) HTTPMarshaller {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	for _, marshaller := range ph.marshallers {
+		if marshaller.ContentType() == mediaType {
+			return marshaller
+		}
+	}
+	return nil
+}
+
+// Decodes the body of a request if a marshaller handles its content type
+func (ph *ProtocolHTTP) unmarshalBody(req *http.Request) (interface{}, bool, error) {
+	marshaller := ph.findMarshaller(req.Header.Get("Content-Type"))
+	if marshaller == nil {
+		return nil, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, MAX_FRAME_SIZE))
+	if err != nil {
+		return nil, true, err
+	}
+	obj, err := marshaller.Unmarshal(body)
+	return obj, true, err
+}
+
+// Encodes a reply body, returning its content type if a marshaller was used
+func (ph *ProtocolHTTP) marshalBody(body interface{}) ([]byte, string, error) {
+	switch b := body.(type) {
+	case string:
+		return []byte(b), "", nil
+	case []byte:
+		return b, "", nil
+	}
+
+	for _, marshaller := range ph.marshallers {
+		if marshaller.CanMarshal(body) {
+			data, err := marshaller.Marshal(body)
+			return data, marshaller.ContentType(), err
+		}
+	}
+	return []byte(fmt.Sprintf("%s", body)), "", nil
 }
 
 func (ph *ProtocolHTTP) ServeHTTP(respWriter http.ResponseWriter, req *http.Request) {
@@ -58,8 +137,23 @@ func (ph *ProtocolHTTP) ServeHTTP(respWriter http.ResponseWriter, req *http.Requ
 		service = ph.cluster.GetService(sp[0])
 	}
 
-	binding, params := service.FindBinding(req.URL.Path)
-	if binding != nil {
+	binding, params, allowed := service.FindBindingMethod(req.URL.Path, req.Method)
+	if binding == nil && req.Method == http.MethodHead {
+		binding, params, _ = service.FindBindingMethod(req.URL.Path, http.MethodGet)
+	}
+
+	if binding == nil && len(allowed) > 0 {
+		allowed = append(allowed, http.MethodOptions)
+		respWriter.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		if req.Method == http.MethodOptions {
+			respWriter.WriteHeader(http.StatusNoContent)
+		} else {
+			Log.Debug("ProtocolHTTP> Method %s not allowed for %s %s", req.Method, req.Host, req.URL)
+			http.Error(respWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	} else if binding != nil {
 		responseWait := make(chan *Message, 1)
 
 		// parse url parameters + post parameters
@@ -71,6 +165,14 @@ func (ph *ProtocolHTTP) ServeHTTP(respWriter http.ResponseWriter, req *http.Requ
 		}
 		params["method"] = req.Method
 
+		if body, found, err := ph.unmarshalBody(req); err != nil {
+			Log.Debug("ProtocolHTTP> Couldn't decode body of %s %s: %s", req.Host, req.URL, err)
+			http.Error(respWriter, "Invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		} else if found {
+			params["body"] = body
+		}
+
 		// check if we need to trace this request // TODO: SECURITY!
 		logLevel := Log.GetLevel()
 		if _, found := params["nrv_trace"]; found {
@@ -83,13 +185,17 @@ func (ph *ProtocolHTTP) ServeHTTP(respWriter http.ResponseWriter, req *http.Requ
 		trc := logger.Trace("http_receive")
 		binding.getFirstBackwardHandler().HandleRequestReceive(&ReceivedRequest{
 			Message: &Message{
-				Logger: logger,
-				Path:   req.URL.Path,
-				Data:   params,
+				Logger:  logger,
+				Path:    req.URL.Path,
+				Method:  req.Method,
+				Data:    params,
+				Timeout: uint32(HTTP_MAX_WAIT / time.Millisecond),
 			},
 			OnReply: func(message *Message) {
 				responseWait <- message
 			},
+			WaitReply: true,
+			ctx:       req.Context(),
 		})
 
 		select {
@@ -103,20 +209,29 @@ func (ph *ProtocolHTTP) ServeHTTP(respWriter http.ResponseWriter, req *http.Requ
 					http.Redirect(respWriter, req, redirect_url.(string), 301)
 
 				} else {
+					// body, encoded by a marshaller if it's not a string
+					body, bodyContentType, err := ph.marshalBody(resp.Data["body"])
+					if err != nil {
+						http.Error(respWriter, "Couldn't encode body: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
 					// set content type
 					contentType := "text/html"
 					if newContentType, found := resp.Data["content-type"]; found {
 						contentType = newContentType.(string)
+					} else if bodyContentType != "" {
+						contentType = bodyContentType
 					}
 					respWriter.Header().Set("Content-Type", contentType)
 
-					// body
-					body := resp.Data["body"]
-					strBody := fmt.Sprintf("%s", body)
-					if _, found := params["nrv_trace"]; found {
-						strBody += fmt.Sprintf("<pre style=\"font-size: 10px\">%s</pre>", logger)
+					// the trace is only added to text bodies, appended to a copy since the body
+					// may be the bytes of the reply's data
+					if _, found := params["nrv_trace"]; found && strings.HasPrefix(contentType, "text/") {
+						trace := fmt.Sprintf("<pre style=\"font-size: 10px\">%s</pre>", logger)
+						body = append(body[:len(body):len(body)], trace...)
 					}
-					respWriter.Write([]uint8(strBody))
+					respWriter.Write(body)
 				}
 			}
 
@@ -135,11 +250,21 @@ func (np *ProtocolHTTP) SetNextHandler(handler CallHandler)     {}
 func (np *ProtocolHTTP) SetPreviousHandler(handler CallHandler) {}
 
 func (np *ProtocolHTTP) HandleRequestSend(request *Request) *Request {
-	Log.Fatal("ProtocolHTTP> Sending request not yet supported in ProtocolHTTP")
+	Log.Error("ProtocolHTTP> Sending request not yet supported in ProtocolHTTP")
+	if request.NeedReply() {
+		request.handleReply(&ReceivedRequest{
+			Message: &Message{
+				Error: Error{"Sending request not supported by ProtocolHTTP", ERROR_NOT_IMPLEMENTED},
+			},
+		})
+	}
 	return request
 }
 
 func (np *ProtocolHTTP) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
-	Log.Fatal("ProtocolHTTP> Unsupported handling of received request")
+	Log.Error("ProtocolHTTP> Unsupported handling of received request")
+	if request.NeedReply() {
+		request.ReplyMessage(&Message{Error: Error{"Unsupported handling of received request", ERROR_NOT_IMPLEMENTED}})
+	}
 	return request
 }
@@ -0,0 +1,83 @@
+package nrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProtocolHTTPMethods(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("http")
+	ph := &ProtocolHTTP{DefaultService: service}
+
+	reply := func(body string) func(request *ReceivedRequest) {
+		return func(request *ReceivedRequest) {
+			request.Reply(Map{"body": body})
+		}
+	}
+	service.BindClosure("/users", reply("list"), http.MethodGet)
+	service.BindClosure("/users", reply("create"), "post")
+	if _, err := service.BindClosure("/users", reply("conflict"), http.MethodGet); err == nil {
+		t.Fatalf("Binding the same path and method twice should conflict")
+	}
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		ph.ServeHTTP(recorder, httptest.NewRequest(method, "/users", nil))
+		return recorder
+	}
+
+	if resp := serve(http.MethodGet); resp.Code != http.StatusOK || resp.Body.String() != "list" {
+		t.Fatalf("GET wasn't routed to its binding: %d %s", resp.Code, resp.Body)
+	}
+	if resp := serve(http.MethodPost); resp.Body.String() != "create" {
+		t.Fatalf("POST wasn't routed to its binding: %d %s", resp.Code, resp.Body)
+	}
+	if resp := serve(http.MethodHead); resp.Code != http.StatusOK {
+		t.Fatalf("HEAD should be handled by GET binding: %d", resp.Code)
+	}
+
+	resp := serve(http.MethodDelete)
+	if resp.Code != http.StatusMethodNotAllowed || resp.Header().Get("Allow") != "GET, POST, OPTIONS" {
+		t.Fatalf("Expected 405 with allowed methods, got %d %q", resp.Code, resp.Header().Get("Allow"))
+	}
+
+	resp = serve(http.MethodOptions)
+	if resp.Code != http.StatusNoContent || resp.Header().Get("Allow") != "GET, POST, OPTIONS" {
+		t.Fatalf("OPTIONS should be answered automatically, got %d %q", resp.Code, resp.Header().Get("Allow"))
+	}
+}
+
+func TestProtocolHTTPTrace(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("http")
+	ph := &ProtocolHTTP{DefaultService: service}
+
+	// room left after the body so that appending to it would write in it
+	data := make([]byte, 4, 64)
+	copy(data, "data")
+	service.BindClosure("/binary", func(request *ReceivedRequest) {
+		request.Reply(Map{"body": data, "content-type": "application/octet-stream"})
+	})
+	service.BindClosure("/text", func(request *ReceivedRequest) {
+		request.Reply(Map{"body": data[:2], "content-type": "text/plain"})
+	})
+
+	serve := func(path string) string {
+		recorder := httptest.NewRecorder()
+		ph.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path+"?nrv_trace=1", nil))
+		return recorder.Body.String()
+	}
+
+	if body := serve("/binary"); body != "data" {
+		t.Fatalf("Trace shouldn't be added to a binary body, got %q", body)
+	}
+	if body := serve("/text"); !strings.HasPrefix(body, "da<pre") {
+		t.Fatalf("Trace should be added to a text body, got %q", body)
+	}
+	if string(data[:4]) != "data" {
+		t.Fatalf("Reply's data was modified by the trace: %q", data[:4])
+	}
+}
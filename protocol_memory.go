@@ -0,0 +1,200 @@
+package nrv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Connects protocols of clusters running in the same process, mostly for tests.
+// If set, faults are injected in messages going through it.
+type MemorySwitchboard struct {
+	Faults *FaultInjector
+
+	mutex     sync.Mutex
+	protocols map[string]*ProtocolMemory
+}
+
+func NewMemorySwitchboard() *MemorySwitchboard {
+	return &MemorySwitchboard{
+		protocols: make(map[string]*ProtocolMemory),
+	}
+}
+
+func (sb *MemorySwitchboard) register(protocol *ProtocolMemory) error {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	node := protocol.cluster.GetLocalNode()
+	if _, found := sb.protocols[node.String()]; found {
+		return fmt.Errorf("A node is already registered as %s on the switchboard", node)
+	}
+	sb.protocols[node.String()] = protocol
+	return nil
+}
+
+func (sb *MemorySwitchboard) unregister(protocol *ProtocolMemory) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	node := protocol.cluster.GetLocalNode()
+	if sb.protocols[node.String()] == protocol {
+		delete(sb.protocols, node.String())
+	}
+}
+
+func (sb *MemorySwitchboard) get(node *Node) *ProtocolMemory {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.protocols[node.String()]
+}
+
+// Delivers an encoded message to the protocol of a node
+func (sb *MemorySwitchboard) deliver(from, to *Node, data []byte) error {
+	dest := sb.get(to)
+	if dest == nil {
+		return fmt.Errorf("Node %s is not connected to the switchboard", to)
+	}
+
+	if sb.Faults == nil {
+		dest.enqueue(data)
+		return nil
+	}
+
+	sb.Faults.inject(from, to, func() {
+		dest.enqueue(data)
+	})
+	return nil
+}
+
+// Protocol that sends messages to other clusters of the process through a shared
+// switchboard. Messages are encoded and decoded like on the network so that
+// receivers never share data with senders. Each node receives messages in the
+// order they were delivered to it, unless faults are injected.
+type ProtocolMemory struct {
+	Switchboard *MemorySwitchboard
+
+	// codec used to encode requests, gob if not set
+	Codec Codec
+
+	cluster     Cluster
+	marshallers map[string]ProtocolMarshaller
+
+	// messages delivered to this node, received one at a time by a single goroutine
+	// while the queue isn't empty
+	queueMutex sync.Mutex
+	queue      [][]byte
+	receiving  bool
+}
+
+func (mp *ProtocolMemory) init(cluster Cluster) {
+	mp.cluster = cluster
+	mp.marshallers = make(map[string]ProtocolMarshaller)
+}
+
+func (mp *ProtocolMemory) start() error {
+	if err := mp.Switchboard.register(mp); err != nil {
+		return err
+	}
+
+	Log.Info("ProtocolMemory> Started")
+	return nil
+}
+
+func (mp *ProtocolMemory) stop(ctx context.Context) error {
+	mp.Switchboard.unregister(mp)
+	Log.Info("ProtocolMemory> Stopped")
+	return nil
+}
+
+func (mp *ProtocolMemory) AddMarshaller(marshaller ProtocolMarshaller) {
+	mp.marshallers[marshaller.MarshallerName()] = marshaller
+}
+
+// Queues an encoded message delivered to this node
+func (mp *ProtocolMemory) enqueue(data []byte) {
+	mp.queueMutex.Lock()
+	mp.queue = append(mp.queue, data)
+	if mp.receiving {
+		mp.queueMutex.Unlock()
+		return
+	}
+	mp.receiving = true
+	mp.queueMutex.Unlock()
+
+	go mp.receiveQueued()
+}
+
+// Receives queued messages in order until the queue is empty
+func (mp *ProtocolMemory) receiveQueued() {
+	for {
+		mp.queueMutex.Lock()
+		if len(mp.queue) == 0 {
+			mp.receiving = false
+			mp.queueMutex.Unlock()
+			return
+		}
+		data := mp.queue[0]
+		mp.queue[0] = nil
+		mp.queue = mp.queue[1:]
+		mp.queueMutex.Unlock()
+
+		mp.receive(data)
+	}
+}
+
+func (mp *ProtocolMemory) receive(data []byte) {
+	message, err := readMessage(bytes.NewReader(data), mp.marshallers)
+	if err != nil {
+		Log.Error("ProtocolMemory> Got an error reading message %s", err)
+		return
+	}
+
+	handleReceivedMessage(mp.cluster, message)
+}
+
+func (mp *ProtocolMemory) InitHandler(binding *Binding)           {}
+func (mp *ProtocolMemory) SetNextHandler(handler CallHandler)     {}
+func (mp *ProtocolMemory) SetPreviousHandler(handler CallHandler) {}
+
+func (mp *ProtocolMemory) HandleRequestSend(request *Request) *Request {
+	Log.Debug("ProtocolMemory> Sending request %s", request)
+
+	buf := &bytes.Buffer{}
+	if err := writeMessage(buf, request.Message, requestCodec(request, mp.Codec), mp.marshallers); err != nil {
+		mp.sendError(request, nil, err)
+		return request
+	}
+
+	localNode := mp.cluster.GetLocalNode()
+	for _, dest := range request.Message.Destination.Slice() {
+		if err := mp.Switchboard.deliver(localNode, dest.Node, buf.Bytes()); err != nil {
+			mp.sendError(request, NewServiceMembers(dest), err)
+		}
+	}
+
+	return request
+}
+
+// reply with the error if the sender waits for it, as if it came from the
+// destination that couldn't be reached
+func (mp *ProtocolMemory) sendError(request *Request, source *ServiceMembers, err error) {
+	Log.Error("ProtocolMemory> Couldn't send request %s: %s", request, err)
+	if request.NeedReply() {
+		request.handleReply(&ReceivedRequest{
+			Message: &Message{
+				Source: source,
+				Error:  Error{err.Error(), ERROR_UNAVAILABLE},
+			},
+		})
+	}
+}
+
+func (mp *ProtocolMemory) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
+	Log.Error("ProtocolMemory> Unsupported handling of received request")
+	if request.NeedReply() {
+		request.ReplyMessage(&Message{Error: Error{"Unsupported handling of received request", ERROR_NOT_IMPLEMENTED}})
+	}
+	return request
+}
@@ -0,0 +1,170 @@
+package nrv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newMemoryClusters(t *testing.T, sb *MemorySwitchboard, count int, setup func(cluster *StaticCluster, service *Service)) []*StaticCluster {
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		nodes[i] = &Node{fmt.Sprintf("node%d", i), 1000 + i, 0}
+	}
+
+	clusters := make([]*StaticCluster, count)
+	for i, node := range nodes {
+		clusters[i] = NewStaticClusterWithProtocol(node, &ProtocolMemory{Switchboard: sb})
+		service := clusters[i].GetService("mem")
+		for j, member := range nodes {
+			service.Members.Add(ServiceMember{Token(uint32(j) * (1 << 30)), member})
+		}
+		setup(clusters[i], service)
+
+		if err := clusters[i].Start(); err != nil {
+			t.Fatalf("Couldn't start cluster %d: %s", i, err)
+		}
+	}
+
+	return clusters
+}
+
+// requests lost by the switchboard never get a reply, so don't wait for them forever
+func stopClusters(clusters []*StaticCluster) {
+	// disconnect every node first so that leave announcements aren't handled after
+	// the test is over
+	for _, cluster := range clusters {
+		protocol := cluster.GetDefaultProtocol().(*ProtocolMemory)
+		protocol.Switchboard.unregister(protocol)
+	}
+
+	for _, cluster := range clusters {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		cluster.Stop(ctx)
+		cancel()
+	}
+}
+
+func TestProtocolMemoryRequestReply(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 3, func(cluster *StaticCluster, service *Service) {
+		service.BindClosure("/whoami", func(request *ReceivedRequest) {
+			request.Reply(Map{"node": cluster.GetLocalNode().Address})
+		})
+		service.BindClosure("/forward", func(request *ReceivedRequest) {
+			fwd := request.ChildRequest(Map{})
+			fwd.Message.Destination = NewServiceMembers(ServiceMember{Token(0), &Node{"node2", 1002, 0}})
+			resp := cluster.GetService("mem").CallWait("/whoami", fwd)
+			request.Reply(Map{"via": cluster.GetLocalNode().Address, "node": resp.Data["node"]})
+		})
+	})
+	defer stopClusters(clusters)
+	service := clusters[0].GetService("mem")
+
+	// resolved through the ring
+	resp := service.CallWait("/whoami", &Message{})
+	expected := service.Resolve(HashToken("/whoami"), 1).Get(0).Node.Address
+	if resp.Data["node"] != expected {
+		t.Fatalf("Expected a reply from %s, got %v", expected, resp.Data)
+	}
+
+	// explicit destination, forwarded to another node
+	req := &Message{Destination: NewServiceMembers(ServiceMember{Token(0), &Node{"node1", 1001, 0}})}
+	resp = service.CallWait("/forward", req)
+	if resp.Data["via"] != "node1" || resp.Data["node"] != "node2" {
+		t.Fatalf("Request wasn't forwarded: %v", resp.Data)
+	}
+}
+
+func TestProtocolMemoryFanOut(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 3, func(cluster *StaticCluster, service *Service) {
+		service.BindClosure("/whoami", func(request *ReceivedRequest) {
+			request.Reply(Map{"node": cluster.GetLocalNode().Address})
+		})
+	})
+	defer stopClusters(clusters)
+	service := clusters[0].GetService("mem")
+
+	replies := service.CallChan("/whoami", &Message{Destination: service.Members})
+	seen := make(map[interface{}]bool)
+	for i := 0; i < 3; i++ {
+		resp := <-replies
+		seen[resp.Data["node"]] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected a reply from every node, got %v", seen)
+	}
+}
+
+func TestProtocolMemoryOrder(t *testing.T) {
+	const count = 100
+	received := make(chan interface{}, count)
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		// handled one at a time, in the order they are received
+		service.Bind(&Binding{
+			Path:           "/order",
+			MaxConcurrency: 1,
+			MaxQueue:       count,
+			Closure: func(request *ReceivedRequest) {
+				received <- request.Data["i"]
+			},
+		})
+	})
+	defer stopClusters(clusters)
+
+	service := clusters[0].GetService("mem")
+	dest := NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()})
+	for i := 0; i < count; i++ {
+		service.Call("/order", &Message{Destination: dest, Data: Map{"i": i}})
+	}
+	for i := 0; i < count; i++ {
+		if got := <-received; got != i {
+			t.Fatalf("Expected message %d, got %v", i, got)
+		}
+	}
+}
+
+func TestProtocolMemoryUnknownNode(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 1, func(cluster *StaticCluster, service *Service) {
+		service.BindClosure("/whoami", func(request *ReceivedRequest) {})
+	})
+	defer stopClusters(clusters)
+
+	req := &Message{Destination: NewServiceMembers(ServiceMember{Token(0), &Node{"nowhere", 1, 0}})}
+	resp := clusters[0].GetService("mem").CallWait("/whoami", req)
+	if resp.Error.Code != ERROR_UNAVAILABLE {
+		t.Fatalf("Sending to an unknown node should fail, got %v", resp.Error)
+	}
+}
+
+func TestProtocolMemoryMethods(t *testing.T) {
+	var bindings [2]*Binding
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		bindings[0], _ = service.BindClosure("/users", func(request *ReceivedRequest) {
+			request.Reply(Map{"method": "get"})
+		}, "GET")
+		bindings[1], _ = service.BindClosure("/users", func(request *ReceivedRequest) {
+			request.Reply(Map{"method": "post"})
+		}, "POST")
+	})
+	defer stopClusters(clusters)
+
+	// bindings of the last cluster, the one calling
+	dest := NewServiceMembers(ServiceMember{Token(0), clusters[0].GetLocalNode()})
+	for i, expected := range []string{"get", "post"} {
+		select {
+		case resp := <-bindings[i].CallChan(&Message{Destination: dest}):
+			if resp.Data["method"] != expected {
+				t.Fatalf("Expected the %s binding to handle the call, got %v %s", expected, resp.Data, resp.Error)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No reply for the %s binding", expected)
+		}
+	}
+
+	// a method given by the caller picks the binding
+	resp := clusters[1].GetService("mem").CallWait("/users", &Message{Destination: dest, Method: "post"})
+	if resp.Data["method"] != "post" {
+		t.Fatalf("Expected the post binding to handle the call, got %v %s", resp.Data, resp.Error)
+	}
+}
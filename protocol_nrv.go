@@ -3,16 +3,43 @@ package nrv
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 )
 
 const (
 	MAX_UDP_SIZE = 4096
+
+	// First byte of datagrams that must be acknowledged, followed by the epoch of
+	// the sender and a sequence number, and of their acks. Other datagrams are
+	// frames starting by a codec id.
+	UDP_ACK_REQUEST = 0xfe
+	UDP_ACK         = 0xff
+	UDP_HEADER_SIZE = 9
+
+	// Time waited for an ack before retransmitting, doubled on each retry
+	UDP_ACK_TIMEOUT = 50 * time.Millisecond
+
+	// Number of acknowledged datagrams remembered to drop retransmitted ones
+	UDP_RECENT_SIZE = 1024
+
+	// First byte of the frame sent when opening a TCP connection, followed by the
+	// length and address of the node opening it. Other frames start by a codec id.
+	TCP_HELLO = 0x00
+
+	// Time a frame can take to be written on a TCP connection before the connection
+	// is given up, so that a stalled node doesn't block every sender
+	TCP_WRITE_TIMEOUT = 5 * time.Second
 )
 
 type ProtocolMarshaller interface {
@@ -22,6 +49,13 @@ type ProtocolMarshaller interface {
 	Unmarshal(bytes []byte) (interface{}, error)
 }
 
+// Marshaller that ProtocolHTTP can use for request and reply bodies of its content
+// type
+type HTTPMarshaller interface {
+	ProtocolMarshaller
+	ContentType() string
+}
+
 type MarshalledObject struct {
 	Name  string
 	Bytes []byte
@@ -32,7 +66,8 @@ type Protocol interface {
 	AddMarshaller(marshaller ProtocolMarshaller)
 
 	init(cluster Cluster)
-	start()
+	start() error
+	stop(ctx context.Context) error
 }
 
 type ProtocolNrv struct {
@@ -40,120 +75,425 @@ type ProtocolNrv struct {
 	TCPPort      int
 	UDPPort      int
 
+	// codec used to encode requests, gob if not set
+	Codec Codec
+
 	tcpSock     *net.TCPListener
 	udpSock     *net.UDPConn
 	cluster     Cluster
 	marshallers map[string]ProtocolMarshaller
+	accepting   sync.WaitGroup
+
+	// TCP connections shared by requests and replies from and to other nodes, by
+	// node, and all opened connections including duplicates and connections of
+	// unknown nodes not in the pool. None are opened once stopped.
+	connsMutex sync.Mutex
+	conns      map[string]*nrvConnection
+	openConns  map[*nrvConnection]bool
+	stopped    bool
+
+	// datagrams waiting for an ack, by sequence number
+	udpSeq   uint32
+	udpMutex sync.Mutex
+	udpAcks  map[uint32]chan bool
+}
+
+var errProtocolStopped = errors.New("Protocol is stopped")
+
+// Random epoch of this process in acknowledged datagrams, so that a restarted node
+// reusing its address and restarting its sequence numbers isn't taken for the
+// previous one retransmitting
+var udpEpoch = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+
+func init() {
+	gob.Register(&MarshalledObject{})
+	gob.Register(&RequestLogger{})
+	gob.Register(&messageLogger{})
+	gob.Register(Map{})
+	gob.Register(Array{})
+	gob.Register([]interface{}{})
+	gob.Register([]string{})
 }
 
 func (np *ProtocolNrv) init(cluster Cluster) {
 	np.cluster = cluster
 	np.marshallers = make(map[string]ProtocolMarshaller)
-	gob.Register(&MarshalledObject{})
-	gob.Register(&RequestLogger{})
+	np.udpAcks = make(map[uint32]chan bool)
+	np.conns = make(map[string]*nrvConnection)
+	np.openConns = make(map[*nrvConnection]bool)
 }
 
-func (np *ProtocolNrv) start() {
+func (np *ProtocolNrv) start() error {
 	var err error
-	tcpAddr := net.TCPAddr{net.ParseIP(np.LocalAddress), int(np.TCPPort)}
+	tcpAddr := net.TCPAddr{IP: net.ParseIP(np.LocalAddress), Port: np.TCPPort}
 	np.tcpSock, err = net.ListenTCP("tcp", &tcpAddr)
 	if err != nil {
-		Log.Fatal("ProtocolNrv> Can't start nrv TCP listener: %s", err)
+		return fmt.Errorf("Can't start nrv TCP listener: %s", err)
 	}
-	go np.acceptTCP()
 
-	udpAddr := net.UDPAddr{net.ParseIP(np.LocalAddress), int(np.UDPPort)}
+	udpAddr := net.UDPAddr{IP: net.ParseIP(np.LocalAddress), Port: np.UDPPort}
 	np.udpSock, err = net.ListenUDP("udp", &udpAddr)
 	if err != nil {
-		Log.Fatal("ProtocolNrv> Can't start nrv UDP listener: %s", err)
+		np.tcpSock.Close()
+		return fmt.Errorf("Can't start nrv UDP listener: %s", err)
 	}
-	go np.acceptUDP()
+
+	np.connsMutex.Lock()
+	np.stopped = false
+	np.connsMutex.Unlock()
+
+	np.accepting.Add(2)
+	go np.acceptTCP(np.tcpSock)
+	go np.acceptUDP(np.udpSock)
 
 	Log.Info("ProtocolNrv> Started")
+	return nil
+}
+
+// Closes listeners and connections and waits for accept and read loops to exit
+func (np *ProtocolNrv) stop(ctx context.Context) error {
+	if np.tcpSock == nil {
+		return nil
+	}
+
+	np.tcpSock.Close()
+	np.udpSock.Close()
+	np.tcpSock, np.udpSock = nil, nil
+
+	np.connsMutex.Lock()
+	np.stopped = true
+	conns := make([]*nrvConnection, 0, len(np.openConns))
+	for conn := range np.openConns {
+		conns = append(conns, conn)
+	}
+	np.connsMutex.Unlock()
+	for _, conn := range conns {
+		np.closeConnection(conn)
+	}
+
+	done := make(chan bool)
+	go func() {
+		np.accepting.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		Log.Info("ProtocolNrv> Stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (np *ProtocolNrv) AddMarshaller(marshaller ProtocolMarshaller) {
 	np.marshallers[marshaller.MarshallerName()] = marshaller
 }
 
-func (np *ProtocolNrv) acceptTCP() {
+func (np *ProtocolNrv) acceptTCP(tcpSock *net.TCPListener) {
+	defer np.accepting.Done()
+
 	for {
-		conn, err := np.tcpSock.Accept()
-		if err != nil {
+		conn, err := tcpSock.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			Log.Error("ProtocolNrv> Couldn't accept TCP connexion: %s\n", err)
+			continue
 		}
 
-		message, err := np.readMessage(conn)
-		if err == nil {
-			go np.handleReceivedMessage(message)
-		} else {
-			Log.Error("ProtocolNrv> Got an error reading TCP message %s", err)
-		}
+		np.accepting.Add(1)
+		go np.serveConnection(conn)
+	}
+}
+
+// Reads the hello of a connection opened by another node, then reads its messages.
+// The connection is pooled to send replies and requests to that node only if it's
+// a member of the cluster's services connecting from its address, so that a peer
+// can't take the place of another node.
+func (np *ProtocolNrv) serveConnection(conn net.Conn) {
+	defer np.accepting.Done()
 
-		// TODO: DON'T CLOSE IT, POOL IT
+	reader := bufio.NewReader(conn)
+	key, err := readHello(reader)
+	if err != nil {
+		Log.Error("ProtocolNrv> Got an invalid hello from %s: %s", conn.RemoteAddr(), err)
 		conn.Close()
+		return
+	}
+
+	pool := np.knownNode(key, conn.RemoteAddr())
+	if !pool {
+		Log.Debug("ProtocolNrv> Not pooling TCP connection from %s, %s is not a known node", conn.RemoteAddr(), key)
+	}
+
+	Log.Debug("ProtocolNrv> Accepted TCP connection from %s", key)
+	if c := np.addConnection(key, conn, pool); c != nil {
+		np.readConnection(c, reader)
+	}
+}
+
+// Returns true if the key is the one of a member of the cluster's services whose
+// address, if it's an IP, is the remote address of the connection
+func (np *ProtocolNrv) knownNode(key string, remote net.Addr) bool {
+	for _, service := range np.cluster.GetServices() {
+		for _, member := range service.Members.Slice() {
+			if nodeKey(member.Node) != key {
+				continue
+			}
+
+			ip := net.ParseIP(member.Node.Address)
+			tcpAddr, ok := remote.(*net.TCPAddr)
+			return ip == nil || !ok || ip.Equal(tcpAddr.IP)
+		}
+	}
+	return false
+}
+
+// Reads messages of a connection until it's closed. Each message is handled in
+// its own goroutine so that a slow handler doesn't hold the following ones.
+func (np *ProtocolNrv) readConnection(c *nrvConnection, reader io.Reader) {
+	defer np.accepting.Done()
+	defer np.closeConnection(c)
+
+	for {
+		codecId, data, err := readRawFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				Log.Error("ProtocolNrv> Got an error reading TCP connection with %s: %s", c.key, err)
+			}
+			return
+		}
+
+		message, err := decodeMessage(codecId, data, np.marshallers)
+		if err != nil {
+			Log.Error("ProtocolNrv> Got an error reading TCP message from %s: %s", c.key, err)
+			continue
+		}
+		np.handleReceivedMessage(message)
 	}
 }
 
-func (np *ProtocolNrv) acceptUDP() {
+func (np *ProtocolNrv) acceptUDP(udpSock *net.UDPConn) {
+	defer np.accepting.Done()
+
+	recent := newRecentDatagrams(UDP_RECENT_SIZE)
+
 	// Looping for new messages
 	for {
 		buf := make([]byte, MAX_UDP_SIZE)
-		n, adr, err := np.udpSock.ReadFrom(buf)
+		n, adr, err := udpSock.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 
 		Log.Debug("ProtocolNrv> New UDP packet received of %d bytes from %s %s", n, adr, err)
 
 		if err != nil {
 			Log.Error("ProtocolNrv> Error while reading UDP (read %d) from %s: %s\n", n, adr, err)
-		} else {
-			reader := io.Reader(bytes.NewBuffer(buf))
-			message, err := np.readMessage(reader)
-			if err == nil {
-				go np.handleReceivedMessage(message)
-			} else {
-				Log.Error("ProtocolNrv> Got an error reading UDP message %s", err)
+			continue
+		}
+
+		data := buf[:n]
+		if n > 0 && (data[0] == UDP_ACK || data[0] == UDP_ACK_REQUEST) {
+			if n < UDP_HEADER_SIZE {
+				Log.Error("ProtocolNrv> Got a truncated UDP packet of %d bytes from %s", n, adr)
+				continue
 			}
+
+			epoch, seq := readUDPHeader(data)
+			if data[0] == UDP_ACK {
+				// acks of datagrams sent before a restart of this process are ignored
+				if epoch == udpEpoch {
+					np.ackReceived(seq)
+				}
+				continue
+			}
+
+			if _, err := udpSock.WriteToUDP(udpHeader(UDP_ACK, epoch, seq), adr); err != nil {
+				Log.Error("ProtocolNrv> Couldn't send UDP ack to %s: %s", adr, err)
+			}
+
+			// our ack got lost and the message was sent again
+			if !recent.add(fmt.Sprintf("%s/%d/%d", adr, epoch, seq)) {
+				Log.Debug("ProtocolNrv> Dropping UDP message %d from %s already received", seq, adr)
+				continue
+			}
+			data = data[UDP_HEADER_SIZE:]
+		}
+
+		message, err := np.readMessage(bytes.NewReader(data))
+		if err == nil {
+			np.handleReceivedMessage(message)
+		} else {
+			Log.Error("ProtocolNrv> Got an error reading UDP message %s", err)
 		}
 	}
 }
 
 func (np *ProtocolNrv) handleReceivedMessage(message *Message) {
-	service := np.cluster.GetService(message.ServiceName)
-	binding, pathParams := service.FindBinding(message.Path)
+	handleReceivedMessage(np.cluster, message)
+}
+
+// Finds the binding of a message received by a protocol and passes it in its chain.
+// The message is handled in another goroutine, within the binding's limits.
+func handleReceivedMessage(cluster Cluster, message *Message) {
+	service := cluster.GetService(message.ServiceName)
+	binding, pathParams, _ := service.FindBindingMethod(message.Path, message.Method)
 
 	if binding != nil {
+		if message.Data == nil {
+			message.Data = NewMap()
+		}
 		message.Data.Merge(pathParams)
-		binding.getFirstBackwardHandler().HandleRequestReceive(&ReceivedRequest{
+		binding.limiter.submit(&ReceivedRequest{
 			Message: message,
 		})
 	} else {
-		Log.Error("ProtocolNrv> Got a message for a non existing. Service=%s Path=%s", service, message.Path)
+		Log.Error("Protocol> Got a message for a non existing binding. Service=%s Path=%s Method=%s", message.ServiceName, message.Path, message.Method)
 	}
 }
 
-func (np *ProtocolNrv) getConnection(node *Node) *nrvConnection {
-	// TODO: TCP pooling!
-	// TODO: Find a way to find size of message
-
-	/*
-		Log.Debug("ProtocolNrv> Opening new UDP connection to %s", node)
-		adr := net.UDPAddr{net.ParseIP(node.Address), int(node.UDPPort)}
-		con, err := net.DialUDP("udp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
-		if err != nil {
-			Log.Error("Couldn't create UDP connection to node %s: %s", node, err)
-			return nil
-		}
-		return &nrvConnection{con, false}
-	*/
+// Returns the pooled connection to a node, opening it if needed and the protocol
+// isn't stopped
+func (np *ProtocolNrv) getConnection(node *Node) (*nrvConnection, error) {
+	key := nodeKey(node)
+
+	np.connsMutex.Lock()
+	c, found := np.conns[key]
+	stopped := np.stopped
+	np.connsMutex.Unlock()
+	if found {
+		return c, nil
+	} else if stopped {
+		return nil, errProtocolStopped
+	}
 
 	Log.Debug("ProtocolNrv> Opening new TCP connection to %s", node)
-	adr := net.TCPAddr{net.ParseIP(node.Address), int(node.TCPPort)}
-	con, err := net.DialTCP("tcp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
+	adr := net.TCPAddr{IP: net.ParseIP(node.Address), Port: node.TCPPort}
+	conn, err := net.DialTCP("tcp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
 	if err != nil {
-		Log.Error("Couldn't create TCP connection to node %s: %s", node, err)
+		return nil, fmt.Errorf("Couldn't create TCP connection to node %s: %s", node, err)
+	}
+
+	if err := writeHello(conn, nodeKey(np.cluster.GetLocalNode())); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Couldn't send hello to node %s: %s", node, err)
+	}
+
+	c = np.addConnection(key, conn, true)
+	if c == nil {
+		return nil, errProtocolStopped
+	}
+	go np.readConnection(c, bufio.NewReader(conn))
+
+	// another goroutine may have opened one at the same time, the first one is used
+	// and this one closed
+	np.connsMutex.Lock()
+	pooled, found := np.conns[key]
+	np.connsMutex.Unlock()
+	if found && pooled != c {
+		np.closeConnection(c)
+		return pooled, nil
+	}
+	return c, nil
+}
+
+// Tracks an opened connection to be read, pooling it if asked and there's none for
+// the node yet. The connection is closed and nil returned if the protocol is
+// stopped.
+func (np *ProtocolNrv) addConnection(key string, conn net.Conn, pool bool) *nrvConnection {
+	c := &nrvConnection{conn: conn, key: key, pending: make(map[*Request]*Node)}
+
+	np.connsMutex.Lock()
+	if np.stopped {
+		np.connsMutex.Unlock()
+		conn.Close()
 		return nil
 	}
-	return &nrvConnection{con, true}
+	// counted while holding the mutex so that stop waits for its read loop
+	np.accepting.Add(1)
+	np.openConns[c] = true
+	if _, found := np.conns[key]; pool && !found {
+		np.conns[key] = c
+	}
+	np.connsMutex.Unlock()
+
+	Metrics.Gauge("nrv_connection_pool_size", "Number of connections opened to other nodes", nil).Inc()
+	return c
+}
+
+// Closes a connection, requests written on it that still wait for a reply from its
+// node getting an error reply since it will never come
+func (np *ProtocolNrv) closeConnection(c *nrvConnection) {
+	np.connsMutex.Lock()
+	if np.conns[c.key] == c {
+		delete(np.conns, c.key)
+	}
+	_, found := np.openConns[c]
+	delete(np.openConns, c)
+	pending := c.pending
+	c.pending = nil
+	np.connsMutex.Unlock()
+
+	if found {
+		c.conn.Close()
+		Metrics.Gauge("nrv_connection_pool_size", "Number of connections opened to other nodes", nil).Dec()
+	}
+
+	// replied as if the error came from the node, so that the rendez-vous counts it
+	for request, node := range pending {
+		Log.Debug("ProtocolNrv> Connection with %s closed before a reply to %s", c.key, request)
+		np.handleReceivedMessage(&Message{
+			ServiceName:    request.Message.ServiceName,
+			Path:           request.Message.Path,
+			Method:         request.Message.Method,
+			Source:         NewServiceMembers(ServiceMember{Token(0), node}),
+			DestinationRdv: request.Message.SourceRdv,
+			Error:          Error{fmt.Sprintf("Connection to node %s closed before a reply", node), ERROR_UNAVAILABLE},
+		})
+	}
+}
+
+// Tracks a request about to be written on a connection until its node replies.
+// Returns false if the connection is already closed.
+func (np *ProtocolNrv) addPending(c *nrvConnection, request *Request, node *Node) bool {
+	np.connsMutex.Lock()
+	defer np.connsMutex.Unlock()
+
+	if c.pending == nil {
+		return false
+	}
+	c.pending[request] = node
+	return true
+}
+
+// Stops tracking a request written on a connection. Returns false if it was
+// already replied to.
+func (np *ProtocolNrv) removePending(c *nrvConnection, request *Request) bool {
+	np.connsMutex.Lock()
+	defer np.connsMutex.Unlock()
+
+	_, found := c.pending[request]
+	delete(c.pending, request)
+	return found
+}
+
+// Stops tracking a request on connections with the node that replied, or on every
+// connection if the reply doesn't come from a node, the request being over
+func (np *ProtocolNrv) replyReceived(request *Request, reply *ReceivedRequest) {
+	key := ""
+	if !reply.Message.Source.Empty() {
+		key = nodeKey(reply.Message.Source.Get(0).Node)
+	}
+
+	np.connsMutex.Lock()
+	defer np.connsMutex.Unlock()
+	for c := range np.openConns {
+		if key == "" || c.key == key {
+			delete(c.pending, request)
+		}
+	}
 }
 
 func (np *ProtocolNrv) InitHandler(binding *Binding)           {}
@@ -163,78 +503,301 @@ func (np *ProtocolNrv) SetPreviousHandler(handler CallHandler) {}
 func (np *ProtocolNrv) HandleRequestSend(request *Request) *Request {
 	Log.Debug("ProtocolNrv> Sending request %s", request)
 
-	for _, dest := range request.Message.Destination.Slice {
+	if request.NeedReply() {
+		onReply := request.OnReply
+		request.OnReply = func(reply *ReceivedRequest) {
+			np.replyReceived(request, reply)
+			onReply(reply)
+		}
+	}
+
+	for _, dest := range request.Message.Destination.Slice() {
 		if dest.Node.Is(np.cluster.GetLocalNode()) {
-			go np.handleReceivedMessage(request.Message)
+			np.handleReceivedMessage(request.Message)
+
+		} else if err := np.send(dest.Node, request, requestCodec(request, np.Codec)); err != nil {
+			Log.Error("ProtocolNrv> Couldn't send request %s: %s", request, err)
+
+			// reply with the error if the sender waits for it, as if it came from
+			// the destination that couldn't be reached
+			if request.NeedReply() {
+				request.handleReply(&ReceivedRequest{
+					Message: &Message{
+						Source: NewServiceMembers(dest),
+						Error:  Error{err.Error(), ERROR_UNAVAILABLE},
+					},
+				})
+			}
+		}
+	}
 
-		} else {
-			conn := np.getConnection(dest.Node)
-			buf := bufio.NewWriter(conn.conn)
-			err := np.writeMessage(buf, request.Message)
+	Log.Debug("ProtocolNrv> Sending request %s. Done!", request)
+	return request
+}
 
-			// TODO: handle errors by sending them back to the OnError callback
-			if err != nil {
-				Log.Fatal("ProtocolNrv> Couldn't write message to connection %s", err)
-			}
-			err = buf.Flush()
-			if err != nil {
-				Log.Fatal("ProtocolNrv> Got an error writing to connection: %s", err)
-			}
+// Sends a request over TCP, or over UDP if its binding allows it and it fits in a
+// datagram
+func (np *ProtocolNrv) send(node *Node, request *Request, codec Codec) error {
+	buf := &bytes.Buffer{}
+	if err := np.writeMessage(buf, request.Message, codec); err != nil {
+		return fmt.Errorf("Couldn't write message: %s", err)
+	}
 
-			conn.Release()
+	if canSendUDP(request) {
+		if buf.Len()+UDP_HEADER_SIZE <= MAX_UDP_SIZE {
+			return np.sendUDP(node, buf.Bytes(), request.Binding.UDPRetries)
+		}
+		Log.Debug("ProtocolNrv> Message of %d bytes is too big for UDP, sending %s over TCP", buf.Len(), request)
+	}
+
+	return np.sendTCP(node, request, buf.Bytes())
+}
 
+// Only messages that don't wait for a reply and aren't replies can be lost
+func canSendUDP(request *Request) bool {
+	return request.Binding != nil && request.Binding.UDP && !request.NeedReply() && request.Message.DestinationRdv == 0
+}
+
+// Writes a frame of a request on the connection to the node. A pooled connection
+// may have been closed by the other node, in which case a new one is opened. A
+// frame partly written isn't sent again since the node may have received it.
+//
+// A request waiting for a reply is tracked on the connection until the node
+// replies, and gets an error reply if the connection closes before.
+func (np *ProtocolNrv) sendTCP(node *Node, request *Request, frame []byte) error {
+	for attempt := 0; ; attempt++ {
+		c, err := np.getConnection(node)
+		if err != nil {
+			return err
 		}
+
+		if request.NeedReply() && !np.addPending(c, request, node) {
+			continue
+		}
+
+		written, err := c.write(frame)
+		if err == nil {
+			return nil
+		}
+
+		// the connection was closed meanwhile, replying with an error already
+		if request.NeedReply() && !np.removePending(c, request) {
+			return nil
+		}
+
+		np.closeConnection(c)
+		if attempt > 0 || written > 0 {
+			return fmt.Errorf("Got an error writing to connection: %s", err)
+		}
+		Log.Debug("ProtocolNrv> Couldn't write to connection with %s, opening a new one: %s", c.key, err)
+	}
+}
+
+// Sends a frame in a datagram from the UDP listener so that acks come back to it.
+// If retries is over 0, the receiver acknowledges it and it is sent again until
+// acked or retries are exhausted.
+func (np *ProtocolNrv) sendUDP(node *Node, frame []byte, retries int) error {
+	udpSock := np.udpSock
+	if udpSock == nil {
+		return errors.New("UDP listener is not started")
 	}
+	adr := &net.UDPAddr{IP: net.ParseIP(node.Address), Port: node.UDPPort}
 
-	Log.Debug("ProtocolNrv> Sending request %s. Done!", request)
-	return request
+	if retries <= 0 {
+		_, err := udpSock.WriteToUDP(frame, adr)
+		return err
+	}
+
+	seq := atomic.AddUint32(&np.udpSeq, 1)
+	datagram := append(udpHeader(UDP_ACK_REQUEST, udpEpoch, seq), frame...)
+
+	acked := make(chan bool)
+	np.udpMutex.Lock()
+	np.udpAcks[seq] = acked
+	np.udpMutex.Unlock()
+
+	if _, err := udpSock.WriteToUDP(datagram, adr); err != nil {
+		np.ackReceived(seq)
+		return err
+	}
+
+	go np.retransmitUDP(udpSock, adr, datagram, seq, acked, retries)
+	return nil
+}
+
+func (np *ProtocolNrv) retransmitUDP(udpSock *net.UDPConn, adr *net.UDPAddr, datagram []byte, seq uint32, acked chan bool, retries int) {
+	timeout := UDP_ACK_TIMEOUT
+	for retry := 0; ; retry++ {
+		select {
+		case <-acked:
+			return
+		case <-time.After(timeout):
+		}
+
+		if retry >= retries {
+			np.ackReceived(seq)
+			Log.Error("ProtocolNrv> No ack received from %s for UDP message %d after %d retries", adr, seq, retries)
+			Metrics.Counter("nrv_udp_lost_total", "Number of UDP messages never acknowledged", nil).Inc()
+			return
+		}
+
+		Log.Debug("ProtocolNrv> Retransmitting UDP message %d to %s", seq, adr)
+		Metrics.Counter("nrv_udp_retransmit_total", "Number of UDP messages sent again for lack of ack", nil).Inc()
+		if _, err := udpSock.WriteToUDP(datagram, adr); err != nil {
+			Log.Error("ProtocolNrv> Couldn't retransmit UDP message %d to %s: %s", seq, adr, err)
+		}
+		timeout *= 2
+	}
+}
+
+// Returns the header of an acknowledged datagram or of its ack
+func udpHeader(kind byte, epoch, seq uint32) []byte {
+	header := make([]byte, UDP_HEADER_SIZE)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], epoch)
+	binary.BigEndian.PutUint32(header[5:], seq)
+	return header
+}
+
+func readUDPHeader(data []byte) (epoch, seq uint32) {
+	return binary.BigEndian.Uint32(data[1:5]), binary.BigEndian.Uint32(data[5:UDP_HEADER_SIZE])
+}
+
+// Stops waiting for the ack of a datagram
+func (np *ProtocolNrv) ackReceived(seq uint32) {
+	np.udpMutex.Lock()
+	acked, found := np.udpAcks[seq]
+	delete(np.udpAcks, seq)
+	np.udpMutex.Unlock()
+
+	if found {
+		close(acked)
+	}
 }
 
 func (np *ProtocolNrv) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest {
-	Log.Fatal("ProtocolHTTP> Unsupported handling of received request")
+	Log.Error("ProtocolNrv> Unsupported handling of received request")
+	if request.NeedReply() {
+		request.ReplyMessage(&Message{Error: Error{"Unsupported handling of received request", ERROR_NOT_IMPLEMENTED}})
+	}
 	return request
 }
 
-func (np *ProtocolNrv) writeMessage(writer io.Writer, message *Message) error {
-	mParams, err := np.preMarshal(message.Data)
+func (np *ProtocolNrv) writeMessage(writer io.Writer, message *Message, codec Codec) error {
+	return writeMessage(writer, message, codec, np.marshallers)
+}
+
+func (np *ProtocolNrv) readMessage(reader io.Reader) (message *Message, err error) {
+	return readMessage(reader, np.marshallers)
+}
+
+func nodeKey(node *Node) string {
+	return fmt.Sprintf("%s:%d", node.Address, node.TCPPort)
+}
+
+// Writes the hello frame identifying the node opening a connection
+func writeHello(writer io.Writer, key string) error {
+	hello := make([]byte, 5+len(key))
+	hello[0] = TCP_HELLO
+	binary.BigEndian.PutUint32(hello[1:], uint32(len(key)))
+	copy(hello[5:], key)
+	_, err := writer.Write(hello)
+	return err
+}
+
+func readHello(reader io.Reader) (string, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != TCP_HELLO {
+		return "", fmt.Errorf("Expected hello, got frame 0x%x", header[0])
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > 1024 {
+		return "", fmt.Errorf("Hello of %d bytes is too big", size)
+	}
+	key := make([]byte, size)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// Returns the codec to encode a request with: the one of the request it replies
+// to, else the protocol's one, else gob
+func requestCodec(request *Request, codec Codec) Codec {
+	if request.InitRequest != nil && request.InitRequest.Message.codec != nil {
+		return request.InitRequest.Message.codec
+	} else if codec != nil {
+		return codec
+	}
+	return GobCodec{}
+}
+
+// Encodes a message in a frame, marshalling objects of its data with the given
+// marshallers. The message is left as it was, so that it can still be sent to
+// other destinations or used by its sender.
+func writeMessage(writer io.Writer, message *Message, codec Codec, marshallers map[string]ProtocolMarshaller) error {
+	mParams, err := preMarshal(message.Data, marshallers)
 	if err != nil {
 		return err
 	}
 
-	message.Data = mParams.(Map)
-
-	encoder := gob.NewEncoder(writer)
-	return encoder.Encode(message)
+	copied := *message
+	copied.Data = mParams.(Map)
+	return writeFrame(writer, &copied, codec)
 }
 
-func (np *ProtocolNrv) preMarshal(obj interface{}) (newObj interface{}, err error) {
+// Returns a copy of maps and arrays in which objects handled by a marshaller are
+// replaced by their *MarshalledObject
+func preMarshal(obj interface{}, marshallers map[string]ProtocolMarshaller) (newObj interface{}, err error) {
 	switch obj.(type) {
 	case Map:
 		mp := obj.(Map)
+		if mp == nil {
+			return mp, nil
+		}
+		copied := make(Map, len(mp))
 		for k, v := range mp {
-			mp[k], err = np.preMarshal(v)
+			copied[k], err = preMarshal(v, marshallers)
 			if err != nil {
 				return
 			}
 		}
+		return copied, nil
 
 	case []interface{}:
 		ar := obj.([]interface{})
+		copied := make([]interface{}, len(ar))
+		for i, v := range ar {
+			copied[i], err = preMarshal(v, marshallers)
+			if err != nil {
+				return
+			}
+		}
+		return copied, nil
+
+	case Array:
+		ar := obj.(Array)
+		copied := make(Array, len(ar))
 		for i, v := range ar {
-			ar[i], err = np.preMarshal(v)
+			copied[i], err = preMarshal(v, marshallers)
 			if err != nil {
 				return
 			}
 		}
+		return copied, nil
 
 	default:
-		for marshName, marsh := range np.marshallers {
+		for marshName, marsh := range marshallers {
 			if marsh.CanMarshal(obj) {
 				bytes, err := marsh.Marshal(obj)
 				if err != nil {
 					return nil, err
 				}
-				return MarshalledObject{marshName, bytes}, nil
+				return &MarshalledObject{marshName, bytes}, nil
 			}
 		}
 	}
@@ -242,12 +805,12 @@ func (np *ProtocolNrv) preMarshal(obj interface{}) (newObj interface{}, err erro
 	return obj, err
 }
 
-func (np *ProtocolNrv) postUnmarshal(obj interface{}) (newObj interface{}, err error) {
+func postUnmarshal(obj interface{}, marshallers map[string]ProtocolMarshaller) (newObj interface{}, err error) {
 	switch obj.(type) {
 	case Map:
 		mp := obj.(Map)
 		for k, v := range mp {
-			mp[k], err = np.postUnmarshal(v)
+			mp[k], err = postUnmarshal(v, marshallers)
 			if err != nil {
 				return
 			}
@@ -256,7 +819,16 @@ func (np *ProtocolNrv) postUnmarshal(obj interface{}) (newObj interface{}, err e
 	case []interface{}:
 		ar := obj.([]interface{})
 		for i, v := range ar {
-			ar[i], err = np.postUnmarshal(v)
+			ar[i], err = postUnmarshal(v, marshallers)
+			if err != nil {
+				return
+			}
+		}
+
+	case Array:
+		ar := obj.(Array)
+		for i, v := range ar {
+			ar[i], err = postUnmarshal(v, marshallers)
 			if err != nil {
 				return
 			}
@@ -264,7 +836,7 @@ func (np *ProtocolNrv) postUnmarshal(obj interface{}) (newObj interface{}, err e
 
 	case *MarshalledObject:
 		mObj := obj.(*MarshalledObject)
-		marsh, found := np.marshallers[mObj.Name]
+		marsh, found := marshallers[mObj.Name]
 		if found {
 			return marsh.Unmarshal(mObj.Bytes)
 		} else {
@@ -276,31 +848,84 @@ func (np *ProtocolNrv) postUnmarshal(obj interface{}) (newObj interface{}, err e
 	return obj, err
 }
 
-func (np *ProtocolNrv) readMessage(reader io.Reader) (message *Message, err error) {
-	decoder := gob.NewDecoder(reader)
+// Decodes a message from a frame, unmarshalling objects of its data with the given
+// marshallers
+func readMessage(reader io.Reader, marshallers map[string]ProtocolMarshaller) (message *Message, err error) {
+	codecId, data, err := readRawFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(codecId, data, marshallers)
+}
 
-	message = &Message{}
-	err = decoder.Decode(message)
+// Decodes a message read by readRawFrame
+func decodeMessage(codecId byte, data []byte, marshallers map[string]ProtocolMarshaller) (*Message, error) {
+	codec, err := getCodec(codecId)
 	if err != nil {
 		return nil, err
 	}
 
-	var mParams interface{}
-	mParams, err = np.postUnmarshal(message.Data)
+	message, err := codec.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode %s message: %s", codec.CodecName(), err)
+	}
+	message.codec = codec
+
+	mParams, err := postUnmarshal(message.Data, marshallers)
 	if err != nil {
 		return nil, err
 	}
 	message.Data = mParams.(Map)
 
-	return message, err
+	return message, nil
+}
+
+// Keys of the last acknowledged datagrams received, oldest ones being forgotten
+type recentDatagrams struct {
+	keys  map[string]bool
+	order []string
+	next  int
+}
+
+func newRecentDatagrams(size int) *recentDatagrams {
+	return &recentDatagrams{
+		keys:  make(map[string]bool),
+		order: make([]string, size),
+	}
+}
+
+// Adds a key, returning false if it was already there
+func (r *recentDatagrams) add(key string) bool {
+	if r.keys[key] {
+		return false
+	}
+
+	delete(r.keys, r.order[r.next])
+	r.order[r.next] = key
+	r.next = (r.next + 1) % len(r.order)
+	r.keys[key] = true
+	return true
 }
 
+// Connection with another node, on which frames of many requests and replies can
+// be interleaved
 type nrvConnection struct {
-	conn  net.Conn
-	isTcp bool
+	conn       net.Conn
+	key        string
+	writeMutex sync.Mutex
+
+	// requests written waiting for a reply, to their node, nil once closed
+	pending map[*Request]*Node
 }
 
-func (c *nrvConnection) Release() {
-	// TODO: if tcp, release to pool
-	c.conn.Close()
+// Writes a whole frame within TCP_WRITE_TIMEOUT, frames of concurrent writers
+// never being mixed. Returns the number of bytes written.
+func (c *nrvConnection) write(frame []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(TCP_WRITE_TIMEOUT)); err != nil {
+		return 0, err
+	}
+	return c.conn.Write(frame)
 }
@@ -0,0 +1,394 @@
+package nrv
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a node with TCP and UDP ports free at the time of the call
+func newLocalNode(t *testing.T) *Node {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't find a free TCP port: %s", err)
+	}
+	defer tcp.Close()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't find a free UDP port: %s", err)
+	}
+	defer udp.Close()
+
+	return &Node{"127.0.0.1", tcp.Addr().(*net.TCPAddr).Port, udp.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func TestProtocolNrvUDP(t *testing.T) {
+	received := make(chan string, 10)
+	setup := func(cluster *StaticCluster) {
+		service := cluster.GetService("udp")
+		service.Bind(&Binding{
+			Path: "/gossip",
+			UDP:  true,
+			Closure: func(request *ReceivedRequest) {
+				received <- request.Data["value"].(string)
+			},
+		})
+		service.Bind(&Binding{
+			Path:       "/heartbeat",
+			UDP:        true,
+			UDPRetries: 3,
+			Closure: func(request *ReceivedRequest) {
+				received <- request.Data["value"].(string)
+			},
+		})
+	}
+
+	clusters := make([]*StaticCluster, 2)
+	for i := range clusters {
+		clusters[i] = NewStaticCluster(newLocalNode(t))
+		setup(clusters[i])
+		if err := clusters[i].Start(); err != nil {
+			t.Fatalf("Couldn't start cluster: %s", err)
+		}
+	}
+	defer func() {
+		for _, cluster := range clusters {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			cluster.Stop(ctx)
+			cancel()
+		}
+	}()
+
+	service := clusters[0].GetService("udp")
+	target := clusters[1].GetLocalNode()
+	expect := func(value string) {
+		select {
+		case got := <-received:
+			if got != value {
+				t.Fatalf("Expected %d bytes, got %d", len(value), len(got))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message of %d bytes wasn't received", len(value))
+		}
+	}
+
+	// nothing listens on this TCP port, so only UDP can deliver
+	udpOnly := &Node{target.Address, newLocalNode(t).TCPPort, target.UDPPort}
+	service.Call("/gossip", &Message{
+		Destination: NewServiceMembers(ServiceMember{Token(0), udpOnly}),
+		Data:        Map{"value": "hello"},
+	})
+	expect("hello")
+
+	// too big for a datagram, falls back to TCP
+	big := strings.Repeat("x", MAX_UDP_SIZE)
+	service.Call("/gossip", &Message{
+		Destination: NewServiceMembers(ServiceMember{Token(0), target}),
+		Data:        Map{"value": big},
+	})
+	expect(big)
+
+	// acknowledged
+	service.Call("/heartbeat", &Message{
+		Destination: NewServiceMembers(ServiceMember{Token(0), udpOnly}),
+		Data:        Map{"value": "beat"},
+	})
+	expect("beat")
+
+	protocol := clusters[0].GetDefaultProtocol().(*ProtocolNrv)
+	deadline := time.Now().Add(time.Second)
+	for {
+		protocol.udpMutex.Lock()
+		pending := len(protocol.udpAcks)
+		protocol.udpMutex.Unlock()
+		if pending == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Datagram was never acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProtocolNrvUDPDuplicates(t *testing.T) {
+	received := make(chan bool, 10)
+	cluster := NewStaticCluster(newLocalNode(t))
+	cluster.GetService("udp").BindClosure("/heartbeat", func(request *ReceivedRequest) {
+		received <- true
+	})
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("Couldn't start cluster: %s", err)
+	}
+	defer cluster.Stop(context.Background())
+
+	frame := &bytes.Buffer{}
+	message := &Message{ServiceName: "udp", Path: "/heartbeat", Data: Map{}}
+	if err := writeMessage(frame, message, GobCodec{}, nil); err != nil {
+		t.Fatalf("Couldn't encode message: %s", err)
+	}
+	datagram := func(epoch uint32) []byte {
+		return append(udpHeader(UDP_ACK_REQUEST, epoch, 42), frame.Bytes()...)
+	}
+
+	conn, err := net.Dial("udp", (&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: cluster.GetLocalNode().UDPPort}).String())
+	if err != nil {
+		t.Fatalf("Couldn't open UDP connection: %s", err)
+	}
+	defer conn.Close()
+
+	send := func(epoch uint32) {
+		conn.Write(datagram(epoch))
+
+		ack := make([]byte, MAX_UDP_SIZE)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(ack)
+		if err != nil || n != UDP_HEADER_SIZE || ack[0] != UDP_ACK {
+			t.Fatalf("Expected an ack for datagram 42, got %v %s", ack[:n], err)
+		}
+		if ackEpoch, ackSeq := readUDPHeader(ack); ackEpoch != epoch || ackSeq != 42 {
+			t.Fatalf("Expected an ack for datagram %d/42, got %d/%d", epoch, ackEpoch, ackSeq)
+		}
+	}
+
+	// sent twice as if the first ack got lost, both are acked
+	send(7)
+	send(7)
+
+	<-received
+	select {
+	case <-received:
+		t.Fatalf("Retransmitted datagram was handled twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// sender restarted with a new epoch, its sequence numbers start over
+	send(8)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("Datagram of a restarted sender was dropped as a duplicate")
+	}
+}
+
+func TestProtocolNrvMultiplexing(t *testing.T) {
+	clusters := make([]*StaticCluster, 2)
+	nodes := []*Node{newLocalNode(t), newLocalNode(t)}
+	for i := range clusters {
+		clusters[i] = NewStaticCluster(nodes[i])
+		service := clusters[i].GetService("mux")
+		// connections are only pooled for known nodes
+		for _, node := range nodes {
+			service.Members.Add(ServiceMember{Token(0), node})
+		}
+		service.BindClosure("/slow", func(request *ReceivedRequest) {
+			time.Sleep(300 * time.Millisecond)
+			request.Reply(Map{"done": "slow"})
+		})
+		service.BindClosure("/echo", func(request *ReceivedRequest) {
+			request.Reply(Map{"value": request.Data["value"]})
+		})
+		if err := clusters[i].Start(); err != nil {
+			t.Fatalf("Couldn't start cluster: %s", err)
+		}
+	}
+	defer func() {
+		for _, cluster := range clusters {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			cluster.Stop(ctx)
+			cancel()
+		}
+	}()
+
+	service := clusters[0].GetService("mux")
+	target := NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()})
+
+	slow := service.CallChan("/slow", &Message{Destination: target})
+
+	// fast requests aren't held by the slow one and get their own reply
+	replies := make([]chan *ReceivedRequest, 50)
+	for i := range replies {
+		replies[i] = service.CallChan("/echo", &Message{Destination: target, Data: Map{"value": i}})
+	}
+	for i, reply := range replies {
+		select {
+		case resp := <-reply:
+			if resp.Data["value"] != i {
+				t.Fatalf("Reply of request %d got value %v", i, resp.Data["value"])
+			}
+		case <-slow:
+			t.Fatalf("Fast request %d was held by the slow one", i)
+		case <-time.After(time.Second):
+			t.Fatalf("No reply for request %d", i)
+		}
+	}
+	if resp := <-slow; resp.Data["done"] != "slow" {
+		t.Fatalf("Unexpected slow reply: %v", resp.Data)
+	}
+
+	// requests and replies shared a single connection
+	for i, cluster := range clusters {
+		protocol := cluster.GetDefaultProtocol().(*ProtocolNrv)
+		protocol.connsMutex.Lock()
+		open := len(protocol.openConns)
+		protocol.connsMutex.Unlock()
+		if open != 1 {
+			t.Fatalf("Expected a single connection on node %d, got %d", i, open)
+		}
+	}
+}
+
+func TestProtocolNrvReconnect(t *testing.T) {
+	node := newLocalNode(t)
+	start := func() *StaticCluster {
+		cluster := NewStaticCluster(node)
+		cluster.GetService("mux").BindClosure("/echo", func(request *ReceivedRequest) {
+			request.Reply(Map{"value": request.Data["value"]})
+		})
+		if err := cluster.Start(); err != nil {
+			t.Fatalf("Couldn't start cluster: %s", err)
+		}
+		return cluster
+	}
+
+	client := NewStaticCluster(newLocalNode(t))
+	service := client.GetService("mux")
+	service.BindClosure("/echo", func(request *ReceivedRequest) {})
+	if err := client.Start(); err != nil {
+		t.Fatalf("Couldn't start cluster: %s", err)
+	}
+	defer client.Stop(context.Background())
+
+	target := NewServiceMembers(ServiceMember{Token(0), node})
+	call := func(i int) *ReceivedRequest {
+		select {
+		case resp := <-service.CallChan("/echo", &Message{Destination: target, Data: Map{"value": i}}):
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Request %d was lost", i)
+			return nil
+		}
+	}
+	for i := 0; i < 2; i++ {
+		server := start()
+
+		// the pooled connection closed by the previous server may not be seen as
+		// closed yet by the client, a request written on it failing
+		resp := call(i)
+		if i > 0 && resp.Error.Code == ERROR_UNAVAILABLE {
+			resp = call(i)
+		}
+		if resp.Data["value"] != i {
+			t.Fatalf("Expected value %d, got %v %s", i, resp.Data["value"], resp.Error)
+		}
+		server.Stop(context.Background())
+	}
+}
+
+func TestProtocolNrvConnectionClosed(t *testing.T) {
+	handling, release := make(chan bool), make(chan bool)
+	clusters := make([]*StaticCluster, 2)
+	for i := range clusters {
+		clusters[i] = NewStaticCluster(newLocalNode(t))
+		clusters[i].GetService("mux").BindClosure("/wait", func(request *ReceivedRequest) {
+			handling <- true
+			<-release
+			request.Reply(Map{})
+		})
+		if err := clusters[i].Start(); err != nil {
+			t.Fatalf("Couldn't start cluster: %s", err)
+		}
+	}
+	defer func() {
+		close(release)
+		for _, cluster := range clusters {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			cluster.Stop(ctx)
+			cancel()
+		}
+	}()
+
+	service := clusters[0].GetService("mux")
+	node := clusters[1].GetLocalNode()
+	replies := service.CallChan("/wait", &Message{Destination: NewServiceMembers(ServiceMember{Token(0), node})})
+	<-handling
+
+	// the node's reply would come back on its own connection, too late
+	protocol := clusters[0].GetDefaultProtocol().(*ProtocolNrv)
+	conn, err := protocol.getConnection(node)
+	if err != nil {
+		t.Fatalf("Couldn't get connection: %s", err)
+	}
+	protocol.closeConnection(conn)
+
+	select {
+	case resp := <-replies:
+		if resp.Error.Code != ERROR_UNAVAILABLE {
+			t.Fatalf("Expected an unavailable error, got %s", resp.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Request written on a closed connection never got a reply")
+	}
+
+	pattern := service.GetBinding("/wait").Pattern.(*PatternRequestReply)
+	if pattern.rdvsGauge.Value() != 0 {
+		t.Fatalf("Rendez-vous of the failed request is still pending")
+	}
+}
+
+func TestProtocolNrvConnectionPool(t *testing.T) {
+	node, member := newLocalNode(t), newLocalNode(t)
+	cluster := NewStaticCluster(node)
+	cluster.GetService("pool").Members.Add(ServiceMember{Token(0), member})
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("Couldn't start cluster: %s", err)
+	}
+	protocol := cluster.GetDefaultProtocol().(*ProtocolNrv)
+
+	// waits for the connection sending a hello to be tracked, as the count-th one
+	hello := func(key string, count int) net.Conn {
+		conn, err := net.Dial("tcp", nodeKey(node))
+		if err != nil {
+			t.Fatalf("Couldn't connect: %s", err)
+		}
+		writeHello(conn, key)
+		for i := 0; ; i++ {
+			protocol.connsMutex.Lock()
+			open := len(protocol.openConns)
+			protocol.connsMutex.Unlock()
+			if open >= count {
+				return conn
+			} else if i > 100 {
+				t.Fatalf("Connection from %s was never tracked", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	pooled := func(key string) bool {
+		protocol.connsMutex.Lock()
+		defer protocol.connsMutex.Unlock()
+		_, found := protocol.conns[key]
+		return found
+	}
+
+	unknown := hello("127.0.0.1:1", 1)
+	if pooled("127.0.0.1:1") {
+		t.Fatalf("Connection of an unknown node shouldn't be pooled")
+	}
+	known := hello(nodeKey(member), 2)
+	if !pooled(nodeKey(member)) {
+		t.Fatalf("Connection of a known node should be pooled")
+	}
+	unknown.Close()
+	known.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cluster.Stop(ctx)
+	if _, err := protocol.getConnection(member); err != errProtocolStopped {
+		t.Fatalf("Connections shouldn't be opened once stopped, got %v", err)
+	}
+}
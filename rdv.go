@@ -0,0 +1,109 @@
+package nrv
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// number of shards of a rendez-vous table, a power of 2
+const RDV_SHARDS = 32
+
+// Requests waiting for replies by rendez-vous id. Ids are drawn atomically and
+// requests are spread in shards by id so that concurrent requests and replies
+// rarely wait for each other.
+type rdvTable struct {
+	nextId uint32
+	shards [RDV_SHARDS]rdvShard
+}
+
+type rdvShard struct {
+	mutex   sync.Mutex
+	rdvs    map[uint32]*Request
+	stopped bool
+}
+
+func newRdvTable() *rdvTable {
+	table := &rdvTable{}
+	for i := range table.shards {
+		table.shards[i].rdvs = make(map[uint32]*Request)
+	}
+	return table
+}
+
+func (t *rdvTable) shard(id uint32) *rdvShard {
+	return &t.shards[id&(RDV_SHARDS-1)]
+}
+
+// Adds a request, returning its rendez-vous id, or 0 if the table is stopped. Ids
+// still in use by requests waiting since ids last wrapped around are skipped.
+func (t *rdvTable) add(request *Request) uint32 {
+	for {
+		id := atomic.AddUint32(&t.nextId, 1)
+		if id == 0 {
+			// 0 means no rendez-vous
+			continue
+		}
+
+		shard := t.shard(id)
+		shard.mutex.Lock()
+		if shard.stopped {
+			shard.mutex.Unlock()
+			return 0
+		}
+		if _, used := shard.rdvs[id]; !used {
+			shard.rdvs[id] = request
+			shard.mutex.Unlock()
+			return id
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// Returns the request a reply is for and whether it got all its replies, in which
+// case it is removed
+func (t *rdvTable) reply(id uint32) (*Request, bool) {
+	shard := t.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	request, found := shard.rdvs[id]
+	if !found {
+		return nil, false
+	}
+
+	request.respReceived++
+	if request.respReceived >= request.respNeeded {
+		delete(shard.rdvs, id)
+		return request, true
+	}
+	return request, false
+}
+
+// Removes a request, returning it if it was still waiting
+func (t *rdvTable) remove(id uint32) *Request {
+	shard := t.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	request, found := shard.rdvs[id]
+	if found {
+		delete(shard.rdvs, id)
+	}
+	return request
+}
+
+// Stops the table and returns requests still waiting, new ones being refused
+func (t *rdvTable) stop() []*Request {
+	var requests []*Request
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mutex.Lock()
+		for id, request := range shard.rdvs {
+			requests = append(requests, request)
+			delete(shard.rdvs, id)
+		}
+		shard.stopped = true
+		shard.mutex.Unlock()
+	}
+	return requests
+}
@@ -0,0 +1,218 @@
+package nrv
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRdvTable(t *testing.T) {
+	table := newRdvTable()
+
+	single := &Request{Message: &Message{}, respNeeded: 1}
+	double := &Request{Message: &Message{}, respNeeded: 2}
+	singleId := table.add(single)
+	doubleId := table.add(double)
+	if singleId == 0 || doubleId == 0 || singleId == doubleId {
+		t.Fatalf("Expected distinct rendez-vous ids, got %d and %d", singleId, doubleId)
+	}
+
+	if req, done := table.reply(singleId); req != single || !done {
+		t.Fatalf("Expected single request to be done after a reply")
+	}
+	if req, _ := table.reply(singleId); req != nil {
+		t.Fatalf("Single request should have been removed")
+	}
+
+	if req, done := table.reply(doubleId); req != double || done {
+		t.Fatalf("Expected double request to wait for a second reply")
+	}
+	if req, done := table.reply(doubleId); req != double || !done {
+		t.Fatalf("Expected double request to be done after two replies")
+	}
+
+	expiring := &Request{Message: &Message{}, respNeeded: 1}
+	expiringId := table.add(expiring)
+	if table.remove(expiringId) != expiring || table.remove(expiringId) != nil {
+		t.Fatalf("Expected expiring request to be removed once")
+	}
+
+	pending := &Request{Message: &Message{}, respNeeded: 1}
+	table.add(pending)
+	if requests := table.stop(); len(requests) != 1 || requests[0] != pending {
+		t.Fatalf("Expected pending request on stop, got %v", requests)
+	}
+	if id := table.add(&Request{Message: &Message{}, respNeeded: 1}); id != 0 {
+		t.Fatalf("Stopped table shouldn't accept requests, got id %d", id)
+	}
+}
+
+func TestRdvTableIdWrap(t *testing.T) {
+	table := newRdvTable()
+	pending := &Request{Message: &Message{}, respNeeded: 1}
+	pendingId := table.add(pending)
+	table.nextId = ^uint32(0) - 1
+
+	first := table.add(&Request{Message: &Message{}, respNeeded: 1})
+	second := table.add(&Request{Message: &Message{}, respNeeded: 1})
+	if first != ^uint32(0) || second != pendingId+1 {
+		t.Fatalf("Expected ids to skip 0 and ids in use when wrapping, got %d and %d", first, second)
+	}
+	if req, _ := table.reply(pendingId); req != pending {
+		t.Fatalf("Pending request was overwritten by a wrapped id")
+	}
+}
+
+func TestRdvTableConcurrent(t *testing.T) {
+	table := newRdvTable()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				request := &Request{Message: &Message{}, respNeeded: 1}
+				id := table.add(request)
+				if req, done := table.reply(id); req != request || !done {
+					t.Errorf("Got wrong request for rendez-vous %d", id)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := table.stop(); len(requests) != 0 {
+		t.Fatalf("Expected empty table, got %d requests", len(requests))
+	}
+}
+
+// Rendez-vous loop serializing every request and reply through channels and a
+// single goroutine, as the request/reply pattern used to do. Kept as a baseline
+// for the benchmarks.
+type chanRdvLoop struct {
+	rdvs    map[uint32]*Request
+	newRdv  chan chanNewRdv
+	getRdv  chan *chanGetRdv
+	rdvId   chan uint32
+	stopped chan bool
+}
+
+type chanNewRdv struct {
+	request *Request
+	sync    chan bool
+}
+
+type chanGetRdv struct {
+	id      uint32
+	request *Request
+	sync    chan bool
+}
+
+func newChanRdvLoop() *chanRdvLoop {
+	loop := &chanRdvLoop{
+		rdvs:    make(map[uint32]*Request),
+		newRdv:  make(chan chanNewRdv, 1),
+		getRdv:  make(chan *chanGetRdv, 1),
+		rdvId:   make(chan uint32, 100),
+		stopped: make(chan bool),
+	}
+	go func() {
+		var rdvId uint32 = 0
+		for {
+			rdvId++
+			select {
+			case loop.rdvId <- rdvId:
+			case <-loop.stopped:
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case rdv := <-loop.newRdv:
+				loop.rdvs[rdv.request.Message.SourceRdv] = rdv.request
+				rdv.sync <- true
+			case rdv := <-loop.getRdv:
+				if req, found := loop.rdvs[rdv.id]; found {
+					rdv.request = req
+					req.respReceived++
+					if req.respReceived >= req.respNeeded {
+						delete(loop.rdvs, rdv.id)
+					}
+				}
+				rdv.sync <- true
+			case <-loop.stopped:
+				return
+			}
+		}
+	}()
+	return loop
+}
+
+func (loop *chanRdvLoop) add(request *Request) uint32 {
+	request.Message.SourceRdv = <-loop.rdvId
+	sync := make(chan bool, 1)
+	loop.newRdv <- chanNewRdv{request, sync}
+	<-sync
+	return request.Message.SourceRdv
+}
+
+func (loop *chanRdvLoop) reply(id uint32) *Request {
+	rdv := &chanGetRdv{id: id, sync: make(chan bool, 1)}
+	loop.getRdv <- rdv
+	<-rdv.sync
+	return rdv.request
+}
+
+func BenchmarkRdvTable(b *testing.B) {
+	table := newRdvTable()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		request := &Request{Message: &Message{}}
+		for pb.Next() {
+			request.respReceived, request.respNeeded = 0, 1
+			id := table.add(request)
+			table.reply(id)
+		}
+	})
+}
+
+func BenchmarkRdvChannelLoop(b *testing.B) {
+	loop := newChanRdvLoop()
+	defer close(loop.stopped)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		request := &Request{Message: &Message{}}
+		for pb.Next() {
+			request.respReceived, request.respNeeded = 0, 1
+			id := loop.add(request)
+			loop.reply(id)
+		}
+	})
+}
+
+func BenchmarkPatternRequestReply(b *testing.B) {
+	cluster := NewStaticClusterWithProtocol(&Node{Address: "127.0.0.1"}, &ProtocolMemory{Switchboard: NewMemorySwitchboard()})
+	binding, _ := cluster.GetService("bench").BindClosure("/noop", func(request *ReceivedRequest) {})
+	pattern := binding.Pattern.(*PatternRequestReply)
+	pattern.SetNextHandler(nopHandler{})
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			request := &Request{Message: &Message{}, respNeeded: 1, OnReply: func(*ReceivedRequest) {}}
+			pattern.HandleRequestSend(request)
+			pattern.HandleRequestReceive(&ReceivedRequest{Message: &Message{DestinationRdv: request.Message.SourceRdv}})
+		}
+	})
+}
+
+type nopHandler struct{}
+
+func (h nopHandler) InitHandler(binding *Binding)                                   {}
+func (h nopHandler) SetNextHandler(handler CallHandler)                             {}
+func (h nopHandler) SetPreviousHandler(handler CallHandler)                         {}
+func (h nopHandler) HandleRequestSend(request *Request) *Request                    { return request }
+func (h nopHandler) HandleRequestReceive(request *ReceivedRequest) *ReceivedRequest { return request }
@@ -1,5 +1,9 @@
 package nrv
 
+import (
+	"fmt"
+)
+
 // Service resolver that resolve from a path to a member of the ring
 type Resolver interface {
 	CallHandler
@@ -28,7 +32,7 @@ func (r *ResolverPath) SetPreviousHandler(handler CallHandler) {
 
 func (r *ResolverPath) HandleRequestSend(request *Request) *Request {
 	if request.Message.IsDestinationEmpty() {
-		request.Message.Destination = r.binding.service.Resolve(HashToken(request.Message.Path), r.Count)
+		request.Message.Destination = r.binding.resolve(HashToken(request.Message.Path), r.Count)
 	}
 
 	request.respNeeded = request.Message.Destination.Len()
@@ -39,9 +43,11 @@ func (r *ResolverPath) HandleRequestReceive(request *ReceivedRequest) *ReceivedR
 	return r.previousHandler.HandleRequestReceive(request)
 }
 
-// Use first parameter to resolve token (/something/(<PARAM>)/...)
+// Use a path parameter to resolve token (/something/{param}/...), the first one if
+// Param is not set
 type ResolverParam struct {
 	Count		int
+	Param		string
 	binding         *Binding
 	nextHandler     CallHandler
 	previousHandler CallHandler
@@ -63,12 +69,17 @@ func (r *ResolverParam) HandleRequestSend(request *Request) *Request {
 	if request.Message.IsDestinationEmpty() {
 		data := r.binding.Matches(request.Message.Path)
 
+		name := r.Param
+		if name == "" {
+			name = "0"
+		}
+
 		var token Token = Token(0)
-		if param, found := data["0"]; found {
-			token = HashToken(param.(string))
+		if param, found := data[name]; found {
+			token = HashToken(fmt.Sprint(param))
 		}
 
-		request.Message.Destination = r.binding.service.Resolve(token, r.Count)
+		request.Message.Destination = r.binding.resolve(token, r.Count)
 	}
 
 	request.respNeeded = request.Message.Destination.Len()
@@ -0,0 +1,214 @@
+package nrv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Order in which parameter types are tried, most specific first
+var routeParamTypes = []string{"int", "uint", "float", "string"}
+
+var routeParamRegexps = make(map[string]*regexp.Regexp)
+
+func init() {
+	for _, typ := range routeParamTypes {
+		routeParamRegexps[typ] = regexp.MustCompile("^(?:" + pathParamTypes[typ] + ")$")
+	}
+}
+
+// Finds the binding of a path. Bindings whose path is only made of static segments
+// and placeholders are stored in a tree of segments where the most specific match
+// wins: static segments first, then typed parameters, string parameters and path
+// wildcards. Other bindings have raw regex paths that are tried in order when no
+// binding of the tree matches.
+//
+// Many bindings can share a path if they are restricted to different methods. A
+// binding without methods accepts any method not taken by another one.
+type router struct {
+	root    *routeNode
+	regexes []*Binding
+}
+
+type routeNode struct {
+	bindings []*Binding
+	static   map[string]*routeNode
+	params   map[string]*routeNode
+	wildcard []*Binding
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{
+		static: make(map[string]*routeNode),
+		params: make(map[string]*routeNode),
+	}
+}
+
+func newRouter() *router {
+	return &router{root: newRouteNode()}
+}
+
+// Adds a binding, returning an error if another binding has the same route
+func (r *router) add(binding *Binding) error {
+	segments := binding.path.segments
+	if segments == nil {
+		for _, other := range r.regexes {
+			if other.Path == binding.Path && methodsOverlap(binding.Methods, other.Methods) {
+				return fmt.Errorf("Path %s conflicts with binding %s", binding.Path, other)
+			}
+		}
+		r.regexes = append(r.regexes, binding)
+		return nil
+	}
+
+	node := r.root
+	for _, segment := range segments {
+		if segment.param == nil {
+			next, found := node.static[segment.static]
+			if !found {
+				next = newRouteNode()
+				node.static[segment.static] = next
+			}
+			node = next
+
+		} else if segment.param.typ == "path" {
+			return addRouteBinding(&node.wildcard, binding)
+
+		} else {
+			next, found := node.params[segment.param.typ]
+			if !found {
+				next = newRouteNode()
+				node.params[segment.param.typ] = next
+			}
+			node = next
+		}
+	}
+
+	return addRouteBinding(&node.bindings, binding)
+}
+
+func addRouteBinding(bindings *[]*Binding, binding *Binding) error {
+	for _, other := range *bindings {
+		if methodsOverlap(binding.Methods, other.Methods) {
+			return fmt.Errorf("Path %s conflicts with binding %s", binding.Path, other)
+		}
+	}
+	*bindings = append(*bindings, binding)
+	return nil
+}
+
+// Returns true if two bindings of the same path would accept a same method
+func methodsOverlap(methods, others []string) bool {
+	if len(methods) == 0 || len(others) == 0 {
+		return len(methods) == 0 && len(others) == 0
+	}
+	for _, method := range methods {
+		if containsMethod(others, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, other := range methods {
+		if other == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the binding matching the path and method and its parameters. If no
+// binding accepts the method but some match the path, their methods are returned.
+// An empty method matches any binding of the path.
+func (r *router) find(path, method string) (*Binding, Map, []string) {
+	var allowed []string
+	if binding := r.root.find(strings.Split(path, "/"), method, &allowed); binding != nil {
+		if params := binding.Matches(path); params != nil {
+			return binding, params, nil
+		}
+	}
+
+	for _, binding := range r.regexes {
+		if params := binding.Matches(path); params != nil {
+			if selectBinding([]*Binding{binding}, method) != nil {
+				return binding, params, nil
+			}
+			allowed = appendMethods(allowed, []*Binding{binding})
+		}
+	}
+
+	return nil, nil, allowed
+}
+
+// Selects the binding restricted to the method or else the one accepting any method
+func selectBinding(bindings []*Binding, method string) *Binding {
+	var anyMethod *Binding
+	for _, binding := range bindings {
+		if len(binding.Methods) == 0 {
+			anyMethod = binding
+		} else if method != "" && containsMethod(binding.Methods, method) {
+			return binding
+		}
+	}
+
+	if anyMethod == nil && method == "" {
+		return bindings[0]
+	}
+	return anyMethod
+}
+
+func appendMethods(methods []string, bindings []*Binding) []string {
+	for _, binding := range bindings {
+		for _, method := range binding.Methods {
+			if !containsMethod(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
+}
+
+// Returns the most specific binding of the segments accepting the method. Less
+// specific routes are tried when more specific ones don't accept it, the methods
+// they accept being added to allowed.
+func (n *routeNode) find(segments []string, method string, allowed *[]string) *Binding {
+	if len(segments) == 0 {
+		return selectRoute(n.bindings, method, allowed)
+	}
+
+	segment, rest := segments[0], segments[1:]
+	if next, found := n.static[segment]; found {
+		if binding := next.find(rest, method, allowed); binding != nil {
+			return binding
+		}
+	}
+
+	if segment != "" {
+		for _, typ := range routeParamTypes {
+			next, found := n.params[typ]
+			if found && routeParamRegexps[typ].MatchString(segment) {
+				if binding := next.find(rest, method, allowed); binding != nil {
+					return binding
+				}
+			}
+		}
+	}
+
+	if segment != "" || len(rest) > 0 {
+		return selectRoute(n.wildcard, method, allowed)
+	}
+	return nil
+}
+
+func selectRoute(bindings []*Binding, method string, allowed *[]string) *Binding {
+	if len(bindings) == 0 {
+		return nil
+	}
+	if binding := selectBinding(bindings, method); binding != nil {
+		return binding
+	}
+	*allowed = appendMethods(*allowed, bindings)
+	return nil
+}
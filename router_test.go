@@ -0,0 +1,93 @@
+package nrv
+
+import (
+	"testing"
+)
+
+func TestRouterPrecedence(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("router")
+
+	paths := []string{
+		"/files/{rest:path}",
+		"/users/{name}",
+		"/users/{id:int}",
+		"/users/me",
+		"/users/{id:int}/posts",
+		"/users/{name}/profile",
+		"/legacy/(.*)",
+	}
+	for _, path := range paths {
+		if _, err := service.BindClosure(path, func(request *ReceivedRequest) {}); err != nil {
+			t.Fatalf("Couldn't bind %s: %s", path, err)
+		}
+	}
+
+	expected := map[string]string{
+		"/users/me":          "/users/me",
+		"/users/42":          "/users/{id:int}",
+		"/users/bob":         "/users/{name}",
+		"/users/42/posts":    "/users/{id:int}/posts",
+		"/users/42/profile":  "/users/{name}/profile",
+		"/files/a/b/c.txt":   "/files/{rest:path}",
+		"/legacy/anything/x": "/legacy/(.*)",
+		"/users/me/unknown":  "",
+		"/users":             "",
+	}
+	for path, bindingPath := range expected {
+		binding, params := service.FindBinding(path)
+		if bindingPath == "" {
+			if binding != nil {
+				t.Fatalf("Path %s shouldn't match, got %s", path, binding)
+			}
+		} else if binding == nil || binding.Path != bindingPath {
+			t.Fatalf("Path %s should match %s, got %v", path, bindingPath, binding)
+		} else if params == nil {
+			t.Fatalf("Path %s should have parameters", path)
+		}
+	}
+
+	if _, params := service.FindBinding("/files/a/b"); params["rest"] != "a/b" {
+		t.Fatalf("Wildcard should capture the rest of the path: %v", params)
+	}
+}
+
+func TestRouterConflicts(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("router")
+
+	service.BindClosure("/users/{id:int}", func(request *ReceivedRequest) {})
+	service.BindClosure("/files/{rest:path}", func(request *ReceivedRequest) {})
+	service.BindClosure("/raw/(.*)", func(request *ReceivedRequest) {})
+
+	conflicting := []string{"/users/{other:int}", "/files/{all:path}", "/raw/(.*)"}
+	for _, path := range conflicting {
+		if _, err := service.BindClosure(path, func(request *ReceivedRequest) {}); err == nil {
+			t.Fatalf("Binding %s should conflict", path)
+		}
+	}
+
+	if len(service.bindings) != 3 {
+		t.Fatalf("Conflicting bindings shouldn't be added: %d", len(service.bindings))
+	}
+}
+
+func TestRouterMethodFallback(t *testing.T) {
+	cluster := NewStaticCluster(&Node{"127.0.0.1", 0, 0})
+	service := cluster.GetService("router")
+
+	get, _ := service.BindClosure("/users/{id:int}", func(request *ReceivedRequest) {}, "GET")
+	post, _ := service.BindClosure("/users/{name}", func(request *ReceivedRequest) {}, "POST")
+
+	if binding, _, _ := service.FindBindingMethod("/users/42", "GET"); binding != get {
+		t.Fatalf("Expected the most specific binding for GET, got %s", binding)
+	}
+	if binding, params, _ := service.FindBindingMethod("/users/42", "POST"); binding != post || params["name"] != "42" {
+		t.Fatalf("Expected a less specific binding accepting POST, got %s %v", binding, params)
+	}
+
+	binding, _, allowed := service.FindBindingMethod("/users/42", "DELETE")
+	if binding != nil || len(allowed) != 2 {
+		t.Fatalf("Expected methods of every matching route, got %s %v", binding, allowed)
+	}
+}
@@ -1,16 +1,23 @@
 package nrv
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"fmt"
 	"sort"
+	"strings"
+	"sync"
 )
 
 type Service struct {
 	Name            string
 	DefaultProtocol Protocol
+	Interceptors    []InterceptorFactory
 
 	cluster  Cluster
 	bindings []*Binding
+	router   *router
 	Members  *ServiceMembers
 }
 
@@ -18,6 +25,7 @@ func newService(cluster Cluster) *Service {
 	return &Service{
 		cluster:  cluster,
 		bindings: make([]*Binding, 0),
+		router:   newRouter(),
 		Members:  NewServiceMembers(),
 	}
 }
@@ -30,20 +38,27 @@ func (s *Service) GetDefaultProtocol() Protocol {
 	return s.cluster.GetDefaultProtocol()
 }
 
-func (s *Service) Bind(binding *Binding) *Binding {
+func (s *Service) Bind(binding *Binding) (*Binding, error) {
+	if err := binding.init(s, s.cluster); err != nil {
+		return nil, err
+	}
+	if err := s.router.add(binding); err != nil {
+		return nil, err
+	}
 	s.bindings = append(s.bindings, binding)
-	binding.init(s, s.cluster)
-	return binding
+	return binding, nil
 }
 
-func (s *Service) BindClosure(path string, closure func(request *ReceivedRequest)) *Binding {
+// Binds a closure to a path, optionally restricted to some HTTP methods
+func (s *Service) BindClosure(path string, closure func(request *ReceivedRequest), methods ...string) (*Binding, error) {
 	return s.Bind(&Binding{
 		Path:    path,
 		Closure: closure,
+		Methods: methods,
 	})
 }
 
-func (s *Service) BindMethod(path string, controller interface{}, method string) *Binding {
+func (s *Service) BindMethod(path string, controller interface{}, method string) (*Binding, error) {
 	return s.Bind(&Binding{
 		Path:       path,
 		Controller: controller,
@@ -51,7 +66,52 @@ func (s *Service) BindMethod(path string, controller interface{}, method string)
 	})
 }
 
-func (s *Service) Reverse(controller interface{}, method string, params ...string) string {
+// Binds a typed handler func(ctx, *ReceivedRequest, *In) (*Out, error), optionally
+// restricted to some HTTP methods
+func (s *Service) BindHandler(path string, handler interface{}, methods ...string) (*Binding, error) {
+	return s.Bind(&Binding{
+		Path:    path,
+		Handler: handler,
+		Methods: methods,
+	})
+}
+
+// Returns the first binding bound with the given path, which is not matched
+func (s *Service) GetBinding(path string) *Binding {
+	for _, binding := range s.bindings {
+		if binding.Path == path {
+			return binding
+		}
+	}
+	return nil
+}
+
+// Returns the first binding bound with the given path and accepting exactly the
+// given methods, any if none are given
+func (s *Service) GetBindingMethods(path string, methods ...string) *Binding {
+	for _, binding := range s.bindings {
+		if binding.Path == path && sameMethods(binding.Methods, methods) {
+			return binding
+		}
+	}
+	return nil
+}
+
+func sameMethods(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, method := range b {
+		if !containsMethod(a, strings.ToUpper(method)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the path of the binding of a controller method, its parameters given in
+// order or by name in a single Map
+func (s *Service) Reverse(controller interface{}, method string, params ...interface{}) string {
 	for _, binding := range s.bindings {
 		if binding.MatchesMethod(controller, method) {
 			return binding.GetPath(params...)
@@ -61,20 +121,51 @@ func (s *Service) Reverse(controller interface{}, method string, params ...strin
 	return ""
 }
 
+// Returns the most specific binding matching the path and the path's parameters.
+// If many bindings of the path are restricted to methods, the one accepting any
+// method is preferred, else the first one bound.
 func (s *Service) FindBinding(path string) (*Binding, Map) {
-	for _, binding := range s.bindings {
-		if m := binding.Matches(path); m != nil {
-			Log.Debug("Found matching binding for %s: %s", path, binding)
-			return binding, m
-		}
+	binding, params, _ := s.FindBindingMethod(path, "")
+	return binding, params
+}
+
+// Returns the most specific binding matching the path and accepting the method. If
+// some bindings match the path but not the method, the methods they accept are
+// returned.
+func (s *Service) FindBindingMethod(path, method string) (*Binding, Map, []string) {
+	binding, params, allowed := s.router.find(path, method)
+	if binding != nil {
+		Log.Debug("Found matching binding for %s %s: %s", method, path, binding)
 	}
-	return nil, nil
+	return binding, params, allowed
 }
 
 func (s *Service) CallWait(path string, reqBuild RequestBuilder) *ReceivedRequest {
 	return <-s.CallChan(path, reqBuild)
 }
 
+// Calls a path and waits for its reply until the context is done, in which case
+// the request stops waiting and the reply has an ERROR_TIMEOUT or ERROR_CANCELLED
+// error, depending on the context's error
+func (s *Service) CallWaitContext(ctx context.Context, path string, reqBuild RequestBuilder) *ReceivedRequest {
+	request := reqBuild.ToRequest()
+	c := s.CallChan(path, request)
+	select {
+	case resp := <-c:
+		return resp
+	case <-ctx.Done():
+		// only requests waiting in a rendez-vous can be abandoned, others may never
+		// get a reply
+		if request.abandon == nil {
+			return newContextReply(ctx.Err())
+		}
+		request.abandon(newContextReply(ctx.Err()))
+
+		// either the reply that raced with the context, or the abandon reply
+		return <-c
+	}
+}
+
 func (s *Service) CallChan(path string, reqBuild RequestBuilder) chan *ReceivedRequest {
 	request := reqBuild.ToRequest()
 	c := request.ReplyChan()
@@ -84,7 +175,7 @@ func (s *Service) CallChan(path string, reqBuild RequestBuilder) chan *ReceivedR
 
 func (s *Service) Call(path string, reqBuild RequestBuilder) {
 	request := reqBuild.ToRequest()
-	b, _ := s.FindBinding(path)
+	b, _, _ := s.FindBindingMethod(path, strings.ToUpper(request.Message.Method))
 
 	if b == nil {
 		Log.Error("Service> Cannot find binding for path %s", path)
@@ -93,7 +184,7 @@ func (s *Service) Call(path string, reqBuild RequestBuilder) {
 		if request.OnReply != nil {
 			request.handleReply(&ReceivedRequest{
 				Message: &Message{
-					Error: Error{"Path not found", 404},
+					Error: Error{"Path not found", ERROR_NOT_FOUND},
 				},
 			})
 		}
@@ -105,23 +196,46 @@ func (s *Service) Call(path string, reqBuild RequestBuilder) {
 }
 
 func (s *Service) Resolve(token Token, count int) *ServiceMembers {
+	return s.ResolveAvailable(token, count, nil)
+}
+
+// Returns the members of count different nodes responsible for a token: the member
+// with the greatest token lower or equal to it, wrapping around the ring, and the
+// following ones. Nodes for which available returns false are skipped, unless there
+// aren't enough other nodes.
+func (s *Service) ResolveAvailable(token Token, count int, available func(node *Node) bool) *ServiceMembers {
 	ret := NewServiceMembers()
+	ring := s.Members.Slice()
+	if len(ring) == 0 {
+		return ret
+	}
 
-	// TODO: support for count
+	// token is before the first member, wrap around the ring to the last one
+	start := len(ring) - 1
+	for i, member := range ring {
+		if member.Token <= token {
+			start = i
+		}
+	}
 
-	var candidate *ServiceMember
-	for _, member := range s.Members.Slice {
-		if member.Token <= token && (candidate == nil || candidate.Token < member.Token) {
-			candidate = &member
+	var unavailable []ServiceMember
+	for i := 0; i < len(ring) && ret.Len() < count; i++ {
+		member := ring[(start+i)%len(ring)]
+		if ret.Contains(member.Node) {
+			continue
+		} else if available != nil && !available(member.Node) {
+			unavailable = append(unavailable, member)
+			continue
 		}
+		ret.Add(member)
 	}
 
-	if candidate == nil {
-		if s.Members.Empty() {
-			ret.Add(s.Members.Get(0))
+	for _, member := range unavailable {
+		if ret.Len() >= count {
+			break
+		} else if !ret.Contains(member.Node) {
+			ret.Add(member)
 		}
-	} else {
-		ret.Add(*candidate)
 	}
 
 	return ret
@@ -133,43 +247,93 @@ type ServiceMember struct {
 	Node  *Node
 }
 
+// Members of a service ring, sorted by token. Members of a service are changed
+// while requests are resolved, so changes replace the whole slice under a lock and
+// readers get a snapshot that they must not modify.
 type ServiceMembers struct {
-	Slice []ServiceMember
+	mutex sync.RWMutex
+	slice []ServiceMember
 }
 
 func NewServiceMembers(members ...ServiceMember) *ServiceMembers {
-	return &ServiceMembers{members}
+	return &ServiceMembers{slice: members}
 }
 
 func (sm *ServiceMembers) String() string {
-	return fmt.Sprintf("%s", sm.Slice)
+	return fmt.Sprintf("%v", sm.Slice())
+}
+
+// Returns a snapshot of the members, unaffected by later changes
+func (sm *ServiceMembers) Slice() []ServiceMember {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.slice
 }
 
 func (sm *ServiceMembers) Get(i int) ServiceMember {
 	// FIXME: what if no node???
-	return sm.Slice[i]
+	return sm.Slice()[i]
 }
 
 func (sm *ServiceMembers) Add(member ServiceMember) {
-	sm.Slice = append(sm.Slice, member)
-	sort.Sort(sm)
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	members := make([]ServiceMember, len(sm.slice), len(sm.slice)+1)
+	copy(members, sm.slice)
+	members = append(members, member)
+	sort.Slice(members, func(i, j int) bool { return members[i].Token < members[j].Token })
+	sm.slice = members
+}
+
+// Removes all members on the given node
+func (sm *ServiceMembers) Remove(node *Node) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	members := make([]ServiceMember, 0, len(sm.slice))
+	for _, member := range sm.slice {
+		if !member.Node.Is(node) {
+			members = append(members, member)
+		}
+	}
+	sm.slice = members
+}
+
+func (sm *ServiceMembers) Contains(node *Node) bool {
+	for _, member := range sm.Slice() {
+		if member.Node.Is(node) {
+			return true
+		}
+	}
+	return false
 }
 
 func (sm *ServiceMembers) Len() int {
-	return len(sm.Slice)
+	return len(sm.Slice())
 }
 
 func (sm *ServiceMembers) Empty() bool {
-	if sm == nil || len(sm.Slice) == 0 {
+	if sm == nil || sm.Len() == 0 {
 		return true
 	}
 	return false
 }
 
-func (sm *ServiceMembers) Less(i, j int) bool {
-	return sm.Slice[i].Token < sm.Slice[j].Token
+// Members are encoded by gob as their slice, the lock not being exported
+func (sm *ServiceMembers) GobEncode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(sm.Slice())
+	return buf.Bytes(), err
 }
 
-func (sm *ServiceMembers) Swap(i, j int) {
-	sm.Slice[i], sm.Slice[j] = sm.Slice[i], sm.Slice[i]
+func (sm *ServiceMembers) GobDecode(data []byte) error {
+	var members []ServiceMember
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&members); err != nil {
+		return err
+	}
+	sm.mutex.Lock()
+	sm.slice = members
+	sm.mutex.Unlock()
+	return nil
 }
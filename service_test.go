@@ -0,0 +1,122 @@
+package nrv
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestServiceResolveCount(t *testing.T) {
+	service := NewStaticCluster(&Node{"127.0.0.1", 0, 0}).GetService("ring")
+	for i := 0; i < 3; i++ {
+		service.Members.Add(ServiceMember{Token(uint32(i) * 100), &Node{"127.0.0.1", 1000 + i, 0}})
+	}
+	// another token on the first node
+	service.Members.Add(ServiceMember{Token(250), &Node{"127.0.0.1", 1000, 0}})
+
+	ports := func(members *ServiceMembers) []int {
+		var ret []int
+		for _, member := range members.Slice() {
+			ret = append(ret, member.Node.TCPPort)
+		}
+		return ret
+	}
+
+	if p := ports(service.Resolve(Token(150), 1)); len(p) != 1 || p[0] != 1001 {
+		t.Fatalf("Expected node 1001, got %v", p)
+	}
+
+	// wraps around the ring and skips members of nodes already taken, members
+	// being sorted by token
+	if p := ports(service.Resolve(Token(260), 2)); len(p) != 2 || p[0] != 1001 || p[1] != 1000 {
+		t.Fatalf("Expected nodes 1000 and 1001, got %v", p)
+	}
+	if p := ports(service.Resolve(Token(150), 10)); len(p) != 3 {
+		t.Fatalf("Expected all 3 nodes, got %v", p)
+	}
+
+	unavailable := func(node *Node) bool { return node.TCPPort != 1001 }
+	if p := ports(service.ResolveAvailable(Token(150), 1, unavailable)); len(p) != 1 || p[0] != 1002 {
+		t.Fatalf("Expected node 1002 to replace unavailable 1001, got %v", p)
+	}
+}
+
+func TestServiceMembersConcurrent(t *testing.T) {
+	service := NewStaticCluster(&Node{"127.0.0.1", 0, 0}).GetService("ring")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			node := &Node{"127.0.0.1", 1000 + i, 0}
+			service.Members.Add(ServiceMember{Token(uint32(i) * 100), node})
+			service.Members.Remove(node)
+		}
+		close(done)
+	}()
+
+	// resolving while members join and leave sees a consistent ring
+	for {
+		select {
+		case <-done:
+			if !service.Members.Empty() {
+				t.Fatalf("Expected no members, got %s", service.Members)
+			}
+			return
+		default:
+			if members := service.Resolve(Token(150), 1); members.Len() > 1 {
+				t.Fatalf("Expected at most 1 member, got %s", members)
+			}
+		}
+	}
+}
+
+func TestServiceCallWaitContext(t *testing.T) {
+	release, replied := make(chan bool), make(chan bool)
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		service.BindClosure("/wait", func(request *ReceivedRequest) {
+			<-release
+			request.Reply(Map{})
+			close(replied)
+		})
+	})
+	defer stopClusters(clusters)
+
+	service := clusters[0].GetService("mem")
+	dest := NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := (&Message{Destination: dest}).ToRequest()
+	resp := service.CallWaitContext(ctx, "/wait", request)
+	if resp.Error.Code != ERROR_CANCELLED {
+		t.Fatalf("Expected a cancelled error, got %s", resp.Error)
+	}
+
+	pattern := service.GetBinding("/wait").Pattern.(*PatternRequestReply)
+	if pattern.rdvsGauge.Value() != 0 || pattern.getRdvs().remove(request.Message.SourceRdv) != nil {
+		t.Fatalf("Rendez-vous of the cancelled request is still pending")
+	}
+
+	// the late reply is ignored
+	close(release)
+	<-replied
+}
+
+func TestServiceCallWaitContextWithoutRendezVous(t *testing.T) {
+	clusters := newMemoryClusters(t, NewMemorySwitchboard(), 2, func(cluster *StaticCluster, service *Service) {
+		// the pattern doesn't track requests, the sender never gets a reply
+		service.Bind(&Binding{
+			Path:    "/noreply",
+			Pattern: &BaseHandler{},
+			Closure: func(request *ReceivedRequest) {},
+		})
+	})
+	defer stopClusters(clusters)
+
+	service := clusters[0].GetService("mem")
+	dest := NewServiceMembers(ServiceMember{Token(0), clusters[1].GetLocalNode()})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	resp := service.CallWaitContext(ctx, "/noreply", &Message{Destination: dest})
+	if resp.Error.Code != ERROR_TIMEOUT {
+		t.Fatalf("Expected a timeout error, got %s", resp.Error)
+	}
+}
@@ -0,0 +1,217 @@
+package nrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	Tracing *Tracer = NewTracer(nil)
+)
+
+const (
+	SPAN_CLIENT = "CLIENT"
+	SPAN_SERVER = "SERVER"
+)
+
+// Creates spans for requests sent and received and exports them once finished
+// to its sink. Trace and span ids are carried in messages so that each remote
+// hop creates a child span.
+type Tracer struct {
+	Sink SpanSink
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func NewTracer(sink SpanSink) *Tracer {
+	return &Tracer{
+		Sink: sink,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (t *Tracer) newId() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var id uint64
+	for id == 0 {
+		id = uint64(t.rand.Int63())
+	}
+	return id
+}
+
+// Starts a new span in the given trace. A zero trace id starts a new trace.
+func (t *Tracer) StartSpan(name, kind string, traceId, parentId uint64) *Span {
+	if traceId == 0 {
+		traceId = t.newId()
+		parentId = 0
+	}
+
+	return &Span{
+		tracer:   t,
+		TraceId:  traceId,
+		Id:       t.newId(),
+		ParentId: parentId,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		Tags:     make(map[string]string),
+	}
+}
+
+// Unit of work in a trace, exported in Zipkin v2 JSON format
+type Span struct {
+	TraceId  uint64
+	Id       uint64
+	ParentId uint64
+	Name     string
+	Kind     string
+
+	ServiceName string
+	Node        *Node
+
+	Start    time.Time
+	Duration time.Duration
+	Tags     map[string]string
+
+	tracer   *Tracer
+	finished bool
+	mutex    sync.Mutex
+}
+
+func (s *Span) SetTag(key, value string) {
+	s.mutex.Lock()
+	s.Tags[key] = value
+	s.mutex.Unlock()
+}
+
+// Finishes the span and exports it. Only the first call has any effect.
+func (s *Span) Finish() {
+	s.mutex.Lock()
+	if s.finished {
+		s.mutex.Unlock()
+		return
+	}
+	s.finished = true
+	s.Duration = time.Now().Sub(s.Start)
+	s.mutex.Unlock()
+
+	if s.tracer != nil && s.tracer.Sink != nil {
+		if err := s.tracer.Sink.Export(s); err != nil {
+			Log.Error("Tracer> Couldn't export span %s: %s", s, err)
+		}
+	}
+}
+
+func (s *Span) finishReply(message *Message) {
+	if message != nil && !message.Error.Empty() {
+		s.SetTag("error", message.Error.Error())
+	}
+	s.Finish()
+}
+
+func (s *Span) String() string {
+	return fmt.Sprintf("[Span %016x:%016x %s]", s.TraceId, s.Id, s.Name)
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type zipkinSpan struct {
+	TraceId       string            `json:"traceId"`
+	Id            string            `json:"id"`
+	ParentId      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint *zipkinEndpoint   `json:"localEndpoint,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+func (s *Span) MarshalJSON() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	zs := zipkinSpan{
+		TraceId:   fmt.Sprintf("%016x", s.TraceId),
+		Id:        fmt.Sprintf("%016x", s.Id),
+		Name:      s.Name,
+		Kind:      s.Kind,
+		Timestamp: s.Start.UnixNano() / 1000,
+		Duration:  int64(s.Duration / time.Microsecond),
+		Tags:      s.Tags,
+	}
+	if s.ParentId != 0 {
+		zs.ParentId = fmt.Sprintf("%016x", s.ParentId)
+	}
+	if s.ServiceName != "" || s.Node != nil {
+		zs.LocalEndpoint = &zipkinEndpoint{ServiceName: s.ServiceName}
+		if s.Node != nil {
+			zs.LocalEndpoint.IPv4 = s.Node.Address
+			zs.LocalEndpoint.Port = s.Node.TCPPort
+		}
+	}
+
+	return json.Marshal(zs)
+}
+
+// Destination of finished spans
+type SpanSink interface {
+	Export(span *Span) error
+}
+
+// Writes spans to a file, one Zipkin v2 JSON span per line
+type FileSpanSink struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func NewFileSpanSink(path string) (*FileSpanSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSpanSink{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (fs *FileSpanSink) Export(span *Span) error {
+	bytes, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if _, err = fs.writer.Write(bytes); err != nil {
+		return err
+	}
+	if err = fs.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	return fs.writer.Flush()
+}
+
+func (fs *FileSpanSink) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.writer.Flush()
+	return fs.file.Close()
+}
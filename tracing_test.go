@@ -0,0 +1,69 @@
+package nrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTracingPropagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	sink, err := NewFileSpanSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTracing := Tracing
+	Tracing = NewTracer(sink)
+	defer func() { Tracing = oldTracing }()
+
+	node := &Node{"127.0.0.1", 0, 0}
+	cluster := NewStaticCluster(node)
+	service := cluster.GetService("tracing")
+	service.Members.Add(ServiceMember{Token(0), node})
+	service.BindClosure("/front", func(request *ReceivedRequest) {
+		resp := service.CallWait("/back", request.ChildRequest(Map{}))
+		request.Reply(resp.Data)
+	})
+	service.BindClosure("/back", func(request *ReceivedRequest) {
+		request.Reply(Map{"ok": true})
+	})
+
+	service.CallWait("/front", &Message{})
+	sink.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	spans := make(map[string]map[string]interface{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		span := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("Invalid span %s: %s", scanner.Text(), err)
+		}
+		spans[span["name"].(string)] = span
+	}
+
+	if len(spans) != 4 {
+		t.Fatalf("Expected 4 spans, got %d: %v", len(spans), spans)
+	}
+
+	chain := []string{"send tracing:/front", "receive tracing:/front", "send tracing:/back", "receive tracing:/back"}
+	for i, name := range chain {
+		span, found := spans[name]
+		if !found {
+			t.Fatalf("Missing span %s", name)
+		}
+		if span["traceId"] != spans[chain[0]]["traceId"] {
+			t.Fatalf("Span %s is not in the same trace", name)
+		}
+		if i > 0 && span["parentId"] != spans[chain[i-1]]["id"] {
+			t.Fatalf("Span %s is not a child of %s", name, chain[i-1])
+		}
+	}
+}